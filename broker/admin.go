@@ -0,0 +1,97 @@
+/*-------------------------------------------*/
+/*            管理员权限控制 admin.go          */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 管理员组织的MSP ID在账本中的key
+const AdminMSP = "admin-msp"
+
+// 只允许管理员组织调用的函数
+var adminFuncs = map[string]bool{
+	"setAdminMSP":         true,
+	"setPrivateKey":       true,
+	"modifyPAPPIP":        true,
+	"setPAPPTransport":    true,
+	"setPAPPEndpoints":    true,
+	"setReversalFunc":     true,
+	"setTransferFunc":     true,
+	"setFingerprintSalt":  true,
+	"resetVerifyFailures": true,
+	"registerChain":       true,
+	"removeChain":         true,
+	"setChainVerifier":    true,
+	"setRelayers":         true,
+	"registerService":     true,
+	"removeService":       true,
+}
+
+// 初始化管理员组织：未指定时为调用Init的组织；已初始化时只能通过setAdminMSP更换
+func (broker *Broker) initAdmin(stub shim.ChaincodeStubInterface, mspID string) error {
+	stored, err := stub.GetState(AdminMSP)
+	if err != nil {
+		return err
+	}
+	if stored != nil {
+		if mspID != "" && mspID != string(stored) {
+			return fmt.Errorf("admin MSP already initialized as %s, use setAdminMSP to change it", string(stored))
+		}
+		return nil
+	}
+	if mspID == "" {
+		if mspID, err = cid.GetMSPID(stub); err != nil {
+			return fmt.Errorf("get creator MSP ID error: %w", err)
+		}
+	}
+	return stub.PutState(AdminMSP, []byte(mspID))
+}
+
+// 校验调用者是否属于管理员组织
+func (broker *Broker) checkAdmin(stub shim.ChaincodeStubInterface) error {
+	stored, err := stub.GetState(AdminMSP)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return codeErrorf(CodeNotInitialized, "admin MSP not initialized")
+	}
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return fmt.Errorf("get creator MSP ID error: %w", err)
+	}
+	if mspID != string(stored) {
+		return codeErrorf(CodeAccessDenied, "access denied: %s is not the admin MSP", mspID)
+	}
+	return nil
+}
+
+// 更换管理员组织
+// args[0] 新的管理员组织MSP ID
+func (broker *Broker) setAdminMSP(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || args[0] == "" {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+	if err := stub.PutState(AdminMSP, []byte(args[0])); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 查询管理员组织
+func (broker *Broker) getAdminMSP(stub shim.ChaincodeStubInterface) pb.Response {
+	stored, err := stub.GetState(AdminMSP)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if stored == nil {
+		return shim.Error(FormatError(CodeNotInitialized, "admin MSP not initialized"))
+	}
+	return shim.Success(stored)
+}
@@ -0,0 +1,417 @@
+/*-------------------------------------------*/
+/*            发票归集模块 aggregate.go        */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	capabilityAggregateQuery = "InterchainAggregateQuery"
+
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// 归集条件，各条件同时满足
+type AggregateFilter struct {
+	BuyerTaxID  string   `json:"gmfsbh,omitempty"`    //购买方纳税人识别号
+	SellerTaxID string   `json:"xsfsbh,omitempty"`    //销售方纳税人识别号
+	DateFrom    string   `json:"dateFrom,omitempty"`  //开票日期起，YYYY-MM-DD，含当天
+	DateTo      string   `json:"dateTo,omitempty"`    //开票日期止，YYYY-MM-DD，含当天
+	AmountMin   string   `json:"amountMin,omitempty"` //金额下限，含
+	AmountMax   string   `json:"amountMax,omitempty"` //金额上限，含
+	Status      []string `json:"zt,omitempty"`        //发票状态，满足其一即可
+}
+
+// 归集请求：归集条件、目的链、排序与分页
+type AggregateCriteria struct {
+	AggregateFilter
+	Chains   []string `json:"chains,omitempty"`   //目的链ID列表，为空时发往所有支持InterchainAggregateQuery的已注册链
+	SortBy   string   `json:"sortBy,omitempty"`   //排序字段：kprq、je、se、fphm，默认kprq
+	Desc     bool     `json:"desc,omitempty"`     //是否倒序
+	Page     int      `json:"page,omitempty"`     //页码，从1开始
+	PageSize int      `json:"pageSize,omitempty"` //每页条数，默认50，最大1000
+}
+
+// 带来源链的发票
+type ChainInvoice struct {
+	ChainID string `json:"chainID"` //发票所在链
+	Invoice
+}
+
+// 统计值
+type AggregateSummary struct {
+	Count  int    `json:"count"` //发票张数
+	Amount string `json:"je"`    //金额合计
+	Tax    string `json:"se"`    //税额合计
+}
+
+// 金额或税额无法解析、未计入统计的发票
+type InvalidInvoice struct {
+	ChainID string `json:"chainID"` //发票所在链
+	Fpdm    string `json:"fpdm"`    //发票代码
+	Fphm    string `json:"fphm"`    //发票号码
+	Reason  string `json:"reason"`  //无法解析的原因
+}
+
+// 归集结果
+// 保存在multiQueryKey下的归集记录不含发票列表，只保留统计值与Digest
+type AggregateResult struct {
+	QueryID      string                      `json:"queryID"`           //归集ID，即发起交易的txID
+	Criteria     AggregateCriteria           `json:"criteria"`          //归集请求
+	Total        int                         `json:"total"`             //符合条件的发票总数
+	Invoices     []ChainInvoice              `json:"invoices"`          //当前页的发票
+	Digest       string                      `json:"digest"`            //排序后全部发票JSON编码的sha256，用于核对分页
+	PerChain     map[string]AggregateSummary `json:"perChain"`          //各链统计
+	Summary      AggregateSummary            `json:"summary"`           //全部链统计
+	Invalid      []InvalidInvoice            `json:"invalid,omitempty"` //金额或税额无法解析的发票，不计入张数与合计
+	InvalidCount int                         `json:"invalidCount"`      //无法解析的发票张数
+	Missing      []string                    `json:"missing"`           //未应答的链
+	Errors       map[string]string           `json:"errors,omitempty"`  //未应答的原因
+}
+
+// 校验归集条件
+func (filter AggregateFilter) Validate() error {
+	for _, date := range []string{filter.DateFrom, filter.DateTo} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return fmt.Errorf("invalid date %q: expecting YYYY-MM-DD", date)
+		}
+	}
+	for _, amount := range []string{filter.AmountMin, filter.AmountMax} {
+		if amount == "" {
+			continue
+		}
+		if _, err := ParseAmount(amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 判断发票是否满足归集条件
+func (filter AggregateFilter) Matches(inv Invoice) bool {
+	if filter.BuyerTaxID != "" && inv.BuyerTaxID != filter.BuyerTaxID {
+		return false
+	}
+	if filter.SellerTaxID != "" && inv.SellerTaxID != filter.SellerTaxID {
+		return false
+	}
+	// 日期格式固定为YYYY-MM-DD，可直接按字符串比较
+	if filter.DateFrom != "" && (inv.IssueDate == "" || inv.IssueDate < filter.DateFrom) {
+		return false
+	}
+	if filter.DateTo != "" && (inv.IssueDate == "" || inv.IssueDate > filter.DateTo) {
+		return false
+	}
+	if filter.AmountMin != "" || filter.AmountMax != "" {
+		amount, err := ParseAmount(inv.Amount)
+		if err != nil {
+			return false
+		}
+		if lower, err := ParseAmount(filter.AmountMin); err == nil && amount < lower {
+			return false
+		}
+		if upper, err := ParseAmount(filter.AmountMax); err == nil && amount > upper {
+			return false
+		}
+	}
+	if len(filter.Status) > 0 {
+		matched := false
+		for _, status := range filter.Status {
+			if inv.Status == status {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// 跨链发票归集：按条件向多条链查询，由跨链合约汇总统计、排序与分页
+// args[0] 归集请求，如`{"gmfsbh":"91310000MA1FL1234X","dateFrom":"2021-06-01","dateTo":"2021-06-30","sortBy":"je","desc":true,"page":1,"pageSize":20}`
+func (broker *Broker) InterchainAggregateQuery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	criteria := AggregateCriteria{}
+	if err := json.Unmarshal([]byte(args[0]), &criteria); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal aggregate criteria: %w", err).Error())
+	}
+	if err := criteria.Validate(); err != nil {
+		return shim.Error(err.Error())
+	}
+	switch criteria.SortBy {
+	case "":
+		criteria.SortBy = "kprq"
+	case "kprq", "je", "se", "fphm":
+	default:
+		return shim.Error("invalid sortBy: " + criteria.SortBy)
+	}
+	if criteria.Page <= 0 {
+		criteria.Page = 1
+	}
+	if criteria.PageSize <= 0 {
+		criteria.PageSize = defaultPageSize
+	}
+	if criteria.PageSize > maxPageSize {
+		return shim.Error(fmt.Sprintf("pageSize exceeds %d", maxPageSize))
+	}
+
+	// 1 确定目的链
+	dstChainIDs, err := broker.resolveChains(stub, criteria.Chains, capabilityAggregateQuery)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 2 只向目的链发送归集条件，排序与分页由本链完成
+	filter, err := json.Marshal(criteria.AggregateFilter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ccRequests := make([]CrossChainRequest, 0, len(dstChainIDs))
+	for _, dstChainID := range dstChainIDs {
+		ccRequests = append(ccRequests, CrossChainRequest{
+			DstChainID: dstChainID,
+			Func:       "InterchainAggregateQuery",
+			Args:       []string{dstChainID, string(filter)},
+		})
+	}
+	answers, err := broker.fanOutByHttp(stub, ccRequests)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 3 汇总
+	result := AggregateResult{
+		QueryID:  stub.GetTxID(),
+		Criteria: criteria,
+		PerChain: make(map[string]AggregateSummary),
+		Missing:  make([]string, 0),
+		Errors:   make(map[string]string),
+	}
+	all := make([]ChainInvoice, 0)
+	invalid := make([]InvalidInvoice, 0)
+	totalAmount, totalTax := int64(0), int64(0)
+	for _, answer := range answers {
+		invoices := make([]Invoice, 0)
+		if answer.Err == nil {
+			if err := json.Unmarshal(answer.Data, &invoices); err != nil {
+				answer.Err = fmt.Errorf("unmarshal invoices: %w", err)
+			}
+		}
+
+		// 目的链的返回结果可能多于条件，本链再次过滤
+		matched := make([]ChainInvoice, 0)
+		skipped := make([]InvalidInvoice, 0)
+		amount, tax := int64(0), int64(0)
+		for _, inv := range invoices {
+			if !criteria.Matches(inv) {
+				continue
+			}
+			je, se, err := invoiceAmounts(inv)
+			if err != nil {
+				skipped = append(skipped, InvalidInvoice{ChainID: answer.DstChainID, Fpdm: inv.Fpdm, Fphm: inv.Fphm, Reason: err.Error()})
+				continue
+			}
+			if amount, err = addAmount(amount, je); err == nil {
+				tax, err = addAmount(tax, se)
+			}
+			if err != nil {
+				answer.Err = err
+				break
+			}
+			matched = append(matched, ChainInvoice{ChainID: answer.DstChainID, Invoice: inv})
+		}
+		if answer.Err != nil {
+			result.Missing = append(result.Missing, answer.DstChainID)
+			result.Errors[answer.DstChainID] = answer.Err.Error()
+			continue
+		}
+
+		result.PerChain[answer.DstChainID] = AggregateSummary{
+			Count:  len(matched),
+			Amount: FormatAmount(amount),
+			Tax:    FormatAmount(tax),
+		}
+		all = append(all, matched...)
+		invalid = append(invalid, skipped...)
+		if totalAmount, err = addAmount(totalAmount, amount); err != nil {
+			return shim.Error(err.Error())
+		}
+		if totalTax, err = addAmount(totalTax, tax); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	result.Total = len(all)
+	result.Summary = AggregateSummary{
+		Count:  len(all),
+		Amount: FormatAmount(totalAmount),
+		Tax:    FormatAmount(totalTax),
+	}
+	result.InvalidCount = len(invalid)
+	if len(invalid) > 0 {
+		result.Invalid = invalid
+	}
+
+	sortInvoices(all, criteria.SortBy, criteria.Desc)
+	start := (criteria.Page - 1) * criteria.PageSize
+	if start > len(all) {
+		start = len(all)
+	}
+	end := start + criteria.PageSize
+	if end > len(all) {
+		end = len(all)
+	}
+	result.Invoices = all[start:end]
+
+	allData, err := json.Marshal(all)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	digest := sha256.Sum256(allData)
+	result.Digest = hex.EncodeToString(digest[:])
+
+	// 只保存统计值与摘要，发票列表可能很大
+	record := result
+	record.Invoices = nil
+	record.Invalid = nil
+	recordData, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(broker.multiQueryKey(result.QueryID), recordData); err != nil {
+		return shim.Error(fmt.Errorf("save aggregate result error: %w", err).Error())
+	}
+
+	ret, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(ret)
+}
+
+// 解析发票的金额与税额，金额必填，税额可省略
+func invoiceAmounts(inv Invoice) (int64, int64, error) {
+	je, err := ParseAmount(inv.Amount)
+	if err != nil {
+		return 0, 0, fmt.Errorf("je: %w", err)
+	}
+	if inv.Tax == "" {
+		return je, 0, nil
+	}
+	se, err := ParseAmount(inv.Tax)
+	if err != nil {
+		return 0, 0, fmt.Errorf("se: %w", err)
+	}
+	return je, se, nil
+}
+
+// 累加以分为单位的金额，与ParseAmount一样不能超出int64
+func addAmount(sum int64, v int64) (int64, error) {
+	if (v > 0 && sum > math.MaxInt64-v) || (v < 0 && sum < math.MinInt64-v) {
+		return 0, fmt.Errorf("amount sum out of range")
+	}
+	return sum + v, nil
+}
+
+// 按字段排序，字段相同时按链ID、发票代码、发票号码排序，保证各背书节点结果一致
+func sortInvoices(invoices []ChainInvoice, sortBy string, desc bool) {
+	compare := func(a, b ChainInvoice) int {
+		switch sortBy {
+		case "je", "se":
+			x, y := a.Amount, b.Amount
+			if sortBy == "se" {
+				x, y = a.Tax, b.Tax
+			}
+			xv, _ := ParseAmount(x)
+			yv, _ := ParseAmount(y)
+			if xv != yv {
+				if xv < yv {
+					return -1
+				}
+				return 1
+			}
+		case "fphm":
+			if a.Fphm != b.Fphm {
+				if a.Fphm < b.Fphm {
+					return -1
+				}
+				return 1
+			}
+		default:
+			if a.IssueDate != b.IssueDate {
+				if a.IssueDate < b.IssueDate {
+					return -1
+				}
+				return 1
+			}
+		}
+		return 0
+	}
+
+	sort.SliceStable(invoices, func(i, j int) bool {
+		if c := compare(invoices[i], invoices[j]); c != 0 {
+			if desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		a, b := invoices[i], invoices[j]
+		if a.ChainID != b.ChainID {
+			return a.ChainID < b.ChainID
+		}
+		if a.Fpdm != b.Fpdm {
+			return a.Fpdm < b.Fpdm
+		}
+		return a.Fphm < b.Fphm
+	})
+}
+
+// 应答其他链的归集请求：将归集条件交给业务链queryByCriteria查询，返回签名的发票列表
+// args[3] PAPP转交的跨链请求ID，写入签名的应答
+func (broker *Broker) interchainQueryByCriteria(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+	if _, err := broker.checkInbound(stub, args[0], args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+	requestID, err := checkRequestID(args, 3)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	filter := AggregateFilter{}
+	if err := json.Unmarshal([]byte(args[2]), &filter); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal aggregate filter: %w", err).Error())
+	}
+	if err := filter.Validate(); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	b := toChaincodeArgs("queryByCriteria", args[2])
+	response := broker.invokeBusiness(stub, b)
+	if response.Status != shim.OK {
+		return shim.Error(chaincodeError(broker.config.ChaincodeID, response.Message).Error())
+	}
+
+	return broker.answer(stub, args, requestID, args[2], response.Payload)
+}
@@ -0,0 +1,214 @@
+/*-------------------------------------------*/
+/*            查询应答签名模块 answer.go       */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/DXPlus/CrosschainContract/papp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 目的链对同步查询的应答
+type QueryAnswer struct {
+	RequestID   string `json:"requestID"`        //跨链请求ID，来源链ID-目的链ID-序号
+	ChainID     string `json:"chainID"`          //应答的链ID，即目的链ID
+	TxID        string `json:"txID"`             //目的链执行查询的交易ID
+	Timestamp   int64  `json:"timestamp"`        //目的链执行查询的交易时间
+	Key         string `json:"key"`              //查询的key或归集关键词
+	Status      string `json:"status,omitempty"` //为failed时表示通用跨链调用执行失败，Value为失败原因
+	PayloadHash string `json:"payloadHash"`      //查询结果的sha256，十六进制
+	Value       []byte `json:"value"`            //查询结果
+}
+
+// 通用跨链调用执行失败的应答状态
+const answerStatusFailed = "failed"
+
+// 目的链跨链合约签名的查询应答，签名覆盖整个QueryAnswer
+type SignedAnswer struct {
+	Answer QueryAnswer `json:"answer"`
+	SigR   []byte      `json:"sigR"`
+	SigS   []byte      `json:"sigS"`
+}
+
+// 应答须由目的链签名的跨链请求
+// 通用跨链调用的结果同样须签名，以函数名作为应答的key
+var signedAnswerFuncs = map[string]bool{
+	"InterchainSingleQuery":      true,
+	"InterchainMultiQuery":       true,
+	"InterchainVerifyInvoice":    true,
+	"InterchainFingerprintQuery": true,
+	"InterchainAggregateQuery":   true,
+}
+
+// 只读取本链状态并返回签名应答的入链接口，供PAPP同步查询；
+// 来源链登记了校验配置或中继集合时仍可直接调用，应答由来源链校验签名，不改变本链状态
+var signedQueryHandlers = map[string]bool{
+	"interchainGet":                true,
+	"interchainQueryByValue":       true,
+	"interchainFingerprintClaimed": true,
+	"interchainVerifyInvoice":      true,
+	"interchainQueryByCriteria":    true,
+}
+
+// 对业务合约的查询结果签名后返回
+// args[0] 来源链ID，args[1] 目的链ID，requestID为PAPP转交的跨链请求ID
+func (broker *Broker) answer(stub shim.ChaincodeStubInterface, args []string, requestID string, key string, value []byte) pb.Response {
+	answer, err := broker.newAnswer(stub, args, requestID, key, "", value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(answer)
+}
+
+// 通用跨链调用执行失败时同样返回签名的应答，签名的应答作为错误信息，来源链校验后执行失败回调
+func (broker *Broker) failedAnswer(stub shim.ChaincodeStubInterface, args []string, requestID string, key string, message string) pb.Response {
+	answer, err := broker.newAnswer(stub, args, requestID, key, answerStatusFailed, []byte(message))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Error(string(answer))
+}
+
+// 生成签名的应答
+func (broker *Broker) newAnswer(stub shim.ChaincodeStubInterface, args []string, requestID string, key string, status string, value []byte) ([]byte, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	return broker.signAnswer(stub, QueryAnswer{
+		RequestID:   requestID,
+		ChainID:     args[1],
+		TxID:        stub.GetTxID(),
+		Timestamp:   ts.GetSeconds(),
+		Key:         key,
+		Status:      status,
+		PayloadHash: payloadHash(value),
+		Value:       value,
+	})
+}
+
+// 使用本链当前的私钥对查询应答签名
+func (broker *Broker) signAnswer(stub shim.ChaincodeStubInterface, answer QueryAnswer) ([]byte, error) {
+	payload, err := json.Marshal(answer)
+	if err != nil {
+		return nil, err
+	}
+	signR, signS, err := broker.signPayload(stub, payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(SignedAnswer{Answer: answer, SigR: signR, SigS: signS})
+}
+
+// 同步请求的应答中应签名的key：查询类请求的args[1]为查询的key、归集关键词或指纹，通用跨链调用为函数名
+func answerKey(ccRequest CrossChainRequest) (string, error) {
+	if isGenericInvoke(ccRequest.Func) {
+		return ccRequest.Func, nil
+	}
+	if !signedAnswerFuncs[ccRequest.Func] {
+		return "", fmt.Errorf("%s request %d has no signed answer", ccRequest.Func, ccRequest.Index)
+	}
+	if len(ccRequest.Args) < 2 {
+		return "", fmt.Errorf("malformed %s request %d", ccRequest.Func, ccRequest.Index)
+	}
+	return ccRequest.Args[1], nil
+}
+
+// 校验目的链签名的同步应答，返回查询结果；同步应答均须签名，无法校验的应答一律拒绝
+func (broker *Broker) verifyAnswer(stub shim.ChaincodeStubInterface, ccRequest CrossChainRequest, data []byte) ([]byte, error) {
+	if ccRequest.Func == "InterchainVerifyInvoice" {
+		publicKey, err := broker.chainPublicKey(stub, ccRequest.DstChainID)
+		if err != nil {
+			return nil, err
+		}
+		requestID := papp.RequestID(ccRequest.SrcChainID, ccRequest.DstChainID, ccRequest.Index)
+		return verifyInvoiceAnswer(publicKey, ccRequest, requestID, data)
+	}
+
+	answer, err := broker.verifySignedAnswer(stub, ccRequest, data)
+	if err != nil {
+		return nil, err
+	}
+	if answer.Status == answerStatusFailed {
+		return nil, fmt.Errorf("chain %s: %s", ccRequest.DstChainID, answer.Value)
+	}
+	return answer.Value, nil
+}
+
+// 校验目的链对跨链请求的签名应答：签名、应答链、请求ID、key与结果哈希均须一致
+func (broker *Broker) verifySignedAnswer(stub shim.ChaincodeStubInterface, ccRequest CrossChainRequest, data []byte) (QueryAnswer, error) {
+	key, err := answerKey(ccRequest)
+	if err != nil {
+		return QueryAnswer{}, err
+	}
+	dstChainID := ccRequest.DstChainID
+	publicKey, err := broker.chainPublicKey(stub, dstChainID)
+	if err != nil {
+		return QueryAnswer{}, err
+	}
+
+	signed := SignedAnswer{}
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return QueryAnswer{}, fmt.Errorf("unmarshal answer from chain %s: %w", dstChainID, err)
+	}
+	payload, err := json.Marshal(signed.Answer)
+	if err != nil {
+		return QueryAnswer{}, err
+	}
+	if err := VerifyPayload(publicKey, payload, signed.SigR, signed.SigS); err != nil {
+		return QueryAnswer{}, fmt.Errorf("answer from chain %s: %w", dstChainID, err)
+	}
+
+	answer := signed.Answer
+	requestID := papp.RequestID(ccRequest.SrcChainID, dstChainID, ccRequest.Index)
+	if answer.ChainID != dstChainID {
+		return QueryAnswer{}, fmt.Errorf("answer signed by chain %s, expecting %s", answer.ChainID, dstChainID)
+	}
+	if answer.RequestID != requestID {
+		return QueryAnswer{}, fmt.Errorf("answer for request %s, expecting %s", answer.RequestID, requestID)
+	}
+	if answer.Key != key {
+		return QueryAnswer{}, fmt.Errorf("answer for key %s, expecting %s", answer.Key, key)
+	}
+	if answer.PayloadHash != payloadHash(answer.Value) {
+		return QueryAnswer{}, fmt.Errorf("payload hash mismatch in answer from chain %s", dstChainID)
+	}
+	return answer, nil
+}
+
+// 目的链登记的公钥
+func (broker *Broker) chainPublicKey(stub shim.ChaincodeStubInterface, chainID string) ([]byte, error) {
+	info, err := broker.lookupChain(stub, chainID)
+	if err != nil {
+		return nil, err
+	}
+	if info.PublicKey == "" {
+		return nil, codeErrorf(CodeNotRegistered, "public key not registered for chain %s", chainID)
+	}
+	return parsePublicKey(info.PublicKey)
+}
+
+// 查询结果的sha256，十六进制
+func payloadHash(value []byte) string {
+	h := sha256.Sum256(value)
+	return hex.EncodeToString(h[:])
+}
+
+// 校验PAPP转交的请求ID属于该来源链与目的链，未提供时返回空
+func checkRequestID(args []string, i int) (string, error) {
+	if len(args) <= i {
+		return "", nil
+	}
+	prefix := args[0] + "-" + args[1] + "-"
+	if !strings.HasPrefix(args[i], prefix) {
+		return "", fmt.Errorf("request ID %s does not belong to chain %s and chain %s", args[i], args[0], args[1])
+	}
+	return args[i], nil
+}
@@ -1,55 +1,121 @@
 /*-------------------------------------------*/
 /*            跨链合约入口 broker.go           */
 /*-------------------------------------------*/
-package main
+package broker
 
 import (
-	"crypto/sha1"
 	"encoding/json"
 	"fmt"
-	"github.com/hyperledger/fabric/common/util"
+	"sort"
 	"strconv"
 	"strings"
 
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
 )
 
 const (
-	interchainEventName = "interchain-event-name"
-	innerMeta           = "inner-meta"
-	outterMeta          = "outter-meta"
-	chaincodeID         = "mycc"                     // 修改为本链链码的名称
-	channelID           = "mychannel"                // 修改为本链通道的名称
-	PrivateKey          = "private-key"
-	PAPPIP              = "PAPP-IP-address"
+	interchainEventName      = "interchain-event-name"
+	interchainBatchEventName = "interchain-batch-event-name"
+	innerMeta                = "inner-meta"
+	outterMeta               = "outter-meta"
+	DefaultChaincodeID       = "mycc"      // 本链业务合约的默认链码名称
+	DefaultChannelID         = "mychannel" // 本链业务合约的默认通道名称
+	PrivateKey               = "private-key"
+	PAPPIP                   = "PAPP-IP-address"
+	LocalChainID             = "local-chain-id"
 )
 
-type Broker struct{}
+// 跨链合约配置，不同部署的业务合约名称与通道不同时无需修改代码
+type Config struct {
+	ChaincodeID string // 本链业务合约的链码名称
+	ChannelID   string // 本链业务合约所在通道
+}
+
+// 默认配置
+func DefaultConfig() Config {
+	return Config{
+		ChaincodeID: DefaultChaincodeID,
+		ChannelID:   DefaultChannelID,
+	}
+}
+
+// 跨链合约，需通过New创建
+type Broker struct {
+	config   Config
+	handlers map[string]Handler // 嵌入模式下的本地处理函数，独立部署时为nil
+	outbox   outbox             // 投递接口执行期间暂存的跨链请求
+	writes   txWrites           // 投递接口执行期间写入的发票状态
+}
+
+// 创建跨链合约，未设置的配置项使用默认值
+func New(config Config) *Broker {
+	if config.ChaincodeID == "" {
+		config.ChaincodeID = DefaultChaincodeID
+	}
+	if config.ChannelID == "" {
+		config.ChannelID = DefaultChannelID
+	}
+	return &Broker{config: config}
+}
+
+// 跨链合约的配置
+func (broker *Broker) Config() Config {
+	return broker.config
+}
 
 // 定义跨链请求的数据结构
 type CrossChainRequest struct {
-	DstChainID    string `json:"dstChainID"`        //目的链ID
-	Func          string `json:"func"`              //请求目的
-	Args        []string `json:"args"`              //请求参数
+	SrcChainID string   `json:"srcChainID"`           //来源链ID
+	DstChainID string   `json:"dstChainID"`           //目的链ID
+	Index      uint64   `json:"index"`                //目的链下的请求序号
+	DstService string   `json:"dstService,omitempty"` //目的链上的合约名，仅通用跨链调用使用
+	Callback   string   `json:"callback,omitempty"`   //异步调用结果的回调函数
+	Deadline   int64    `json:"deadline,omitempty"`   //超时截止时间，Unix秒
+	Func       string   `json:"func"`                 //请求目的
+	Args       []string `json:"args"`                 //请求参数
 }
 
 // 定义跨链合约与PAPP通信的消息结构
 type RequestToPAPP struct {
-	CCRequest   CrossChainRequest `json:"cc_request"`        //跨链请求
-	SigR        []byte            `json:"sig_r"`             //对请求的签名
-	SigS        []byte            `json:"sig_s"`             //对请求的签名
+	CCRequest CrossChainRequest `json:"cc_request"` //跨链请求
+	SigR      []byte            `json:"sig_r"`      //对请求的签名
+	SigS      []byte            `json:"sig_s"`      //对请求的签名
 }
 
 // 链码初始化函数
 func (broker *Broker) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	return broker.initialize(stub)
+	_, args := stub.GetFunctionAndParameters()
+	return broker.initialize(stub, args)
 }
 
 // 链码调用入口
 func (broker *Broker) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
+	return broker.handle(stub, function, args)
+}
+
+// 按函数名分发调用，独立部署与嵌入模式共用
+func (broker *Broker) handle(stub shim.ChaincodeStubInterface, function string, args []string) pb.Response {
 	fmt.Printf("invoke: %s\n", function)
+	// 须携带背书证明的来源链不能直接调用入链接口，只读的签名查询除外
+	if _, ok := broker.inboundHandler(function); ok && len(args) > 0 && !signedQueryHandlers[function] {
+		if err := broker.checkUnproven(stub, args[0]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	// 发票核验应答只允许管理员组织或来源链的中继直接调用，防止穷举校验码
+	if function == "interchainVerifyInvoice" && len(args) > 0 {
+		if err := broker.checkVerifyCaller(stub, args[0]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	// 注册、密钥与PAPP配置等管理接口只允许管理员组织调用
+	if adminFuncs[function] {
+		if err := broker.checkAdmin(stub); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	switch function {
 	/*--------------------------------------*/
 	/*               业务链调用              */
@@ -62,13 +128,37 @@ func (broker *Broker) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return broker.InterchainSingleModify(stub, args)
 	case "InterchainDoubleModify":
 		return broker.InterchainDoubleModify(stub, args)
+	case "InterchainBatchModify":
+		return broker.InterchainBatchModify(stub, args)
+	case "InterchainSingleModifyInvoice":
+		return broker.InterchainSingleModifyInvoice(stub, args)
+	case "InterchainDoubleModifyInvoice":
+		return broker.InterchainDoubleModifyInvoice(stub, args)
+	case "InterchainFingerprintQuery":
+		return broker.InterchainFingerprintQuery(stub, args)
+	case "InterchainVerifyInvoice":
+		return broker.InterchainVerifyInvoice(stub, args)
+	case "InterchainRedReverse":
+		return broker.InterchainRedReverse(stub, args)
+	case "InterchainTransferInvoice":
+		return broker.InterchainTransferInvoice(stub, args)
+	case "InterchainAggregateQuery":
+		return broker.InterchainAggregateQuery(stub, args)
+	case "InterchainInvoke":
+		return broker.InterchainInvoke(stub, args)
+	case "expireInvoke":
+		return broker.expireInvoke(stub, args)
 	/*--------------------------------------*/
 	/*                PAPP调用              */
 	/*--------------------------------------*/
 	case "setPrivateKey":
 		return broker.setPrivateKey(stub, args)
 	case "modifyPAPPIP":
-		return broker.modifyPAPPIP(stub,args)
+		return broker.modifyPAPPIP(stub, args)
+	case "setPAPPTransport":
+		return broker.setPAPPTransport(stub, args)
+	case "setPAPPEndpoints":
+		return broker.setPAPPEndpoints(stub, args)
 	case "interchainGet":
 		return broker.interchainGet(stub, args)
 	case "interchainSet":
@@ -77,8 +167,60 @@ func (broker *Broker) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return broker.interchainQueryByValue(stub, args)
 	case "interchainFuncCall":
 		return broker.interchainFuncCall(stub, args)
+	case "interchainFingerprintClaimed":
+		return broker.interchainFingerprintClaimed(stub, args)
+	case "interchainVerifyInvoice":
+		return broker.interchainVerifyInvoice(stub, args)
+	case "interchainRedReverse":
+		return broker.interchainRedReverse(stub, args)
+	case "interchainRedReverseAck":
+		return broker.interchainRedReverseAck(stub, args)
+	case "setReversalFunc":
+		return broker.setReversalFunc(stub, args)
+	case "interchainTransferIn":
+		return broker.interchainTransferIn(stub, args)
+	case "interchainQueryByCriteria":
+		return broker.interchainQueryByCriteria(stub, args)
+	case "interchainInvoke":
+		return broker.interchainInvoke(stub, args)
+	case "interchainCallback":
+		return broker.interchainCallback(stub, args)
+	case "interchainTransferReceipt":
+		return broker.interchainTransferReceipt(stub, args)
+	case "cancelTransfer":
+		return broker.cancelTransfer(stub, args)
+	case "retryTransferOut":
+		return broker.retryTransferOut(stub, args)
+	case "setTransferFunc":
+		return broker.setTransferFunc(stub, args)
+	case "setFingerprintSalt":
+		return broker.setFingerprintSalt(stub, args)
+	case "resetVerifyFailures":
+		return broker.resetVerifyFailures(stub, args)
+	case "interchainBatchDeliver":
+		return broker.withOutbox(stub, broker.interchainBatchDeliver, args)
+	case "interchainFabricDeliver":
+		return broker.withOutbox(stub, broker.interchainFabricDeliver, args)
+	case "interchainEVMDeliver":
+		return broker.withOutbox(stub, broker.interchainEVMDeliver, args)
+	case "submitEVMHeader":
+		return broker.submitEVMHeader(stub, args)
+	case "getEVMHeader":
+		return broker.getEVMHeader(stub, args)
+	case "interchainQuorumDeliver":
+		return broker.withOutbox(stub, broker.interchainQuorumDeliver, args)
+	case "setRelayers":
+		return broker.setRelayers(stub, args)
+	case "getRelayerID":
+		return broker.getRelayerID(stub)
+	case "getPendingMessage":
+		return broker.getPendingMessage(stub, args)
+	case "getRelayEvidence":
+		return broker.getRelayEvidence(stub, args)
 	case "pollingEvent":
 		return broker.pollingEvent(stub, args)
+	case "pollingSignedEvent":
+		return broker.pollingSignedEvent(stub, args)
 	/*--------------------------------------*/
 	/*        系统管理员调用-跨链历史查询       */
 	/*--------------------------------------*/
@@ -90,6 +232,49 @@ func (broker *Broker) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return broker.getInMessage(stub, args)
 	case "getOutMessage":
 		return broker.getOutMessage(stub, args)
+	case "getLocalChainID":
+		return broker.getLocalChainIDResp(stub)
+	case "getAdminMSP":
+		return broker.getAdminMSP(stub)
+	case "getMultiQueryResult":
+		return broker.getMultiQueryResult(stub, args)
+	case "getInvoiceState":
+		return broker.getInvoiceState(stub, args)
+	case "getFingerprintRecords":
+		return broker.getFingerprintRecords(stub, args)
+	case "getFingerprintResult":
+		return broker.getFingerprintResult(stub, args)
+	case "getReversal":
+		return broker.getReversal(stub, args)
+	case "getTransfer":
+		return broker.getTransfer(stub, args)
+	case "getCallback":
+		return broker.getCallback(stub, args)
+	case "getPAPPTransport":
+		return broker.getPAPPTransport(stub)
+	case "getPAPPEndpoints":
+		return broker.getPAPPEndpoints(stub, args)
+	/*--------------------------------------*/
+	/*        系统管理员调用-伙伴链注册管理       */
+	/*--------------------------------------*/
+	case "setAdminMSP":
+		return broker.setAdminMSP(stub, args)
+	case "registerChain":
+		return broker.registerChain(stub, args)
+	case "removeChain":
+		return broker.removeChain(stub, args)
+	case "setChainVerifier":
+		return broker.setChainVerifier(stub, args)
+	case "getChain":
+		return broker.getChain(stub, args)
+	case "listChains":
+		return broker.listChains(stub)
+	case "registerService":
+		return broker.registerService(stub, args)
+	case "removeService":
+		return broker.removeService(stub, args)
+	case "listServices":
+		return broker.listServices(stub)
 
 	default:
 		return shim.Error("invalid function: " + function + ", args: " + strings.Join(args, ","))
@@ -97,7 +282,38 @@ func (broker *Broker) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 }
 
 // init
-func (broker *Broker) initialize(stub shim.ChaincodeStubInterface) pb.Response {
+// args[0] 本链ID，初始化后不可修改；链码升级时需传入相同的本链ID
+// args[1] 可选，管理员组织的MSP ID，未指定时为调用Init的组织
+func (broker *Broker) initialize(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	localChainID := args[0]
+	if localChainID == "" {
+		return shim.Error("local chain ID cannot be empty")
+	}
+
+	// 本链ID一经设置不可修改
+	stored, err := stub.GetState(LocalChainID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if stored != nil && string(stored) != localChainID {
+		return shim.Error(fmt.Sprintf("local chain ID is immutable, already initialized as %s", string(stored)))
+	}
+	if err := stub.PutState(LocalChainID, []byte(localChainID)); err != nil {
+		return shim.Error(fmt.Errorf("save local chain ID error: %w", err).Error())
+	}
+
+	adminMSP := ""
+	if len(args) > 1 {
+		adminMSP = args[1]
+	}
+	if err := broker.initAdmin(stub, adminMSP); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	inCounter := make(map[string]uint64)
 	outCounter := make(map[string]uint64)
 
@@ -120,132 +336,231 @@ func (broker *Broker) initialize(stub shim.ChaincodeStubInterface) pb.Response {
 // 跨链单链查询
 func (broker *Broker) InterchainSingleQuery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) < 2 {
-		return shim.Error("incorrect number of arguments, expecting 2")
+		return shim.Error(errArgumentCount + ", expecting 2")
 	}
 
 	dstChainID := args[0] // 目的链ID
 	key := args[1]        // 查询的key值
 
-	// 1 获取本链的私钥
-	privateKeyText, err := stub.GetState(PrivateKey)
-	if err != nil{
-		return shim.Error(err.Error())
-	}
-	// 2 生成跨链请求
+	// 生成跨链请求，来源链ID与签名在发送时生成
 	ccRequest := CrossChainRequest{
 		DstChainID: dstChainID,
-		Func: "InterchainSingleQuery",
-		Args: []string{dstChainID, key},
-	}
-	ccRJson, err := json.Marshal(ccRequest)
-	if err != nil {
-		fmt.Println("json marshal error: ", err)
-	}
-	// 3 生成签名  各个节点生成的签名是不一样的，但是都会验证通过
-	Sha1Inst := sha1.New()
-	Sha1Inst.Write(ccRJson)
-	sourceData := Sha1Inst.Sum([]byte(""))
-	signR,signS := EccSign(privateKeyText,sourceData)
-	// 4 生成与PAPP通信的请求
-	req := RequestToPAPP{
-		CCRequest:       ccRequest,
-		SigR:            signR,
-		SigS:            signS,
+		Func:       "InterchainSingleQuery",
+		Args:       []string{dstChainID, key},
 	}
 
-	return broker.InterchainRequestByHttp(stub, req)
+	return broker.invoke(stub, ccRequest, InvokeOptions{Mode: InvokeModeSync})
+}
+
+// 多链归集结果
+type MultiQueryResult struct {
+	QueryID  string            `json:"queryID"`          //归集ID，即发起交易的txID
+	QueryBy  string            `json:"queryBy"`          //归集方式
+	QueryKey string            `json:"queryKey"`         //归集关键词
+	Requests map[string]uint64 `json:"requests"`         //每条目的链的子请求序号
+	Results  map[string]string `json:"results"`          //每条目的链返回的数据
+	Missing  []string          `json:"missing"`          //未应答的目的链
+	Errors   map[string]string `json:"errors,omitempty"` //未应答的原因
 }
 
 // 跨链多链查询
+// args[2] 可选，目的链ID列表，如`["chainA","chainB"]`；为空时发往所有支持InterchainMultiQuery的已注册链
 func (broker *Broker) InterchainMultiQuery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) < 2 {
-		return shim.Error("incorrect number of arguments, expecting 2")
+		return shim.Error(errArgumentCount + ", expecting 2")
 	}
 
-	queryBy := args[0]    //归集方式
-	queryKey := args[1]   //归集关键词
+	queryBy := args[0]  //归集方式
+	queryKey := args[1] //归集关键词
 
-	// 1 获取本链的私钥
-	privateKeyText, err := stub.GetState(PrivateKey)
+	// 1 确定目的链
+	dstChainIDs, err := broker.resolveTargets(stub, args[2:], capabilityMultiQuery)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	// 2 生成跨链请求
-	ccRequest := CrossChainRequest{
-		DstChainID: "",
-		Func: "InterchainMultiQuery",
-		Args: []string{queryBy, queryKey},
+
+	// 2 为每条目的链生成带独立序号的子请求并发送
+	ccRequests := make([]CrossChainRequest, 0, len(dstChainIDs))
+	for _, dstChainID := range dstChainIDs {
+		ccRequests = append(ccRequests, CrossChainRequest{
+			DstChainID: dstChainID,
+			Func:       "InterchainMultiQuery",
+			Args:       []string{queryBy, queryKey},
+		})
+	}
+	answers, err := broker.fanOutByHttp(stub, ccRequests)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 3 汇总各链结果
+	result := MultiQueryResult{
+		QueryID:  stub.GetTxID(),
+		QueryBy:  queryBy,
+		QueryKey: queryKey,
+		Requests: make(map[string]uint64),
+		Results:  make(map[string]string),
+		Missing:  make([]string, 0),
+		Errors:   make(map[string]string),
+	}
+	for _, answer := range answers {
+		result.Requests[answer.DstChainID] = answer.Index
+		if answer.Err != nil {
+			result.Missing = append(result.Missing, answer.DstChainID)
+			result.Errors[answer.DstChainID] = answer.Err.Error()
+			continue
+		}
+		result.Results[answer.DstChainID] = string(answer.Data)
 	}
-	ccRJson, err := json.Marshal(ccRequest)
+
+	ret, err := json.Marshal(result)
 	if err != nil {
-		fmt.Println("json err: ", err)
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(broker.multiQueryKey(result.QueryID), ret); err != nil {
+		return shim.Error(fmt.Errorf("save multi query result error: %w", err).Error())
+	}
+	return shim.Success(ret)
+}
+
+// 确定多链请求的目的链：优先使用调用方给出的链ID列表，否则使用支持该请求类型的全部已注册链
+func (broker *Broker) resolveTargets(stub shim.ChaincodeStubInterface, args []string, capability string) ([]string, error) {
+	dstChainIDs := make([]string, 0)
+	if len(args) > 0 && args[0] != "" {
+		if err := json.Unmarshal([]byte(args[0]), &dstChainIDs); err != nil {
+			return nil, fmt.Errorf("unmarshal target chains: %w", err)
+		}
 	}
-	// 3 生成签名
-	Sha1Inst := sha1.New()
-	Sha1Inst.Write(ccRJson)
-	sourceData := Sha1Inst.Sum([]byte(""))
-	signR,signS := EccSign(privateKeyText,sourceData)
-	// 4 生成与PAPP通信的请求
-	req := RequestToPAPP{
-		CCRequest:       ccRequest,
-		SigR:            signR,
-		SigS:            signS,
+	return broker.resolveChains(stub, dstChainIDs, capability)
+}
+
+// 确定多链请求的目的链：dstChainIDs为空时使用支持该请求类型的全部已注册链
+func (broker *Broker) resolveChains(stub shim.ChaincodeStubInterface, dstChainIDs []string, capability string) ([]string, error) {
+	if len(dstChainIDs) == 0 {
+		chains, err := broker.chainsWithCapability(stub, capability)
+		if err != nil {
+			return nil, err
+		}
+		dstChainIDs = chains
 	}
 
-	return broker.InterchainRequestByHttp(stub, req)
+	if len(dstChainIDs) == 0 {
+		return nil, codeErrorf(CodeNotRegistered, "no target chain for %s", capability)
+	}
+	seen := make(map[string]bool)
+	for _, dstChainID := range dstChainIDs {
+		if dstChainID == "" {
+			return nil, fmt.Errorf("target chain ID cannot be empty")
+		}
+		if seen[dstChainID] {
+			return nil, fmt.Errorf("duplicate target chain: %s", dstChainID)
+		}
+		seen[dstChainID] = true
+	}
+	return dstChainIDs, nil
 }
 
 // 跨链单链写入
 func (broker *Broker) InterchainSingleModify(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) < 3 {
-		return shim.Error("incorrect number of arguments, expecting 3")
+		return shim.Error(errArgumentCount + ", expecting 3")
 	}
 
-	dstChainID:= args[0]
+	dstChainID := args[0]
 	key := args[1]
 	value := args[2]
 
-	ccRequest := CrossChainRequest{
-		DstChainID: dstChainID,
-		Func: "InterchainSingleModify",
-		Args: []string{dstChainID, key, value},
+	// 发票状态变更不合法时在发出请求前拒绝
+	if err := broker.trackInvoices(stub, dstChainID, value); err != nil {
+		return shim.Error(err.Error())
 	}
 
-	req := RequestToPAPP{
-		CCRequest:       ccRequest,
-		SigR:            []byte(""),
-		SigS:            []byte(""),
+	ccRequest := CrossChainRequest{
+		DstChainID: dstChainID,
+		Func:       "InterchainSingleModify",
+		Args:       []string{dstChainID, key, value},
 	}
 
-	return broker.InterchainRequestBySetEvent(stub, req)
+	return broker.invoke(stub, ccRequest, InvokeOptions{Mode: InvokeModeAsync})
 }
 
 // 跨链双链同步写入
 func (broker *Broker) InterchainDoubleModify(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) < 4 {
-		return shim.Error("incorrect number of arguments, expecting 4")
+	if len(args) < 5 {
+		return shim.Error(errArgumentCount + ", expecting 5")
 	}
 
-	dstChainID:= args[0]
+	dstChainID := args[0]
 	key1 := args[1]
 	value1 := args[2]
 	key2 := args[3]
 	value2 := args[4]
 
+	// 转移中的发票不允许在本链修改
+	if err := broker.checkNotInFlight(stub, key1); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := broker.trackInvoices(stub, dstChainID, value1, value2); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// 生成跨链请求
 	ccRequest := CrossChainRequest{
 		DstChainID: dstChainID,
-		Func: "InterchainDoubleModify",
-		Args: []string{dstChainID, key1, value1, key2, value2},
+		Func:       "InterchainDoubleModify",
+		Args:       []string{dstChainID, key1, value1, key2, value2},
+	}
+
+	return broker.invoke(stub, ccRequest, InvokeOptions{Mode: InvokeModeAsync})
+}
+
+// 批量跨链写入的单条记录
+type BatchModifyEntry struct {
+	DstChainID string `json:"dstChainID"` //目的链ID
+	Key        string `json:"key"`        //需要修改的key
+	Value      string `json:"value"`      //需要修改的value
+}
+
+// 跨链批量写入，一个交易内发出多条跨链写入请求
+func (broker *Broker) InterchainBatchModify(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
 	}
-	// 生成与PAPP通信的请求
-	req := RequestToPAPP{
-		CCRequest:       ccRequest,
-		SigR:            []byte(""),
-		SigS:            []byte(""),
+
+	// `[{"dstChainID":"chainA","key":"k1","value":"v1"},{"dstChainID":"chainB","key":"k2","value":"v2"}]`
+	entries := make([]BatchModifyEntry, 0)
+	if err := json.Unmarshal([]byte(args[0]), &entries); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal batch entries: %w", err).Error())
+	}
+	if len(entries) == 0 {
+		return shim.Error("empty batch")
+	}
+
+	ccRequests := make([]CrossChainRequest, 0, len(entries))
+	seen := make(map[string]bool)
+	for i, entry := range entries {
+		if entry.DstChainID == "" || entry.Key == "" {
+			return shim.Error(fmt.Sprintf("batch entry %d: dstChainID and key are required", i))
+		}
+		// 同一批次中同一张发票只能变更一次状态
+		if inv, err := ParseInvoice(entry.Value); err == nil && inv.Status != "" {
+			if seen[inv.ID()] {
+				return shim.Error(fmt.Sprintf("batch entry %d: invoice %s appears more than once", i, inv.ID()))
+			}
+			seen[inv.ID()] = true
+		}
+		if err := broker.trackInvoices(stub, entry.DstChainID, entry.Value); err != nil {
+			return shim.Error(fmt.Sprintf("batch entry %d: %s", i, err.Error()))
+		}
+		// 与InterchainSingleModify生成相同的跨链请求，目的链无需区分
+		ccRequests = append(ccRequests, CrossChainRequest{
+			DstChainID: entry.DstChainID,
+			Func:       "InterchainSingleModify",
+			Args:       []string{entry.DstChainID, entry.Key, entry.Value},
+		})
 	}
 
-	return broker.InterchainRequestBySetEvent(stub, req)
+	return broker.InterchainRequestBySetEventBatch(stub, ccRequests)
 }
 
 /*----------------------------------------------------------*/
@@ -255,7 +570,7 @@ func (broker *Broker) InterchainDoubleModify(stub shim.ChaincodeStubInterface, a
 // 保存PAPP给链码颁发的证书信息
 func (broker *Broker) setPrivateKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) < 1 {
-		return shim.Error("incorrect number of arguments, expecting 1")
+		return shim.Error(errArgumentCount + ", expecting 1")
 	}
 
 	privateKey := args[0]
@@ -269,11 +584,20 @@ func (broker *Broker) setPrivateKey(stub shim.ChaincodeStubInterface, args []str
 // 修改PAPP的IP地址
 func (broker *Broker) modifyPAPPIP(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) < 1 {
-		return shim.Error("incorrect number of arguments, expecting 1")
+		return shim.Error(errArgumentCount + ", expecting 1")
 	}
 
 	ip := args[0]
 
+	// 校验地址格式，启用TLS时必须为https
+	transport, err := broker.loadTransport(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := validatePAPPURL(ip, transport); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	if err := stub.PutState(PAPPIP, []byte(ip)); err != nil {
 		return shim.Error(fmt.Errorf("modify PAPPIP error: %w", err).Error())
 	}
@@ -282,77 +606,120 @@ func (broker *Broker) modifyPAPPIP(stub shim.ChaincodeStubInterface, args []stri
 
 // 查询业务链数据
 func (broker *Broker) interchainGet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) < 1 {
-		return shim.Error("incorrect number of arguments, expecting 1")
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+	// args[0] 来源链ID，args[1] 目的链ID
+	if _, err := broker.checkInbound(stub, args[0], args[1]); err != nil {
+		return shim.Error(err.Error())
 	}
 
-	key := args[0]
+	key := args[2]
+	// args[3] 跨链请求ID，写入签名的应答供来源链校验
+	requestID, err := checkRequestID(args, 3)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	b := util.ToChaincodeArgs("interchainGet", key)
-	response := stub.InvokeChaincode(chaincodeID, b, channelID)
+	b := toChaincodeArgs("interchainGet", key)
+	response := broker.invokeBusiness(stub, b)
 	if response.Status != shim.OK {
-		return shim.Error(fmt.Sprintf("invoke chaincode '%s' err: %s",chaincodeID , response.Message))
+		return shim.Error(chaincodeError(broker.config.ChaincodeID, response.Message).Error())
 	}
 
-	return shim.Success(response.Payload)
+	return broker.answer(stub, args, requestID, key, response.Payload)
 }
 
 // 修改业务链数据
 func (broker *Broker) interchainSet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) < 2 {
-		return shim.Error("incorrect number of arguments, expecting 2")
+	if len(args) < 4 {
+		return shim.Error(errArgumentCount + ", expecting 4")
+	}
+	if _, err := broker.checkInbound(stub, args[0], args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key := args[2]
+	value := args[3]
+
+	if err := broker.checkNotInFlight(stub, key); err != nil {
+		return shim.Error(err.Error())
 	}
 
-	key := args[0]
-	value := args[1]
+	// 校验发票状态变更，业务链写入成功后再保存
+	states, err := broker.prepareInvoiceTransitions(stub, args[0], value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	b := util.ToChaincodeArgs("interchainSet", key,value)
-	response := stub.InvokeChaincode(chaincodeID, b, channelID)
+	b := toChaincodeArgs("interchainSet", key, value)
+	response := broker.invokeBusiness(stub, b)
 	if response.Status != shim.OK {
-		return shim.Error(fmt.Sprintf("invoke chaincode '%s' err: %s",chaincodeID , response.Message))
+		return shim.Error(chaincodeError(broker.config.ChaincodeID, response.Message).Error())
 	}
 
+	if err := broker.putInvoiceStates(stub, states); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := broker.recordFingerprints(stub, fingerprintIn, args[0], value); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := broker.indexInvoiceChains(stub, invoiceSourceObjectType, args[0], value); err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
 // 调用业务链归集接口
 func (broker *Broker) interchainQueryByValue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) < 1 {
-		return shim.Error("incorrect number of arguments, expecting 1")
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+	if _, err := broker.checkInbound(stub, args[0], args[1]); err != nil {
+		return shim.Error(err.Error())
 	}
 
-	value := args[0]// 归集关键词
+	value := args[2] // 归集关键词
+	// args[3] 跨链请求ID，写入签名的应答供来源链校验
+	requestID, err := checkRequestID(args, 3)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	b := util.ToChaincodeArgs("queryByValue",value)
-	response := stub.InvokeChaincode(chaincodeID, b, channelID)
+	b := toChaincodeArgs("queryByValue", value)
+	response := broker.invokeBusiness(stub, b)
 	if response.Status != shim.OK {
-		return shim.Error(fmt.Sprintf("invoke chaincode '%s' err: %s",chaincodeID , response.Message))
+		return shim.Error(chaincodeError(broker.config.ChaincodeID, response.Message).Error())
 	}
 
-	return shim.Success(response.Payload)
+	return broker.answer(stub, args, requestID, value, response.Payload)
 }
 
 // 跨链合约调用业务合约函数的通用接口
 func (broker *Broker) interchainFuncCall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	// args[0]   调用函数名
-	// args[1:]  调用函数时的参数args
-	//funcName := args[0] // 调用函数名
-	//funcParameters := append(args[:0], args[1:]...)
-	//b := util.ToChaincodeArgs(funcName,funcParameters)
-	b := util.ArrayToChaincodeArgs(args)
-	response := stub.InvokeChaincode(chaincodeID, b, channelID)
+	// args[0]   来源链ID
+	// args[1]   目的链ID
+	// args[2]   调用函数名
+	// args[3:]  调用函数时的参数args
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting at least 3")
+	}
+	if _, err := broker.checkInbound(stub, args[0], args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+	b := toChaincodeArgs(args[2:]...)
+	response := broker.invokeBusiness(stub, b)
 	if response.Status != shim.OK {
-		return shim.Error(fmt.Sprintf("invoke chaincode '%s' err: %s",chaincodeID , response.Message))
+		return shim.Error(chaincodeError(broker.config.ChaincodeID, response.Message).Error())
 	}
 
 	return shim.Success(response.Payload)
 }
 
-
 // 根据PAPP当前储存的事件数据来获取最新事件的数据
 func (broker *Broker) pollingEvent(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) < 1 {
-		return shim.Error("incorrect number of arguments, expecting 1")
+		return shim.Error(errArgumentCount + ", expecting 1")
 	}
 	// `[{"chainA":"1"},{"chainB":"3"},{"chainC":"1"}]`
 	pappEvents := []byte(args[0])
@@ -397,10 +764,49 @@ func (broker *Broker) pollingEvent(stub shim.ChaincodeStubInterface, args []stri
 	return shim.Success(ret)
 }
 
+// 获取最新跨链请求并重新签名，供PAPP轮询时校验请求来源
+// 参数同pollingEvent，返回按目的链ID与序号排序的RequestToPAPP列表
+func (broker *Broker) pollingSignedEvent(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+	m := make(map[string]uint64)
+	if err := json.Unmarshal([]byte(args[0]), &m); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal out meta: %s", err).Error())
+	}
+	outMeta, err := broker.getMap(stub, outterMeta)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	dstChainIDs := make([]string, 0, len(outMeta))
+	for dstChainID := range outMeta {
+		dstChainIDs = append(dstChainIDs, dstChainID)
+	}
+	sort.Strings(dstChainIDs)
+
+	events := make([]RequestToPAPP, 0)
+	for _, dstChainID := range dstChainIDs {
+		for i := m[dstChainID] + 1; i <= outMeta[dstChainID]; i++ {
+			eb, err := stub.GetState(broker.outMsgKey(dstChainID, strconv.FormatUint(i, 10)))
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			e := CrossChainRequest{}
+			if err := json.Unmarshal(eb, &e); err != nil {
+				return shim.Error(fmt.Errorf("unmarshal out message %s-%d: %w", dstChainID, i, err).Error())
+			}
+			req, err := broker.signRequest(stub, e)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			events = append(events, req)
+		}
+	}
 
-func main() {
-	err := shim.Start(new(Broker))
+	ret, err := json.Marshal(events)
 	if err != nil {
-		fmt.Printf("Error starting chaincode: %s .....", err)
+		return shim.Error(err.Error())
 	}
-}
\ No newline at end of file
+	return shim.Success(ret)
+}
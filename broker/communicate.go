@@ -1,36 +1,36 @@
 /*-------------------------------------------*/
 /*            通信模块 communicate.go         */
 /*-------------------------------------------*/
-package main
+package broker
 
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/DXPlus/CrosschainContract/papp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
 )
 
 // 通过SetEvent发送跨链请求
-func (broker *Broker) InterchainRequestBySetEvent(stub shim.ChaincodeStubInterface, req RequestToPAPP) pb.Response {
+func (broker *Broker) InterchainRequestBySetEvent(stub shim.ChaincodeStubInterface, ccRequest CrossChainRequest) pb.Response {
+	if broker.outbox.add(stub.GetTxID(), ccRequest) {
+		return shim.Success(nil)
+	}
 
-	// 获取跨链记录的dstChainID和index
-	destChainID := req.CCRequest.DstChainID
 	outMeta, err := broker.getMap(stub, outterMeta)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	if _, ok := outMeta[destChainID]; !ok {
-		outMeta[destChainID] = 0
+	// 分配序号、签名并保存跨链记录
+	req, err := broker.storeOutMessage(stub, outMeta, ccRequest)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-
-	// index++后写入
-	outMeta[destChainID]++
 	if err := broker.putMap(stub, outterMeta, outMeta); err != nil {
 		return shim.Error(err.Error())
 	}
@@ -40,74 +40,320 @@ func (broker *Broker) InterchainRequestBySetEvent(stub shim.ChaincodeStubInterfa
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	ccReq,err:=json.Marshal(req.CCRequest)
+
+	// setEvent触发事件
+	if err := stub.SetEvent(interchainEventName, reqData); err != nil {
+		return shim.Error(fmt.Errorf("set event error: %w", err).Error())
+	}
+	return shim.Success(nil)
+}
+
+// 通过SetEvent批量发送跨链请求
+// 同一交易中stub.SetEvent只保留最后一个事件，因此所有请求合并为一个事件发出
+func (broker *Broker) InterchainRequestBySetEventBatch(stub shim.ChaincodeStubInterface, ccRequests []CrossChainRequest) pb.Response {
+	if len(ccRequests) == 0 {
+		return shim.Error("empty batch")
+	}
+	if broker.outbox.add(stub.GetTxID(), ccRequests...) {
+		return shim.Success(nil)
+	}
+
+	outMeta, err := broker.getMap(stub, outterMeta)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	// 生成每条跨链记录的唯一key
-	key := broker.outMsgKey(destChainID,strconv.FormatUint(outMeta[destChainID], 10))
-	// 保存跨链记录
-	if err := stub.PutState(key, ccReq); err != nil {
-		return shim.Error(fmt.Errorf("save request record error: %w", err).Error())
+	// 按目的链依次分配连续的序号
+	reqs := make([]RequestToPAPP, 0, len(ccRequests))
+	for _, ccRequest := range ccRequests {
+		req, err := broker.storeOutMessage(stub, outMeta, ccRequest)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		reqs = append(reqs, req)
+	}
+	if err := broker.putMap(stub, outterMeta, outMeta); err != nil {
+		return shim.Error(err.Error())
 	}
 
-    // setEvent触发事件
-	if err := stub.SetEvent(interchainEventName, reqData); err != nil {
+	reqData, err := json.Marshal(reqs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := stub.SetEvent(interchainBatchEventName, reqData); err != nil {
 		return shim.Error(fmt.Errorf("set event error: %w", err).Error())
 	}
-	return shim.Success(nil)
+	return shim.Success(reqData)
 }
 
-// 通过Http发送跨链请求并接收返回数据
-func (broker *Broker) InterchainRequestByHttp(stub shim.ChaincodeStubInterface, req RequestToPAPP) pb.Response {
+// 投递接口执行期间各入链消息发出的跨链请求，按交易ID暂存
+// 同一交易中stub.SetEvent只保留最后一个事件，且读取outterMeta看不到本交易的写入，
+// 因此投递期间的请求先暂存，投递结束后统一分配序号并只发出一个事件
+type outbox struct {
+	mu      sync.Mutex
+	pending map[string][]CrossChainRequest
+}
+
+// 开始暂存交易发出的跨链请求
+func (o *outbox) open(txID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.pending == nil {
+		o.pending = make(map[string][]CrossChainRequest)
+	}
+	o.pending[txID] = []CrossChainRequest{}
+}
+
+// 交易正在暂存时加入请求并返回true，否则返回false
+func (o *outbox) add(txID string, ccRequests ...CrossChainRequest) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	queued, ok := o.pending[txID]
+	if !ok {
+		return false
+	}
+	o.pending[txID] = append(queued, ccRequests...)
+	return true
+}
+
+// 已暂存的请求数
+func (o *outbox) size(txID string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending[txID])
+}
+
+// 丢弃第n条之后暂存的请求
+func (o *outbox) truncate(txID string, n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if queued, ok := o.pending[txID]; ok && len(queued) > n {
+		o.pending[txID] = queued[:n]
+	}
+}
+
+// 结束暂存并取出交易暂存的请求
+func (o *outbox) close(txID string) []CrossChainRequest {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	queued := o.pending[txID]
+	delete(o.pending, txID)
+	return queued
+}
+
+// 投递接口执行期间写入的状态，按交易ID暂存
+// 同一交易中stub.GetState读取不到本交易的写入，批量投递时后一条消息须从这里读取前一条消息写入的发票状态，
+// 否则同一批次中的两条消息都会以已提交的状态校验，同一张发票可能被重复锁定或报销
+type txWrites struct {
+	mu      sync.Mutex
+	pending map[string]map[string][]byte
+}
+
+// 开始暂存交易的写入
+func (w *txWrites) open(txID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending == nil {
+		w.pending = make(map[string]map[string][]byte)
+	}
+	w.pending[txID] = make(map[string][]byte)
+}
+
+// 读取交易暂存的写入，未暂存时返回false
+func (w *txWrites) get(txID string, key string) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	v, ok := w.pending[txID][key]
+	return v, ok
+}
+
+// 交易正在暂存时记录写入
+func (w *txWrites) put(txID string, key string, value []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if writes, ok := w.pending[txID]; ok {
+		writes[key] = value
+	}
+}
+
+// 结束暂存
+func (w *txWrites) close(txID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.pending, txID)
+}
 
-	// 获取PAPP的IP地址
-	IP, err := stub.GetState(PAPPIP)
+// 读取状态，优先读取本交易投递期间的写入
+func (broker *Broker) getTxState(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
+	if v, ok := broker.writes.get(stub.GetTxID(), key); ok {
+		return v, nil
+	}
+	return stub.GetState(key)
+}
+
+// 写入状态，投递期间同时暂存以便本交易后续消息读取
+func (broker *Broker) putTxState(stub shim.ChaincodeStubInterface, key string, value []byte) error {
+	if err := stub.PutState(key, value); err != nil {
+		return err
+	}
+	broker.writes.put(stub.GetTxID(), key, value)
+	return nil
+}
+
+// 执行投递接口，投递期间暂存写入的发票状态；投递成功后将暂存的跨链请求合并发出：一条时发出单条事件，多条时发出批量事件
+func (broker *Broker) withOutbox(stub shim.ChaincodeStubInterface, deliver func(shim.ChaincodeStubInterface, []string) pb.Response, args []string) pb.Response {
+	txID := stub.GetTxID()
+	broker.writes.open(txID)
+	defer broker.writes.close(txID)
+	broker.outbox.open(txID)
+	response := deliver(stub, args)
+	queued := broker.outbox.close(txID)
+	if response.Status != shim.OK || len(queued) == 0 {
+		return response
+	}
+
+	var sent pb.Response
+	if len(queued) == 1 {
+		sent = broker.InterchainRequestBySetEvent(stub, queued[0])
+	} else {
+		sent = broker.InterchainRequestBySetEventBatch(stub, queued)
+	}
+	if sent.Status != shim.OK {
+		return sent
+	}
+	return response
+}
+
+// 通过Http发送跨链请求并接收返回数据
+func (broker *Broker) InterchainRequestByHttp(stub shim.ChaincodeStubInterface, ccRequest CrossChainRequest) pb.Response {
+	answers, err := broker.fanOutByHttp(stub, []CrossChainRequest{ccRequest})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if answers[0].Err != nil {
+		return shim.Error(answers[0].Err.Error())
+	}
+	return shim.Success(answers[0].Data)
+}
 
-	// 获取跨链记录的dstChainID和index
-	destChainID := req.CCRequest.DstChainID
-	outMeta, err := broker.getMap(stub, outterMeta)
+// 单条Http跨链请求的应答
+type httpAnswer struct {
+	DstChainID string //目的链ID
+	Index      uint64 //请求序号
+	Data       []byte //PAPP返回的数据
+	Err        error  //请求失败的原因
+}
+
+// 通过Http依次发送多条跨链请求，每条请求单独分配序号并保存，按目的链选择PAPP地址
+// 单条请求发送失败记录在应答中，返回的error仅表示账本读写失败
+func (broker *Broker) fanOutByHttp(stub shim.ChaincodeStubInterface, ccRequests []CrossChainRequest) ([]httpAnswer, error) {
+	// 获取各目的链的PAPP地址与通信配置
+	endpoints, err := broker.getEndpoints(stub)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
+	}
+	transport, err := broker.loadTransport(stub)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, ok := outMeta[destChainID]; !ok {
-		outMeta[destChainID] = 0
+	outMeta, err := broker.getMap(stub, outterMeta)
+	if err != nil {
+		return nil, err
 	}
 
-	// index++后写入
-	outMeta[destChainID]++
+	// 分配序号、签名并保存跨链记录
+	reqs := make([]RequestToPAPP, 0, len(ccRequests))
+	for _, ccRequest := range ccRequests {
+		req, err := broker.storeOutMessage(stub, outMeta, ccRequest)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
 	if err := broker.putMap(stub, outterMeta, outMeta); err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 
-	// 序列化请求
-	reqData, err := json.Marshal(req)
+	answers := make([]httpAnswer, 0, len(reqs))
+	for _, req := range reqs {
+		answer := httpAnswer{
+			DstChainID: req.CCRequest.DstChainID,
+			Index:      req.CCRequest.Index,
+		}
+
+		// 发送请求，设置了截止时间的请求在截止时间前未返回视为失败，重试也不超过截止时间
+		budget := time.Duration(0)
+		if deadline := req.CCRequest.Deadline; deadline > 0 {
+			ts, err := stub.GetTxTimestamp()
+			if err != nil {
+				return nil, err
+			}
+			if deadline <= ts.GetSeconds() {
+				answer.Err = codeErrorf(CodeTransport, "request to chain %s timed out", answer.DstChainID)
+				answers = append(answers, answer)
+				continue
+			}
+			budget = time.Duration(deadline-ts.GetSeconds()) * time.Second
+		}
+		answer.Data, answer.Err = broker.sendWithFailover(stub, endpoints, req, transport, budget)
+		if answer.Err != nil && ErrorCodeOf(answer.Err.Error()) == "" {
+			answer.Err = codeErrorf(CodeTransport, "%w", answer.Err)
+		} else if answer.Err == nil {
+			// 查询结果须带有目的链的签名，防止PAPP伪造
+			answer.Data, answer.Err = broker.verifyAnswer(stub, req.CCRequest, answer.Data)
+		}
+		answers = append(answers, answer)
+	}
+
+	// 保存各地址的健康状况
+	if len(endpoints) > 0 {
+		if err := broker.putEndpoints(stub, endpoints); err != nil {
+			return nil, err
+		}
+	}
+	return answers, nil
+}
+
+// 为跨链请求分配目的链下的下一个序号，签名后保存跨链记录
+// outMeta只在内存中更新，由调用方统一写回
+func (broker *Broker) storeOutMessage(stub shim.ChaincodeStubInterface, outMeta map[string]uint64, ccRequest CrossChainRequest) (RequestToPAPP, error) {
+	destChainID := ccRequest.DstChainID
+
+	// index++
+	outMeta[destChainID]++
+	ccRequest.Index = outMeta[destChainID]
+
+	// 填写来源链ID并签名，签名覆盖序号
+	req, err := broker.signRequest(stub, ccRequest)
 	if err != nil {
-		return shim.Error(err.Error())
+		return RequestToPAPP{}, err
 	}
-	ccReq,err:=json.Marshal(req.CCRequest)
+
+	ccReq, err := json.Marshal(req.CCRequest)
 	if err != nil {
-		return shim.Error(err.Error())
+		return RequestToPAPP{}, err
+	}
+
+	// 记录请求中发票的指纹
+	if err := broker.recordFingerprints(stub, fingerprintOut, destChainID, ccRequest.Args...); err != nil {
+		return RequestToPAPP{}, err
+	}
+	if err := broker.indexInvoiceChains(stub, invoiceHolderObjectType, destChainID, ccRequest.Args...); err != nil {
+		return RequestToPAPP{}, err
+	}
+	if err := broker.recordRequester(stub, ccRequest); err != nil {
+		return RequestToPAPP{}, err
 	}
 
 	// 生成每条跨链记录的唯一key
-	key := broker.outMsgKey(destChainID,strconv.FormatUint(outMeta[destChainID], 10))
+	key := broker.outMsgKey(destChainID, strconv.FormatUint(ccRequest.Index, 10))
 	// 保存跨链记录
 	if err := stub.PutState(key, ccReq); err != nil {
-		return shim.Error(fmt.Errorf("save request record error: %w", err).Error())
-	}
-
-	// 发送http.post请求
-	returnData,err := broker.SendRep(string(IP), string(reqData))
-	if err != nil {
-		return shim.Error(err.Error())
+		return RequestToPAPP{}, fmt.Errorf("save request record error: %w", err)
 	}
-	return shim.Success([]byte(returnData))
+	return req, nil
 }
 
 //// 非跨链操作请求，通过Http发送请求并接收返回数据
@@ -144,22 +390,19 @@ func (broker *Broker) InterchainRequestByHttp(stub shim.ChaincodeStubInterface,
 //	return shim.Success(nil)
 //}
 
-// 向服务器发送http.post请求
-func (broker *Broker) SendRep(url string, data string) (string, error) {
-	// 发送post请求
-	res, err := http.Post(url, "application/json;charset=utf-8", strings.NewReader(data))
-	if err != nil || res == nil {
-		fmt.Println("Request error: ", err)
-		return "Request error", err
+// 按PAPP协议发送跨链请求，budget为0时只受通信配置中的单次超时限制
+func (broker *Broker) sendToPAPP(pappURL string, req RequestToPAPP, transport TransportConfig, budget time.Duration) ([]byte, error) {
+	if len(pappURL) == 0 {
+		return nil, codeErrorf(CodeNotInitialized, "PAPP address not set")
 	}
-
-	defer res.Body.Close()
-
-	// 读取服务器返回消息
-	content, err := ioutil.ReadAll(res.Body)
+	reqData, err := json.Marshal(req)
 	if err != nil {
-		fmt.Println("Fatal error: ", err)
-		return "Fatal error", err
+		return nil, err
 	}
-	return string(content), err
-}
\ No newline at end of file
+	client, err := transport.client(pappURL, budget)
+	if err != nil {
+		return nil, err
+	}
+	requestID := papp.RequestID(req.CCRequest.SrcChainID, req.CCRequest.DstChainID, req.CCRequest.Index)
+	return client.Send(requestID, reqData)
+}
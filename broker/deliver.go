@@ -0,0 +1,262 @@
+/*-------------------------------------------*/
+/*            批量投递模块 deliver.go          */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/DXPlus/CrosschainContract/papp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 批量投递的失败处理策略
+const (
+	deliverPolicyStop     = "stop"     // 遇到第一条失败即停止，后续消息不处理
+	deliverPolicyContinue = "continue" // 失败后继续处理后续消息
+)
+
+// 批量投递中单条消息的处理状态
+const (
+	deliverStatusSuccess = "success"
+	deliverStatusFailed  = "failed"
+	deliverStatusSkipped = "skipped"
+)
+
+// 单条入链消息的处理结果，保存在inMsgKey下
+type DeliverResult struct {
+	SrcChainID string `json:"srcChainID"`        //来源链ID
+	Index      uint64 `json:"index"`             //来源链下的请求序号
+	Func       string `json:"func"`              //处理消息的跨链接口
+	Status     string `json:"status"`            //success、failed、skipped
+	Message    string `json:"message,omitempty"` //失败原因
+	Payload    []byte `json:"payload,omitempty"` //业务链返回数据
+}
+
+// PAPP批量投递入链消息
+// args[0] 消息列表，每条消息的Func为本链的跨链接口名，Args不包含来源链ID和目的链ID
+// args[1] 失败处理策略，stop或continue，默认stop
+func (broker *Broker) interchainBatchDeliver(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	// `[{"srcChainID":"chainA","dstChainID":"chainB","index":3,"func":"interchainSet","args":["k1","v1"]}]`
+	msgs := make([]CrossChainRequest, 0)
+	if err := json.Unmarshal([]byte(args[0]), &msgs); err != nil {
+		return shim.Error(codeErrorf(CodeInvalidArgument, "unmarshal inbound messages: %w", err).Error())
+	}
+	if len(msgs) == 0 {
+		return shim.Error("empty batch")
+	}
+
+	policy := deliverPolicyStop
+	if len(args) > 1 && args[1] != "" {
+		policy = args[1]
+	}
+	if policy != deliverPolicyStop && policy != deliverPolicyContinue {
+		return shim.Error(FormatError(CodeInvalidArgument, "invalid deliver policy: "+policy))
+	}
+
+	inMeta, err := broker.getMap(stub, innerMeta)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	results := make([]DeliverResult, 0, len(msgs))
+	stopped := false
+	for _, msg := range msgs {
+		if stopped {
+			results = append(results, DeliverResult{
+				SrcChainID: msg.SrcChainID,
+				Index:      msg.Index,
+				Func:       msg.Func,
+				Status:     deliverStatusSkipped,
+			})
+			continue
+		}
+
+		result := DeliverResult{
+			SrcChainID: msg.SrcChainID,
+			Index:      msg.Index,
+			Func:       msg.Func,
+			Status:     deliverStatusFailed,
+		}
+		if err := broker.checkUnproven(stub, msg.SrcChainID); err != nil {
+			result.Message = err.Error()
+		} else if err := broker.checkInboundCaller(stub, msg); err != nil {
+			result.Message = err.Error()
+		} else if result, err = broker.deliverMessage(stub, inMeta, msg); err != nil {
+			return shim.Error(err.Error())
+		}
+		results = append(results, result)
+		if result.Status != deliverStatusSuccess && policy == deliverPolicyStop {
+			stopped = true
+		}
+	}
+
+	if err := broker.putMap(stub, innerMeta, inMeta); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ret, err := json.Marshal(results)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(ret)
+}
+
+// 校验并处理单条入链消息
+// 序号必须紧接innerMeta中该来源链的最新序号；校验失败的消息不占用序号，
+// 通过校验的消息无论业务链执行成功与否都会记录结果并推进序号
+// 返回的error仅表示账本读写失败，此时整个交易应当失败
+func (broker *Broker) deliverMessage(stub shim.ChaincodeStubInterface, inMeta map[string]uint64, msg CrossChainRequest) (DeliverResult, error) {
+	result := DeliverResult{
+		SrcChainID: msg.SrcChainID,
+		Index:      msg.Index,
+		Func:       msg.Func,
+		Status:     deliverStatusFailed,
+	}
+
+	if _, err := broker.checkInbound(stub, msg.SrcChainID, msg.DstChainID); err != nil {
+		result.Message = err.Error()
+		return result, nil
+	}
+	if expected := inMeta[msg.SrcChainID] + 1; msg.Index != expected {
+		result.Message = fmt.Sprintf("unexpected index %d from chain %s, expecting %d", msg.Index, msg.SrcChainID, expected)
+		return result, nil
+	}
+	handler, ok := broker.inboundHandler(msg.Func)
+	if !ok {
+		result.Message = "invalid inbound function: " + msg.Func
+		return result, nil
+	}
+
+	// 复用单条跨链接口，参数前补上来源链ID与目的链ID
+	// 处理失败的消息发出的跨链请求不再发送
+	queued := broker.outbox.size(stub.GetTxID())
+	handlerArgs := append([]string{msg.SrcChainID, msg.DstChainID}, msg.Args...)
+	response := handler(stub, handlerArgs)
+	if response.Status == shim.OK {
+		result.Status = deliverStatusSuccess
+		result.Payload = response.Payload
+	} else {
+		result.Message = response.Message
+		broker.outbox.truncate(stub.GetTxID(), queued)
+	}
+
+	// 记录处理结果并推进序号
+	inMeta[msg.SrcChainID] = msg.Index
+	resultData, err := json.Marshal(result)
+	if err != nil {
+		return result, err
+	}
+	key := broker.inMsgKey(msg.SrcChainID, strconv.FormatUint(msg.Index, 10))
+	if err := stub.PutState(key, resultData); err != nil {
+		return result, fmt.Errorf("save inbound result error: %w", err)
+	}
+	return result, nil
+}
+
+// 可以批量投递的本链跨链接口
+func (broker *Broker) inboundHandler(function string) (func(shim.ChaincodeStubInterface, []string) pb.Response, bool) {
+	switch function {
+	case "interchainGet":
+		return broker.interchainGet, true
+	case "interchainSet":
+		return broker.interchainSet, true
+	case "interchainQueryByValue":
+		return broker.interchainQueryByValue, true
+	case "interchainFuncCall":
+		return broker.interchainFuncCall, true
+	case "interchainFingerprintClaimed":
+		return broker.interchainFingerprintClaimed, true
+	case "interchainVerifyInvoice":
+		return broker.interchainVerifyInvoice, true
+	case "interchainRedReverse":
+		return broker.interchainRedReverse, true
+	case "interchainRedReverseAck":
+		return broker.interchainRedReverseAck, true
+	case "interchainTransferIn":
+		return broker.interchainTransferIn, true
+	case "interchainQueryByCriteria":
+		return broker.interchainQueryByCriteria, true
+	case "interchainInvoke":
+		return broker.interchainInvoke, true
+	case "interchainCallback":
+		return broker.interchainCallback, true
+	case "interchainTransferReceipt":
+		return broker.interchainTransferReceipt, true
+	default:
+		return nil, false
+	}
+}
+
+// 发出请求的跨链接口对应的目的链跨链接口，请求参数的第一个为目的链ID
+var inboundFuncs = map[string]string{
+	"InterchainSingleQuery":         "interchainGet",
+	"InterchainSingleModify":        "interchainSet",
+	"InterchainSingleModifyInvoice": "interchainSet",
+	"InterchainFingerprintQuery":    "interchainFingerprintClaimed",
+	"InterchainVerifyInvoice":       "interchainVerifyInvoice",
+	"InterchainRedReverse":          "interchainRedReverse",
+	"InterchainRedReverseAck":       "interchainRedReverseAck",
+	"InterchainTransferInvoice":     "interchainTransferIn",
+	"InterchainTransferReceipt":     "interchainTransferReceipt",
+	"InterchainAggregateQuery":      "interchainQueryByCriteria",
+}
+
+// 未登记在inboundFuncs中的请求均为通用跨链调用
+func isGenericInvoke(function string) bool {
+	if _, ok := inboundFuncs[function]; ok {
+		return false
+	}
+	switch function {
+	case "InterchainMultiQuery", "InterchainDoubleModify", "InterchainDoubleModifyInvoice":
+		return false
+	}
+	return true
+}
+
+// 将来源链发出的跨链请求转换为目的链批量投递的入链消息
+// 返回消息的Func为目的链的跨链接口名，Args不包含来源链ID与目的链ID；
+// 未知的Func视为通用跨链调用，转换为interchainInvoke并在Args开头附加请求ID与截止时间；查询类请求在Args末尾附加请求ID
+func ToInbound(req CrossChainRequest) (CrossChainRequest, error) {
+	msg := req
+	switch req.Func {
+	case "InterchainMultiQuery":
+		// args: 归集方式，归集关键字
+		if len(req.Args) < 2 {
+			return CrossChainRequest{}, fmt.Errorf("malformed %s request %d", req.Func, req.Index)
+		}
+		msg.Func = "interchainQueryByValue"
+		msg.Args = []string{req.Args[1], papp.RequestID(req.SrcChainID, req.DstChainID, req.Index)}
+	case "InterchainDoubleModify", "InterchainDoubleModifyInvoice":
+		// args: 目的链ID，本链key，本链value，目的链key，目的链value
+		if len(req.Args) < 5 {
+			return CrossChainRequest{}, fmt.Errorf("malformed %s request %d", req.Func, req.Index)
+		}
+		msg.Func = "interchainSet"
+		msg.Args = []string{req.Args[3], req.Args[4]}
+	default:
+		if isGenericInvoke(req.Func) {
+			msg.Func = "interchainInvoke"
+			deadline := strconv.FormatInt(req.Deadline, 10)
+			msg.Args = append([]string{papp.RequestID(req.SrcChainID, req.DstChainID, req.Index), deadline, req.DstService, req.Func}, req.Args...)
+			return msg, nil
+		}
+		if len(req.Args) < 1 || req.Args[0] != req.DstChainID {
+			return CrossChainRequest{}, fmt.Errorf("malformed %s request %d", req.Func, req.Index)
+		}
+		msg.Func = inboundFuncs[req.Func]
+		msg.Args = req.Args[1:]
+		if signedAnswerFuncs[req.Func] {
+			// 目的链将请求ID写入签名的应答
+			msg.Args = append(append([]string(nil), msg.Args...), papp.RequestID(req.SrcChainID, req.DstChainID, req.Index))
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,129 @@
+package broker_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/DXPlus/CrosschainContract/relayer"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 与Fabric一致的模拟账本：交易中的写入在交易结束后才生效，GetState读取不到本交易的写入
+type committedStub struct {
+	*shimtest.MockStub
+	args   []string
+	writes map[string][]byte
+}
+
+func (stub *committedStub) GetFunctionAndParameters() (string, []string) {
+	return stub.args[0], stub.args[1:]
+}
+
+func (stub *committedStub) PutState(key string, value []byte) error {
+	stub.writes[key] = value
+	return nil
+}
+
+func (stub *committedStub) DelState(key string) error {
+	stub.writes[key] = nil
+	return nil
+}
+
+func (stub *committedStub) GetState(key string) ([]byte, error) {
+	return stub.MockStub.GetState(key)
+}
+
+// 以一个交易调用跨链合约，交易结束后提交写入
+func (stub *committedStub) invoke(cc shim.Chaincode, txID string, args ...string) pb.Response {
+	stub.args = args
+	stub.writes = make(map[string][]byte)
+	stub.MockTransactionStart(txID)
+	resp := cc.Invoke(stub)
+	for key, value := range stub.writes {
+		if value == nil {
+			stub.MockStub.DelState(key)
+		} else {
+			stub.MockStub.PutState(key, value)
+		}
+	}
+	stub.MockTransactionEnd(txID)
+	return resp
+}
+
+// 创建登记了来源链chainA的目的链chainB
+func newCommittedChain(t *testing.T) (*committedStub, shim.Chaincode) {
+	cc := broker.New(broker.DefaultConfig())
+	stub := &committedStub{MockStub: shimtest.NewMockStub("broker", cc)}
+	stub.MockPeerChaincode(broker.DefaultChaincodeID, shimtest.NewMockStub(broker.DefaultChaincodeID, new(relayer.MockBusiness)), broker.DefaultChannelID)
+	admin, err := relayer.MockIdentity(relayer.MockAdminMSP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.Creator = admin
+	if resp := stub.invoke(initChaincode{cc}, "init", "init", "chainB"); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	if resp := stub.invoke(cc, "register", "registerChain", `{"chainID":"chainA"}`); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	return stub, cc
+}
+
+// 以Init调用跨链合约
+type initChaincode struct {
+	shim.Chaincode
+}
+
+func (cc initChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	return cc.Chaincode.Init(stub)
+}
+
+func TestBatchDeliverSeesEarlierInvoiceStates(t *testing.T) {
+	stub, cc := newCommittedChain(t)
+
+	invoice := func(status string) string {
+		return `{"fpdm":"3100204130","fphm":"12345678","zt":"` + status + `"}`
+	}
+	msgs := make([]broker.CrossChainRequest, 0)
+	for i, status := range []string{broker.InvoiceLocked, broker.InvoiceReimbursed, broker.InvoiceReimbursed} {
+		msgs = append(msgs, broker.CrossChainRequest{
+			SrcChainID: "chainA",
+			DstChainID: "chainB",
+			Index:      uint64(i + 1),
+			Func:       "interchainSet",
+			Args:       []string{"k1", invoice(status)},
+		})
+	}
+	msgData, err := json.Marshal(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := stub.invoke(cc, "deliver", "interchainBatchDeliver", string(msgData), "continue")
+	if resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	results := make([]broker.DeliverResult, 0)
+	if err := json.Unmarshal(resp.Payload, &results); err != nil {
+		t.Fatal(err)
+	}
+	// 第二条消息须看到第一条消息的锁定，第三条消息须看到第二条消息的报销
+	if results[0].Status != "success" || results[1].Status != "success" {
+		t.Fatalf("lock and reimburse returned %+v", results[:2])
+	}
+	if results[2].Status != "failed" || broker.ErrorCodeOf(results[2].Message) != broker.CodeInvalidTransition {
+		t.Fatalf("second reimbursement returned %+v", results[2])
+	}
+
+	resp = stub.invoke(cc, "query", "getInvoiceState", "3100204130", "12345678")
+	state := broker.InvoiceState{}
+	if err := json.Unmarshal(resp.Payload, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != broker.InvoiceReimbursed || len(state.History) != 2 {
+		t.Fatalf("invoice state is %+v", state)
+	}
+}
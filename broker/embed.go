@@ -0,0 +1,159 @@
+/*-------------------------------------------*/
+/*            嵌入模式 embed.go               */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	EmbeddedKeyPrefix      = "~broker~" // 嵌入模式下跨链合约状态的保留前缀
+	EmbeddedFunctionPrefix = "broker."  // 嵌入模式下跨链合约函数名的默认前缀
+)
+
+// 嵌入模式下业务合约注册的本地处理函数，代替对业务合约的InvokeChaincode调用
+// stub为宿主合约的原始stub，处理函数读写的是业务合约自身的状态
+type Handler func(stub shim.ChaincodeStubInterface, args []string) pb.Response
+
+// 编译进业务合约的跨链合约
+// 跨链合约的状态保存在EmbeddedKeyPrefix前缀下，函数通过宿主合约的Invoke以FunctionPrefix前缀路由
+type Embedded struct {
+	FunctionPrefix string // 跨链合约函数名前缀，避免与业务合约的interchainGet等函数重名
+	broker         *Broker
+}
+
+// 创建嵌入模式的跨链合约，handlers以函数名为key，代替对业务合约的调用
+// config.ChaincodeID对应的调用均由handlers处理，通用跨链调用访问的其他合约仍通过InvokeChaincode
+func NewEmbedded(config Config, handlers map[string]Handler) *Embedded {
+	broker := New(config)
+	broker.handlers = make(map[string]Handler, len(handlers))
+	for name, handler := range handlers {
+		broker.handlers[name] = handler
+	}
+	return &Embedded{
+		FunctionPrefix: EmbeddedFunctionPrefix,
+		broker:         broker,
+	}
+}
+
+// 注册或替换本地处理函数，需在链码启动前调用
+func (e *Embedded) Handle(function string, handler Handler) {
+	e.broker.handlers[function] = handler
+}
+
+// 跨链合约初始化，由宿主合约的Init调用，args同独立部署时的Init参数
+func (e *Embedded) Init(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return e.broker.initialize(newPrefixedStub(stub), args)
+}
+
+// 宿主合约Invoke中调用，函数名带FunctionPrefix前缀时由跨链合约处理并返回true
+// 例：if resp, ok := embedded.Route(stub); ok { return resp }
+func (e *Embedded) Route(stub shim.ChaincodeStubInterface) (pb.Response, bool) {
+	function, args := stub.GetFunctionAndParameters()
+	if !strings.HasPrefix(function, e.FunctionPrefix) {
+		return pb.Response{}, false
+	}
+	return e.Call(stub, strings.TrimPrefix(function, e.FunctionPrefix), args...), true
+}
+
+// 业务合约在本地直接调用跨链合约函数，函数名不带前缀
+// 例：embedded.Call(stub, "InterchainSingleModify", "B", "key", "value")
+func (e *Embedded) Call(stub shim.ChaincodeStubInterface, function string, args ...string) pb.Response {
+	return e.broker.handle(newPrefixedStub(stub), function, args)
+}
+
+// 调用本链业务合约
+func (broker *Broker) invokeBusiness(stub shim.ChaincodeStubInterface, args [][]byte) pb.Response {
+	return broker.invokeService(stub, broker.config.ChaincodeID, args, broker.config.ChannelID)
+}
+
+// 调用本链合约，嵌入模式下业务合约的调用转交本地处理函数
+func (broker *Broker) invokeService(stub shim.ChaincodeStubInterface, service string, args [][]byte, channel string) pb.Response {
+	if broker.handlers == nil || service != broker.config.ChaincodeID {
+		return stub.InvokeChaincode(service, args, channel)
+	}
+	if len(args) == 0 {
+		return shim.Error("empty local call")
+	}
+
+	function := string(args[0])
+	handler, ok := broker.handlers[function]
+	if !ok {
+		return shim.Error("no local handler registered for " + function)
+	}
+	params := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		params = append(params, string(arg))
+	}
+	return handler(unwrapStub(stub), params)
+}
+
+// 为跨链合约的状态加上保留前缀的stub
+// 组合键在objectType前加前缀，普通键直接加前缀
+type prefixedStub struct {
+	shim.ChaincodeStubInterface
+}
+
+func newPrefixedStub(stub shim.ChaincodeStubInterface) *prefixedStub {
+	if ps, ok := stub.(*prefixedStub); ok {
+		return ps
+	}
+	return &prefixedStub{ChaincodeStubInterface: stub}
+}
+
+// 取出宿主合约的原始stub
+func unwrapStub(stub shim.ChaincodeStubInterface) shim.ChaincodeStubInterface {
+	if ps, ok := stub.(*prefixedStub); ok {
+		return ps.ChaincodeStubInterface
+	}
+	return stub
+}
+
+// 组合键以\x00开头，其前缀已由CreateCompositeKey加在objectType上
+func (ps *prefixedStub) key(key string) string {
+	if strings.HasPrefix(key, "\x00") {
+		return key
+	}
+	return EmbeddedKeyPrefix + key
+}
+
+func (ps *prefixedStub) GetState(key string) ([]byte, error) {
+	return ps.ChaincodeStubInterface.GetState(ps.key(key))
+}
+
+func (ps *prefixedStub) PutState(key string, value []byte) error {
+	return ps.ChaincodeStubInterface.PutState(ps.key(key), value)
+}
+
+func (ps *prefixedStub) DelState(key string) error {
+	return ps.ChaincodeStubInterface.DelState(ps.key(key))
+}
+
+// 范围查询限定在保留前缀内，结果key带前缀，跨链合约只使用其中的value
+func (ps *prefixedStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if endKey == "" {
+		endKey = string(utf8.MaxRune)
+	}
+	return ps.ChaincodeStubInterface.GetStateByRange(ps.key(startKey), ps.key(endKey))
+}
+
+func (ps *prefixedStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return ps.ChaincodeStubInterface.CreateCompositeKey(EmbeddedKeyPrefix+objectType, attributes)
+}
+
+func (ps *prefixedStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	objectType, attributes, err := ps.ChaincodeStubInterface.SplitCompositeKey(compositeKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimPrefix(objectType, EmbeddedKeyPrefix), attributes, nil
+}
+
+func (ps *prefixedStub) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	return ps.ChaincodeStubInterface.GetStateByPartialCompositeKey(EmbeddedKeyPrefix+objectType, keys)
+}
@@ -0,0 +1,230 @@
+/*-------------------------------------------*/
+/*            PAPP地址管理 endpoint.go         */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/DXPlus/CrosschainContract/papp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	PAPPEndpoints = "papp-endpoints" // 各目的链的PAPP地址列表
+
+	endpointFailureThreshold = 3  // 连续失败达到该次数的地址视为不可用
+	endpointCooldown         = 60 // 不可用的地址在最近一次失败后该秒数内排到最后
+)
+
+// PAPP地址的健康状况，由请求结果更新
+type EndpointHealth struct {
+	Failures    int    `json:"failures"`              //连续失败次数
+	LastFailure int64  `json:"lastFailure,omitempty"` //最近一次失败的交易时间
+	LastError   string `json:"lastError,omitempty"`   //最近一次失败的原因
+	LastSuccess int64  `json:"lastSuccess,omitempty"` //最近一次成功的交易时间
+}
+
+// 目的链的PAPP地址配置
+type ChainEndpoints struct {
+	ChainID   string                    `json:"chainID"`          //目的链ID
+	Endpoints []string                  `json:"endpoints"`        //按优先级排列的PAPP地址
+	Health    map[string]EndpointHealth `json:"health,omitempty"` //各地址的健康状况
+}
+
+// 是否暂时不可用
+func (h EndpointHealth) down(now int64) bool {
+	return h.Failures >= endpointFailureThreshold && now-h.LastFailure < endpointCooldown
+}
+
+// 设置目的链的PAPP地址
+// args[0] 目的链ID，args[1] 按优先级排列的地址列表，如`["https://relay-1:8443","https://relay-2:8443"]`，为空列表时删除
+func (broker *Broker) setPAPPEndpoints(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+	chainID := args[0]
+	if chainID == "" {
+		return shim.Error("chain ID cannot be empty")
+	}
+
+	urls := make([]string, 0)
+	if err := json.Unmarshal([]byte(args[1]), &urls); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal endpoints: %w", err).Error())
+	}
+	transport, err := broker.loadTransport(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	seen := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		if seen[u] {
+			return shim.Error("duplicate endpoint: " + u)
+		}
+		seen[u] = true
+		if err := validatePAPPURL(u, transport); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	all, err := broker.getEndpoints(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(urls) == 0 {
+		delete(all, chainID)
+	} else {
+		// 保留仍在使用的地址的健康状况
+		health := make(map[string]EndpointHealth)
+		for u, h := range all[chainID].Health {
+			if seen[u] {
+				health[u] = h
+			}
+		}
+		all[chainID] = ChainEndpoints{ChainID: chainID, Endpoints: urls, Health: health}
+	}
+	if err := broker.putEndpoints(stub, all); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 查询目的链的PAPP地址与健康状况
+// args[0] 目的链ID，省略时返回所有目的链
+func (broker *Broker) getPAPPEndpoints(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	all, err := broker.getEndpoints(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var v []byte
+	if len(args) > 0 && args[0] != "" {
+		chain, ok := all[args[0]]
+		if !ok {
+			return shim.Error("no endpoints configured for chain " + args[0])
+		}
+		v, err = json.Marshal(chain)
+	} else {
+		v, err = json.Marshal(all)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 按优先级返回目的链的PAPP地址，暂时不可用的地址排在最后；未配置时使用modifyPAPPIP设置的地址
+func (broker *Broker) resolveEndpoints(stub shim.ChaincodeStubInterface, all map[string]ChainEndpoints, dstChainID string, now int64) ([]string, error) {
+	chain, ok := all[dstChainID]
+	if !ok || len(chain.Endpoints) == 0 {
+		IP, err := stub.GetState(PAPPIP)
+		if err != nil {
+			return nil, err
+		}
+		if len(IP) == 0 {
+			return nil, codeErrorf(CodeNotInitialized, "PAPP address not set for chain %s", dstChainID)
+		}
+		return []string{string(IP)}, nil
+	}
+
+	urls := append([]string(nil), chain.Endpoints...)
+	sort.SliceStable(urls, func(i, j int) bool {
+		return !chain.Health[urls[i]].down(now) && chain.Health[urls[j]].down(now)
+	})
+	return urls, nil
+}
+
+// 依次尝试目的链的PAPP地址，通信失败或该地址无法处理时换下一个，并记录各地址的健康状况
+// 健康状况只在all中更新，由调用方统一写回
+func (broker *Broker) sendWithFailover(stub shim.ChaincodeStubInterface, all map[string]ChainEndpoints, req RequestToPAPP, transport TransportConfig, budget time.Duration) ([]byte, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	now := ts.GetSeconds()
+
+	dstChainID := req.CCRequest.DstChainID
+	urls, err := broker.resolveEndpoints(stub, all, dstChainID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, u := range urls {
+		data, err := broker.sendToPAPP(u, req, transport, budget)
+		broker.recordHealth(all, dstChainID, u, err, now)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+		if !failover(err) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// 通信失败、PAPP内部错误、超时或该PAPP未接入目的链时换下一个地址；其他错误说明请求已被处理
+func failover(err error) bool {
+	perr, ok := err.(*papp.Error)
+	if !ok {
+		return true
+	}
+	switch perr.Code {
+	case papp.CodeInternal, papp.CodeTimeout, papp.CodeUnknownChain:
+		return true
+	default:
+		return false
+	}
+}
+
+// 记录一次请求结果，只记录已配置的地址
+func (broker *Broker) recordHealth(all map[string]ChainEndpoints, dstChainID string, u string, err error, now int64) {
+	chain, ok := all[dstChainID]
+	if !ok {
+		return
+	}
+	if chain.Health == nil {
+		chain.Health = make(map[string]EndpointHealth)
+	}
+	h := chain.Health[u]
+	if err == nil || !failover(err) {
+		h.Failures = 0
+		h.LastSuccess = now
+	} else {
+		h.Failures++
+		h.LastFailure = now
+		h.LastError = err.Error()
+	}
+	chain.Health[u] = h
+	all[dstChainID] = chain
+}
+
+// 读取所有目的链的PAPP地址
+func (broker *Broker) getEndpoints(stub shim.ChaincodeStubInterface) (map[string]ChainEndpoints, error) {
+	v, err := stub.GetState(PAPPEndpoints)
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]ChainEndpoints)
+	if v == nil {
+		return all, nil
+	}
+	if err := json.Unmarshal(v, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// 保存所有目的链的PAPP地址
+func (broker *Broker) putEndpoints(stub shim.ChaincodeStubInterface, all map[string]ChainEndpoints) error {
+	v, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(PAPPEndpoints, v)
+}
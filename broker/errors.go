@@ -0,0 +1,54 @@
+/*-------------------------------------------*/
+/*            错误码 errors.go                */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 跨链合约的错误码，以"[错误码] "的形式写在错误消息开头，业务合约可通过ErrorCodeOf识别
+// 未带错误码的错误消息表示其他错误
+const (
+	CodeInvalidArgument   = "invalid-argument"   // 参数个数或格式错误
+	CodeNotInitialized    = "not-initialized"    // 跨链合约未初始化或缺少配置
+	CodeNotRegistered     = "not-registered"     // 链、合约或公钥未注册
+	CodeInvalidTransition = "invalid-transition" // 发票状态变更不合法
+	CodeInFlight          = "in-flight"          // 发票正在转移，不能修改
+	CodeWrongChain        = "wrong-chain"        // 请求的目的链不是本链
+	CodeAccessDenied      = "access-denied"      // 调用者不是管理员组织
+	CodeTransport         = "transport"          // 与PAPP通信失败
+	CodeChaincode         = "chaincode"          // 调用业务合约失败
+	CodeDuplicate         = "duplicate"          // 请求已处理过，如重复回调
+)
+
+// 参数个数错误的消息前缀
+const errArgumentCount = "[" + CodeInvalidArgument + "] incorrect number of arguments"
+
+// 生成带错误码的错误消息
+func FormatError(code string, message string) string {
+	return "[" + code + "] " + message
+}
+
+// 解析错误消息开头的错误码，没有错误码时返回空
+func ErrorCodeOf(message string) string {
+	if !strings.HasPrefix(message, "[") {
+		return ""
+	}
+	end := strings.Index(message, "] ")
+	if end < 0 {
+		return ""
+	}
+	return message[1:end]
+}
+
+// 生成带错误码的错误
+func codeErrorf(code string, format string, args ...interface{}) error {
+	return fmt.Errorf(FormatError(code, format), args...)
+}
+
+// 调用业务合约失败的错误
+func chaincodeError(chaincode string, message string) error {
+	return codeErrorf(CodeChaincode, "invoke chaincode '%s' err: %s", chaincode, message)
+}
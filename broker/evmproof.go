@@ -0,0 +1,289 @@
+/*-------------------------------------------*/
+/*         EVM来源链回执证明校验 evmproof.go    */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/DXPlus/CrosschainContract/evm"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 以太坊兼容来源链的校验配置，登记在伙伴链信息中
+// 登记后该链的入链消息只能通过interchainEVMDeliver携带回执证明投递
+type EVMVerifier struct {
+	Contract string   `json:"contract"` //来源链跨链合约地址，0x开头的十六进制
+	Signers  []string `json:"signers"`  //区块头签名者的ECDSA公钥，PEM格式
+	Quorum   int      `json:"quorum"`   //区块头至少须有该数量的签名者签名
+}
+
+// 区块头签名者对区块哈希的签名
+type HeaderSignature struct {
+	Signer int    `json:"signer"` //签名者在Signers中的序号
+	SigR   []byte `json:"sigR"`
+	SigS   []byte `json:"sigS"`
+}
+
+// 已确认的来源链区块头
+type StoredHeader struct {
+	Hash         string `json:"hash"`         //区块哈希
+	Number       uint64 `json:"number"`       //区块高度
+	ReceiptsRoot string `json:"receiptsRoot"` //回执树的根
+	Signers      []int  `json:"signers"`      //签名的签名者序号
+}
+
+// 来源链跨链事件的回执证明
+type EVMProof struct {
+	BlockHash string   `json:"blockHash"` //事件所在区块的哈希，须已通过submitEVMHeader确认
+	TxIndex   uint64   `json:"txIndex"`   //交易在区块中的序号
+	LogIndex  int      `json:"logIndex"`  //事件在交易回执中的序号
+	Proof     []string `json:"proof"`     //回执树中从根到该交易回执的节点，0x开头的十六进制
+}
+
+// 校验来源链的校验配置
+func (v *EVMVerifier) Validate() error {
+	if addr, err := decodeHex(v.Contract); err != nil || len(addr) != 20 {
+		return fmt.Errorf("evm verifier: invalid contract address %s", v.Contract)
+	}
+	seen := make(map[string]bool, len(v.Signers))
+	for i, s := range v.Signers {
+		der, err := parsePublicKey(s)
+		if err != nil {
+			return fmt.Errorf("evm verifier: signer %d: %w", i, err)
+		}
+		if seen[string(der)] {
+			return fmt.Errorf("evm verifier: duplicate signer %d", i)
+		}
+		seen[string(der)] = true
+	}
+	if v.Quorum < 1 || v.Quorum > len(v.Signers) {
+		return fmt.Errorf("evm verifier: invalid quorum %d, expecting 1-%d", v.Quorum, len(v.Signers))
+	}
+	return nil
+}
+
+// 校验区块头签名是否达到法定数量，返回签名的签名者序号
+func (v *EVMVerifier) verifyHeader(hash []byte, sigs []HeaderSignature) ([]int, error) {
+	signed := make(map[int]bool)
+	signers := make([]int, 0, len(sigs))
+	for _, sig := range sigs {
+		if sig.Signer < 0 || sig.Signer >= len(v.Signers) {
+			return nil, fmt.Errorf("unknown header signer %d", sig.Signer)
+		}
+		if signed[sig.Signer] {
+			continue
+		}
+		publicKey, err := parsePublicKey(v.Signers[sig.Signer])
+		if err != nil {
+			return nil, err
+		}
+		if err := VerifyPayload(publicKey, hash, sig.SigR, sig.SigS); err != nil {
+			return nil, fmt.Errorf("header signer %d: %w", sig.Signer, err)
+		}
+		signed[sig.Signer] = true
+		signers = append(signers, sig.Signer)
+	}
+	if len(signers) < v.Quorum {
+		return nil, fmt.Errorf("header signed by %d signers, expecting at least %d", len(signers), v.Quorum)
+	}
+	return signers, nil
+}
+
+// 校验回执证明并解码其中的跨链事件
+func (v *EVMVerifier) verifyEvent(header StoredHeader, proof EVMProof) (evm.InterchainEvent, error) {
+	root, err := decodeHex(header.ReceiptsRoot)
+	if err != nil {
+		return evm.InterchainEvent{}, err
+	}
+	nodes := make([][]byte, 0, len(proof.Proof))
+	for _, p := range proof.Proof {
+		node, err := decodeHex(p)
+		if err != nil {
+			return evm.InterchainEvent{}, fmt.Errorf("invalid proof node: %w", err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	raw, err := evm.VerifyProof(root, evm.EncodeUint(proof.TxIndex), nodes)
+	if err != nil {
+		return evm.InterchainEvent{}, err
+	}
+	receipt, err := evm.DecodeReceipt(raw)
+	if err != nil {
+		return evm.InterchainEvent{}, err
+	}
+	if receipt.Status != 1 {
+		return evm.InterchainEvent{}, fmt.Errorf("transaction %d in block %s failed", proof.TxIndex, header.Hash)
+	}
+	if proof.LogIndex < 0 || proof.LogIndex >= len(receipt.Logs) {
+		return evm.InterchainEvent{}, fmt.Errorf("log %d not found in receipt", proof.LogIndex)
+	}
+
+	log := receipt.Logs[proof.LogIndex]
+	contract, _ := decodeHex(v.Contract)
+	if !bytes.Equal(log.Address, contract) {
+		return evm.InterchainEvent{}, fmt.Errorf("log emitted by 0x%x, expecting %s", log.Address, v.Contract)
+	}
+	if len(log.Topics) == 0 || !bytes.Equal(log.Topics[0], evm.InterchainEventTopic) {
+		return evm.InterchainEvent{}, fmt.Errorf("log is not an interchain event")
+	}
+	return evm.DecodeInterchainEvent(log.Data)
+}
+
+// 获取来源链的EVM校验配置
+func (broker *Broker) evmVerifier(stub shim.ChaincodeStubInterface, chainID string) (*EVMVerifier, error) {
+	info, err := broker.lookupChain(stub, chainID)
+	if err != nil {
+		return nil, err
+	}
+	if info.EVM == nil {
+		return nil, fmt.Errorf("no evm verifier registered for chain %s", chainID)
+	}
+	return info.EVM, nil
+}
+
+// 区块头签名者提交来源链的区块头
+// args[0] 来源链ID，args[1] RLP编码的区块头，0x开头的十六进制，args[2] 签名者对区块哈希的签名列表HeaderSignature
+func (broker *Broker) submitEVMHeader(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+	verifier, err := broker.evmVerifier(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	raw, err := decodeHex(args[1])
+	if err != nil {
+		return shim.Error(fmt.Errorf("invalid header: %w", err).Error())
+	}
+	header, err := evm.DecodeHeader(raw)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sigs := make([]HeaderSignature, 0)
+	if err := json.Unmarshal([]byte(args[2]), &sigs); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal header signatures: %w", err).Error())
+	}
+	signers, err := verifier.verifyHeader(header.Hash, sigs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	stored := StoredHeader{
+		Hash:         "0x" + hex.EncodeToString(header.Hash),
+		Number:       header.Number,
+		ReceiptsRoot: "0x" + hex.EncodeToString(header.ReceiptsRoot),
+		Signers:      signers,
+	}
+	v, err := json.Marshal(stored)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(evmHeaderKey(args[0], stored.Hash), v); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 查询已确认的来源链区块头
+// args[0] 来源链ID，args[1] 区块哈希
+func (broker *Broker) getEVMHeader(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+	v, err := stub.GetState(evmHeaderKey(args[0], args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if v == nil {
+		return shim.Error("header not found: " + args[1])
+	}
+	return shim.Success(v)
+}
+
+// PAPP投递携带回执证明的入链消息
+// args[0] 来源链ID，args[1] 目的链ID，args[2] 跨链事件的回执证明EVMProof
+func (broker *Broker) interchainEVMDeliver(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+	srcChainID, err := broker.checkInbound(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	verifier, err := broker.evmVerifier(stub, srcChainID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	proof := EVMProof{}
+	if err := json.Unmarshal([]byte(args[2]), &proof); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal proof: %w", err).Error())
+	}
+	v, err := stub.GetState(evmHeaderKey(srcChainID, proof.BlockHash))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if v == nil {
+		return shim.Error("header not confirmed: " + proof.BlockHash)
+	}
+	header := StoredHeader{}
+	if err := json.Unmarshal(v, &header); err != nil {
+		return shim.Error(err.Error())
+	}
+	ev, err := verifier.verifyEvent(header, proof)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if ev.DstChainID != args[1] {
+		return shim.Error(FormatError(CodeWrongChain, "event addressed to chain "+ev.DstChainID))
+	}
+
+	msg, err := ToInbound(CrossChainRequest{
+		SrcChainID: srcChainID,
+		DstChainID: ev.DstChainID,
+		Index:      ev.Index,
+		DstService: ev.DstService,
+		Func:       ev.Func,
+		Args:       ev.Args,
+		Callback:   ev.Callback,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	inMeta, err := broker.getMap(stub, innerMeta)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, err := broker.deliverMessage(stub, inMeta, msg)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := broker.putMap(stub, innerMeta, inMeta); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ret, err := json.Marshal([]DeliverResult{result})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(ret)
+}
+
+// 来源链区块头在账本中的key，区块哈希统一为小写十六进制
+func evmHeaderKey(chainID string, hash string) string {
+	return fmt.Sprintf("evm-header-%s-%s", chainID, strings.ToLower(strings.TrimPrefix(hash, "0x")))
+}
+
+// 解析0x开头的十六进制
+func decodeHex(s string) ([]byte, error) {
+	return hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+}
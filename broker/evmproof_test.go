@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DXPlus/CrosschainContract/evm"
+)
+
+const testEVMContract = "0x5fbdb2315678afecb367f032d93f642f64180aa3"
+
+// 测试用的RLP编码
+func rlpString(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return b
+	}
+	return append(rlpLength(len(b), 0x80), b...)
+}
+
+func rlpList(items ...[]byte) []byte {
+	payload := bytes.Join(items, nil)
+	return append(rlpLength(len(payload), 0xc0), payload...)
+}
+
+func rlpLength(n int, offset byte) []byte {
+	if n <= 55 {
+		return []byte{offset + byte(n)}
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n))
+	i := 0
+	for buf[i] == 0 {
+		i++
+	}
+	return append([]byte{offset + 55 + byte(8-i)}, buf[i:]...)
+}
+
+// ABI编码的跨链事件：InterchainRequest("chainB", 1, "", "interchainSet", ["k1", "v1"], "")
+func abiEvent() []byte {
+	word := func(n int) []byte {
+		w := make([]byte, 32)
+		binary.BigEndian.PutUint64(w[24:], uint64(n))
+		return w
+	}
+	str := func(s string) []byte {
+		padded := make([]byte, (len(s)+31)/32*32)
+		copy(padded, s)
+		return append(word(len(s)), padded...)
+	}
+	args := bytes.Join([][]byte{word(2), word(64), word(128), str("k1"), str("v1")}, nil)
+	tail := [][]byte{str("chainB"), str(""), str("interchainSet"), args, str("")}
+	offsets := []int{192}
+	for _, part := range tail[:len(tail)-1] {
+		offsets = append(offsets, offsets[len(offsets)-1]+len(part))
+	}
+	head := bytes.Join([][]byte{word(offsets[0]), word(1), word(offsets[1]), word(offsets[2]), word(offsets[3]), word(offsets[4])}, nil)
+	return append(head, bytes.Join(tail, nil)...)
+}
+
+// 只含一笔交易回执的区块：回执树只有一个叶子节点，路径为交易序号0的编码0x80
+func receiptTrie(status uint64, address []byte, topic []byte) ([]byte, []string) {
+	log := rlpList(rlpString(address), rlpList(rlpString(topic)), rlpString(abiEvent()))
+	receipt := rlpList(evm.EncodeUint(status), evm.EncodeUint(50000), rlpString(make([]byte, 256)), rlpList(log))
+	// EIP-1559类型化回执
+	typed := append([]byte{0x02}, receipt...)
+	leaf := rlpList(rlpString([]byte{0x20, 0x80}), rlpString(typed))
+	return evm.Keccak256(leaf), []string{"0x" + hex.EncodeToString(leaf)}
+}
+
+// 生成n个区块头签名者的私钥及quorum为threshold的校验配置
+func newTestEVMVerifier(t *testing.T, n int, threshold int) (*EVMVerifier, [][]byte) {
+	v := &EVMVerifier{Contract: testEVMContract, Quorum: threshold}
+	keys := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, der)
+		v.Signers = append(v.Signers, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})))
+	}
+	if err := v.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return v, keys
+}
+
+func signHeader(t *testing.T, keys [][]byte, hash []byte, signers ...int) []HeaderSignature {
+	sigs := make([]HeaderSignature, 0, len(signers))
+	for _, i := range signers {
+		r, s, err := SignPayload(keys[i], hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs = append(sigs, HeaderSignature{Signer: i, SigR: r, SigS: s})
+	}
+	return sigs
+}
+
+func TestEVMVerifyHeaderQuorum(t *testing.T) {
+	v, keys := newTestEVMVerifier(t, 3, 2)
+	hash := evm.Keccak256([]byte("header"))
+
+	signers, err := v.verifyHeader(hash, signHeader(t, keys, hash, 0, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(signers, []int{0, 2}) {
+		t.Fatalf("signers are %v", signers)
+	}
+
+	// 低于法定数量，同一签名者的重复签名只计一次
+	if _, err := v.verifyHeader(hash, signHeader(t, keys, hash, 1, 1)); err == nil || !strings.Contains(err.Error(), "expecting at least 2") {
+		t.Fatalf("one signer returned %v", err)
+	}
+	// 签名者对其他区块头的签名
+	other := evm.Keccak256([]byte("other"))
+	sigs := append(signHeader(t, keys, hash, 0), signHeader(t, keys, other, 1)...)
+	if _, err := v.verifyHeader(hash, sigs); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Fatalf("signature over another header returned %v", err)
+	}
+	// 未登记的签名者
+	if _, err := v.verifyHeader(hash, append(signHeader(t, keys, hash, 0), HeaderSignature{Signer: 3})); err == nil || !strings.Contains(err.Error(), "unknown header signer") {
+		t.Fatalf("unknown signer returned %v", err)
+	}
+}
+
+func TestEVMVerifyEvent(t *testing.T) {
+	v, _ := newTestEVMVerifier(t, 1, 1)
+	contract, _ := decodeHex(testEVMContract)
+
+	root, proof := receiptTrie(1, contract, evm.InterchainEventTopic)
+	header := StoredHeader{Hash: "0x01", ReceiptsRoot: "0x" + hex.EncodeToString(root)}
+	ev, err := v.verifyEvent(header, EVMProof{TxIndex: 0, LogIndex: 0, Proof: proof})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := evm.InterchainEvent{DstChainID: "chainB", Index: 1, Func: "interchainSet", Args: []string{"k1", "v1"}}
+	if !reflect.DeepEqual(ev, want) {
+		t.Fatalf("event decoded as %+v", ev)
+	}
+
+	// 证明中不存在的交易与日志
+	if _, err := v.verifyEvent(header, EVMProof{TxIndex: 1, Proof: proof}); err == nil {
+		t.Fatal("missing transaction accepted")
+	}
+	if _, err := v.verifyEvent(header, EVMProof{LogIndex: 1, Proof: proof}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("missing log returned %v", err)
+	}
+
+	// 被篡改的回执节点
+	tampered := []string{strings.Replace(proof[0], "6b31", "6b32", 1)}
+	if _, err := v.verifyEvent(header, EVMProof{Proof: tampered}); err == nil || !strings.Contains(err.Error(), "missing node") {
+		t.Fatalf("tampered receipt returned %v", err)
+	}
+}
+
+func TestEVMVerifyEventRejectsForeignLog(t *testing.T) {
+	v, _ := newTestEVMVerifier(t, 1, 1)
+	contract, _ := decodeHex(testEVMContract)
+
+	for name, c := range map[string]struct {
+		status  uint64
+		address []byte
+		topic   []byte
+		want    string
+	}{
+		"other contract": {1, bytes.Repeat([]byte{0x11}, 20), evm.InterchainEventTopic, "log emitted by"},
+		"other event":    {1, contract, evm.Keccak256([]byte("Transfer(address,address,uint256)")), "not an interchain event"},
+		"failed tx":      {0, contract, evm.InterchainEventTopic, "failed"},
+	} {
+		root, proof := receiptTrie(c.status, c.address, c.topic)
+		header := StoredHeader{Hash: "0x01", ReceiptsRoot: "0x" + hex.EncodeToString(root)}
+		if _, err := v.verifyEvent(header, EVMProof{Proof: proof}); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("%s returned %v", name, err)
+		}
+	}
+}
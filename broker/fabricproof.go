@@ -0,0 +1,392 @@
+/*-------------------------------------------*/
+/*         Fabric来源链背书校验 fabricproof.go  */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// Fabric来源链的校验配置，登记在伙伴链信息中
+// 登记后该链的入链消息只能通过interchainFabricDeliver携带背书证明投递
+type FabricVerifier struct {
+	ChannelID     string            `json:"channelID"`     //来源链跨链合约所在通道
+	ChaincodeName string            `json:"chaincodeName"` //来源链跨链合约的链码名
+	MSPs          []FabricMSP       `json:"msps"`          //来源链各组织的MSP
+	Policy        EndorsementPolicy `json:"policy"`        //来源链跨链合约的背书策略
+}
+
+// 来源链组织的MSP根证书
+type FabricMSP struct {
+	MSPID             string   `json:"mspID"`
+	RootCerts         []string `json:"rootCerts"`                   //根CA证书，PEM格式
+	IntermediateCerts []string `json:"intermediateCerts,omitempty"` //中间CA证书，PEM格式
+	PeerOU            string   `json:"peerOU,omitempty"`            //背书节点证书的OU，即NodeOUs中的peer角色，默认为peer
+}
+
+// 背书节点证书的默认OU
+const defaultPeerOU = "peer"
+
+// 背书策略：MSPIDs中至少Threshold个不同组织的节点背书
+type EndorsementPolicy struct {
+	Threshold int      `json:"threshold"`
+	MSPIDs    []string `json:"mspIDs,omitempty"` //为空时为msps中的全部组织
+}
+
+// 来源链交易的背书证明，取自来源链区块中的该交易
+type FabricProof struct {
+	Header                   []byte              `json:"header"`                   //交易Payload的common.Header，含通道头
+	ChaincodeProposalPayload []byte              `json:"chaincodeProposalPayload"` //ChaincodeActionPayload中的提案内容
+	ProposalResponsePayload  []byte              `json:"proposalResponsePayload"`  //背书节点签名的ProposalResponsePayload
+	Endorsements             []FabricEndorsement `json:"endorsements"`             //ChaincodeEndorsedAction中的背书
+}
+
+// 单个背书节点的背书
+type FabricEndorsement struct {
+	Endorser  []byte `json:"endorser"`  //序列化的背书节点身份msp.SerializedIdentity
+	Signature []byte `json:"signature"` //对ProposalResponsePayload与Endorser的签名
+}
+
+// 校验来源链的校验配置
+func (v *FabricVerifier) Validate() error {
+	if v.ChannelID == "" {
+		return fmt.Errorf("fabric verifier: channel ID cannot be empty")
+	}
+	if v.ChaincodeName == "" {
+		return fmt.Errorf("fabric verifier: chaincode name cannot be empty")
+	}
+	if len(v.MSPs) == 0 {
+		return fmt.Errorf("fabric verifier: no MSP configured")
+	}
+	known := make(map[string]bool, len(v.MSPs))
+	for _, m := range v.MSPs {
+		if m.MSPID == "" || known[m.MSPID] {
+			return fmt.Errorf("fabric verifier: empty or duplicate MSP ID %q", m.MSPID)
+		}
+		known[m.MSPID] = true
+		if _, err := m.verifyOptions(time.Time{}); err != nil {
+			return err
+		}
+	}
+	for _, id := range v.Policy.MSPIDs {
+		if !known[id] {
+			return fmt.Errorf("fabric verifier: policy references unknown MSP %s", id)
+		}
+	}
+	if n := len(v.policyMSPIDs()); v.Policy.Threshold < 1 || v.Policy.Threshold > n {
+		return fmt.Errorf("fabric verifier: invalid threshold %d, expecting 1-%d", v.Policy.Threshold, n)
+	}
+	return nil
+}
+
+// 背书策略中的组织
+func (v *FabricVerifier) policyMSPIDs() []string {
+	if len(v.Policy.MSPIDs) > 0 {
+		return v.Policy.MSPIDs
+	}
+	ids := make([]string, 0, len(v.MSPs))
+	for _, m := range v.MSPs {
+		ids = append(ids, m.MSPID)
+	}
+	return ids
+}
+
+// 生成校验证书链的选项，now为证书有效期的参照时间
+func (m FabricMSP) verifyOptions(now time.Time) (x509.VerifyOptions, error) {
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if len(m.RootCerts) == 0 {
+		return opts, fmt.Errorf("fabric verifier: no root certificate for MSP %s", m.MSPID)
+	}
+	for _, c := range m.RootCerts {
+		if !opts.Roots.AppendCertsFromPEM([]byte(c)) {
+			return opts, fmt.Errorf("fabric verifier: invalid root certificate for MSP %s", m.MSPID)
+		}
+	}
+	for _, c := range m.IntermediateCerts {
+		if !opts.Intermediates.AppendCertsFromPEM([]byte(c)) {
+			return opts, fmt.Errorf("fabric verifier: invalid intermediate certificate for MSP %s", m.MSPID)
+		}
+	}
+	return opts, nil
+}
+
+// 校验背书是否满足背书策略且提案属于登记的通道，返回背书节点签名的ProposalResponsePayload
+// now为来源链交易证书有效期的参照时间
+func (v *FabricVerifier) Verify(proof FabricProof, now time.Time) (*pb.ProposalResponsePayload, error) {
+	prp := &pb.ProposalResponsePayload{}
+	if err := proto.Unmarshal(proof.ProposalResponsePayload, prp); err != nil {
+		return nil, fmt.Errorf("unmarshal proposal response payload: %w", err)
+	}
+	if err := v.verifyChannel(proof, prp.ProposalHash); err != nil {
+		return nil, err
+	}
+
+	msps := make(map[string]FabricMSP, len(v.MSPs))
+	for _, m := range v.MSPs {
+		msps[m.MSPID] = m
+	}
+
+	endorsed := make(map[string]bool)
+	for i, e := range proof.Endorsements {
+		mspID, err := verifyEndorsement(msps, proof.ProposalResponsePayload, e, now)
+		if err != nil {
+			return nil, fmt.Errorf("endorsement %d: %w", i, err)
+		}
+		endorsed[mspID] = true
+	}
+
+	satisfied := 0
+	for _, id := range v.policyMSPIDs() {
+		if endorsed[id] {
+			satisfied++
+		}
+	}
+	if satisfied < v.Policy.Threshold {
+		return nil, fmt.Errorf("endorsement policy not satisfied: %d of %d organizations", satisfied, v.Policy.Threshold)
+	}
+	return prp, nil
+}
+
+// 校验背书的提案属于登记通道上的背书交易：提案哈希为通道头、签名头与提案内容的SHA-256
+func (v *FabricVerifier) verifyChannel(proof FabricProof, proposalHash []byte) error {
+	header := &common.Header{}
+	if err := proto.Unmarshal(proof.Header, header); err != nil {
+		return fmt.Errorf("unmarshal header: %w", err)
+	}
+	h := sha256.New()
+	h.Write(header.ChannelHeader)
+	h.Write(header.SignatureHeader)
+	h.Write(proof.ChaincodeProposalPayload)
+	if !bytes.Equal(h.Sum(nil), proposalHash) {
+		return fmt.Errorf("header does not match the endorsed proposal")
+	}
+
+	chdr := &common.ChannelHeader{}
+	if err := proto.Unmarshal(header.ChannelHeader, chdr); err != nil {
+		return fmt.Errorf("unmarshal channel header: %w", err)
+	}
+	if chdr.Type != int32(common.HeaderType_ENDORSER_TRANSACTION) {
+		return fmt.Errorf("transaction type %d is not an endorser transaction", chdr.Type)
+	}
+	if chdr.ChannelId != v.ChannelID {
+		return fmt.Errorf("transaction on channel %s, expecting %s", chdr.ChannelId, v.ChannelID)
+	}
+	return nil
+}
+
+// 证书是否带有背书节点角色的OU
+func (m FabricMSP) isPeer(cert *x509.Certificate) bool {
+	peerOU := m.PeerOU
+	if peerOU == "" {
+		peerOU = defaultPeerOU
+	}
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if ou == peerOU {
+			return true
+		}
+	}
+	return false
+}
+
+// 校验单个背书节点的证书与签名，返回其所属组织
+func verifyEndorsement(msps map[string]FabricMSP, prp []byte, e FabricEndorsement, now time.Time) (string, error) {
+	sid := &msp.SerializedIdentity{}
+	if err := proto.Unmarshal(e.Endorser, sid); err != nil {
+		return "", fmt.Errorf("unmarshal endorser: %w", err)
+	}
+	m, ok := msps[sid.Mspid]
+	if !ok {
+		return "", fmt.Errorf("unknown MSP %s", sid.Mspid)
+	}
+
+	block, _ := pem.Decode(sid.IdBytes)
+	if block == nil {
+		return "", fmt.Errorf("invalid endorser certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("invalid endorser certificate: %w", err)
+	}
+	opts, err := m.verifyOptions(now)
+	if err != nil {
+		return "", err
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		return "", fmt.Errorf("endorser certificate not issued by MSP %s: %w", sid.Mspid, err)
+	}
+	// 只接受背书节点的证书，同一MSP的客户端证书（如中继自身）不能伪造背书
+	if !m.isPeer(cert) {
+		return "", fmt.Errorf("endorser of MSP %s is not a peer", sid.Mspid)
+	}
+
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("endorser key is not ECDSA")
+	}
+	digest := sha256.Sum256(append(append([]byte(nil), prp...), e.Endorser...))
+	if !ecdsa.VerifyASN1(pub, digest[:], e.Signature) {
+		return "", fmt.Errorf("invalid signature from MSP %s", sid.Mspid)
+	}
+	return sid.Mspid, nil
+}
+
+// 从背书结果中取出来源链跨链合约写入的发往dstChainID的跨链请求，按序号排序
+func (v *FabricVerifier) outboundRequests(prp *pb.ProposalResponsePayload, dstChainID string) ([]CrossChainRequest, error) {
+	action := &pb.ChaincodeAction{}
+	if err := proto.Unmarshal(prp.Extension, action); err != nil {
+		return nil, fmt.Errorf("unmarshal chaincode action: %w", err)
+	}
+	if action.ChaincodeId == nil || action.ChaincodeId.Name != v.ChaincodeName {
+		return nil, fmt.Errorf("transaction not executed by chaincode %s", v.ChaincodeName)
+	}
+	if action.Response == nil || action.Response.Status != shim.OK {
+		return nil, fmt.Errorf("transaction failed on source chain")
+	}
+
+	txRWSet := &rwset.TxReadWriteSet{}
+	if err := proto.Unmarshal(action.Results, txRWSet); err != nil {
+		return nil, fmt.Errorf("unmarshal read-write set: %w", err)
+	}
+
+	// 嵌入模式下跨链合约的key带有EmbeddedKeyPrefix
+	prefix := OutMsgKey(dstChainID, "")
+	reqs := make([]CrossChainRequest, 0)
+	for _, ns := range txRWSet.NsRwset {
+		if ns.Namespace != v.ChaincodeName {
+			continue
+		}
+		kv := &kvrwset.KVRWSet{}
+		if err := proto.Unmarshal(ns.Rwset, kv); err != nil {
+			return nil, fmt.Errorf("unmarshal read-write set: %w", err)
+		}
+		for _, w := range kv.Writes {
+			key := strings.TrimPrefix(w.Key, EmbeddedKeyPrefix)
+			if w.IsDelete || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			req := CrossChainRequest{}
+			if err := json.Unmarshal(w.Value, &req); err != nil {
+				return nil, fmt.Errorf("unmarshal request %s: %w", key, err)
+			}
+			// 前缀相同的其他目的链
+			if req.DstChainID != dstChainID {
+				continue
+			}
+			if key != OutMsgKey(dstChainID, strconv.FormatUint(req.Index, 10)) {
+				return nil, fmt.Errorf("request stored under %s does not match its key", key)
+			}
+			reqs = append(reqs, req)
+		}
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("no request to chain %s in transaction", dstChainID)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].Index < reqs[j].Index })
+	return reqs, nil
+}
+
+// 获取来源链的Fabric校验配置，未登记时返回nil
+func (broker *Broker) fabricVerifier(stub shim.ChaincodeStubInterface, srcChainID string) (*FabricVerifier, error) {
+	registry, err := broker.getRegistry(stub)
+	if err != nil {
+		return nil, err
+	}
+	return registry[srcChainID].Fabric, nil
+}
+
+// PAPP投递携带背书证明的入链消息
+// args[0] 来源链ID，args[1] 目的链ID，args[2] 来源链发出跨链请求的交易的背书证明FabricProof
+// 校验背书满足来源链的背书策略后，按序号投递该交易中发往本链的全部跨链请求，遇到失败即停止
+func (broker *Broker) interchainFabricDeliver(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+	srcChainID, err := broker.checkInbound(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	verifier, err := broker.fabricVerifier(stub, srcChainID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if verifier == nil {
+		return shim.Error("no fabric verifier registered for chain " + srcChainID)
+	}
+
+	proof := FabricProof{}
+	if err := json.Unmarshal([]byte(args[2]), &proof); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal proof: %w", err).Error())
+	}
+	// 以本交易时间校验证书有效期，保证各背书节点结果一致
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	prp, err := verifier.Verify(proof, time.Unix(ts.GetSeconds(), 0))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reqs, err := verifier.outboundRequests(prp, args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	inMeta, err := broker.getMap(stub, innerMeta)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	results := make([]DeliverResult, 0, len(reqs))
+	for _, req := range reqs {
+		if req.SrcChainID != srcChainID {
+			return shim.Error(fmt.Sprintf("request %d was issued by chain %s", req.Index, req.SrcChainID))
+		}
+		// 已投递的请求跳过，部分投递后可重复提交同一证明
+		if req.Index <= inMeta[srcChainID] {
+			continue
+		}
+		msg, err := ToInbound(req)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result, err := broker.deliverMessage(stub, inMeta, msg)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		results = append(results, result)
+		if result.Status != deliverStatusSuccess {
+			break
+		}
+	}
+	if err := broker.putMap(stub, innerMeta, inMeta); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ret, err := json.Marshal(results)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(ret)
+}
@@ -0,0 +1,235 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset"
+	"github.com/hyperledger/fabric-protos-go/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 测试用的来源链组织：根CA及其签发的节点证书
+type testOrg struct {
+	mspID   string
+	rootKey *ecdsa.PrivateKey
+	root    *x509.Certificate
+	rootPEM string
+}
+
+func newTestOrg(t *testing.T, mspID string) *testOrg {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca." + mspID},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testOrg{
+		mspID:   mspID,
+		rootKey: key,
+		root:    root,
+		rootPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+}
+
+// 签发带有指定OU的身份，返回序列化身份与私钥
+func (org *testOrg) identity(t *testing.T, ou string) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: ou + "0." + org.mspID, OrganizationalUnit: []string{ou}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, org.root, &key.PublicKey, org.rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   org.mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sid, key
+}
+
+// 以ou角色的身份背书
+func (org *testOrg) endorse(t *testing.T, ou string, prp []byte) FabricEndorsement {
+	endorser, key := org.identity(t, ou)
+	digest := sha256.Sum256(append(append([]byte(nil), prp...), endorser...))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FabricEndorsement{Endorser: endorser, Signature: sig}
+}
+
+func newTestVerifier(threshold int, orgs ...*testOrg) *FabricVerifier {
+	v := &FabricVerifier{ChannelID: "mychannel", ChaincodeName: "broker", Policy: EndorsementPolicy{Threshold: threshold}}
+	for _, org := range orgs {
+		v.MSPs = append(v.MSPs, FabricMSP{MSPID: org.mspID, RootCerts: []string{org.rootPEM}})
+	}
+	return v
+}
+
+// 生成channelID上broker链码写入发往chainB的1号请求的交易证明，尚未背书
+func newTestProof(t *testing.T, channelID string) FabricProof {
+	chdr, err := proto.Marshal(&common.ChannelHeader{
+		Type:      int32(common.HeaderType_ENDORSER_TRANSACTION),
+		ChannelId: channelID,
+		TxId:      "tx1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := proto.Marshal(&common.Header{ChannelHeader: chdr, SignatureHeader: []byte("creator")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("proposal")
+	h := sha256.New()
+	h.Write(chdr)
+	h.Write([]byte("creator"))
+	h.Write(payload)
+
+	req, err := json.Marshal(CrossChainRequest{SrcChainID: "chainA", DstChainID: "chainB", Index: 1, Func: "InterchainSingleModify", Args: []string{"chainB", "k1", "v1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := proto.Marshal(&kvrwset.KVRWSet{Writes: []*kvrwset.KVWrite{{Key: OutMsgKey("chainB", "1"), Value: req}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := proto.Marshal(&rwset.TxReadWriteSet{NsRwset: []*rwset.NsReadWriteSet{{Namespace: "broker", Rwset: kv}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	action, err := proto.Marshal(&pb.ChaincodeAction{
+		Results:     results,
+		Response:    &pb.Response{Status: 200},
+		ChaincodeId: &pb.ChaincodeID{Name: "broker"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prp, err := proto.Marshal(&pb.ProposalResponsePayload{ProposalHash: h.Sum(nil), Extension: action})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FabricProof{Header: header, ChaincodeProposalPayload: payload, ProposalResponsePayload: prp}
+}
+
+func TestFabricVerifyPeerEndorsements(t *testing.T) {
+	org1, org2 := newTestOrg(t, "Org1MSP"), newTestOrg(t, "Org2MSP")
+	v := newTestVerifier(2, org1, org2)
+	if err := v.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	proof := newTestProof(t, "mychannel")
+	proof.Endorsements = []FabricEndorsement{
+		org1.endorse(t, "peer", proof.ProposalResponsePayload),
+		org2.endorse(t, "peer", proof.ProposalResponsePayload),
+	}
+	prp, err := v.Verify(proof, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs, err := v.outboundRequests(prp, "chainB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].Index != 1 || reqs[0].Args[2] != "v1" {
+		t.Fatalf("outbound requests %+v", reqs)
+	}
+}
+
+func TestFabricVerifyRejectsClientEndorsement(t *testing.T) {
+	org1 := newTestOrg(t, "Org1MSP")
+	v := newTestVerifier(1, org1)
+
+	// 同一MSP签发的客户端证书（如中继自身）不能背书
+	proof := newTestProof(t, "mychannel")
+	proof.Endorsements = []FabricEndorsement{org1.endorse(t, "client", proof.ProposalResponsePayload)}
+	if _, err := v.Verify(proof, time.Now()); err == nil || !strings.Contains(err.Error(), "not a peer") {
+		t.Fatalf("client endorsement returned %v", err)
+	}
+
+	// 其他CA签发的节点证书同样拒绝
+	forger := newTestOrg(t, "Org1MSP")
+	proof.Endorsements = []FabricEndorsement{forger.endorse(t, "peer", proof.ProposalResponsePayload)}
+	if _, err := v.Verify(proof, time.Now()); err == nil {
+		t.Fatal("endorsement from a foreign CA accepted")
+	}
+}
+
+func TestFabricVerifyThreshold(t *testing.T) {
+	org1, org2 := newTestOrg(t, "Org1MSP"), newTestOrg(t, "Org2MSP")
+	v := newTestVerifier(2, org1, org2)
+
+	// 同一组织的多个背书只计一次
+	proof := newTestProof(t, "mychannel")
+	proof.Endorsements = []FabricEndorsement{
+		org1.endorse(t, "peer", proof.ProposalResponsePayload),
+		org1.endorse(t, "peer", proof.ProposalResponsePayload),
+	}
+	if _, err := v.Verify(proof, time.Now()); err == nil || !strings.Contains(err.Error(), "policy not satisfied") {
+		t.Fatalf("one organization satisfied a 2-of-2 policy: %v", err)
+	}
+
+	v.Policy.Threshold = 1
+	if _, err := v.Verify(proof, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFabricVerifyChannel(t *testing.T) {
+	org1 := newTestOrg(t, "Org1MSP")
+	v := newTestVerifier(1, org1)
+
+	proof := newTestProof(t, "otherchannel")
+	proof.Endorsements = []FabricEndorsement{org1.endorse(t, "peer", proof.ProposalResponsePayload)}
+	if _, err := v.Verify(proof, time.Now()); err == nil || !strings.Contains(err.Error(), "otherchannel") {
+		t.Fatalf("transaction on another channel returned %v", err)
+	}
+
+	// 替换为其他交易的通道头时提案哈希不符
+	proof.Header = newTestProof(t, "mychannel").Header
+	if _, err := v.Verify(proof, time.Now()); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("swapped header returned %v", err)
+	}
+}
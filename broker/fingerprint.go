@@ -0,0 +1,315 @@
+/*-------------------------------------------*/
+/*            发票指纹模块 fingerprint.go      */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	FingerprintSalt       = "fingerprint-salt"
+	FingerprintCollection = "brokerPrivateCollection" // 保存盐的私有数据集合，只分发给本链管理员组织的节点
+
+	fingerprintObjectType = "fingerprint"
+	fingerprintOut        = "out" // 本链发出的发票
+	fingerprintIn         = "in"  // 本链收到的发票
+
+	capabilityFingerprintQuery = "InterchainFingerprintQuery"
+)
+
+// 本链发出或收到某张发票的记录，只保存指纹，不保存发票内容
+type FingerprintRecord struct {
+	Fingerprint string `json:"fingerprint"` //发票指纹
+	Direction   string `json:"direction"`   //out：发出，in：收到
+	ChainID     string `json:"chainID"`     //对端链ID
+	TxID        string `json:"txID"`        //交易ID
+}
+
+// 目的链对指纹查询的应答
+type FingerprintClaim struct {
+	Fingerprint string `json:"fingerprint"` //发票指纹
+	ChainID     string `json:"chainID"`     //应答链ID
+	Claimed     bool   `json:"claimed"`     //应答链是否发出或收到过该发票
+}
+
+// 跨链指纹查询结果
+type FingerprintQueryResult struct {
+	Fingerprint string            `json:"fingerprint"`      //发票指纹
+	TxID        string            `json:"txID"`             //发起查询的交易ID
+	Claimed     map[string]bool   `json:"claimed"`          //各链的应答
+	Missing     []string          `json:"missing"`          //未应答的链
+	Errors      map[string]string `json:"errors,omitempty"` //未应答的原因
+}
+
+// 是否有链声明过该指纹
+func (result FingerprintQueryResult) AnyClaimed() bool {
+	for _, claimed := range result.Claimed {
+		if claimed {
+			return true
+		}
+	}
+	return false
+}
+
+// 计算发票指纹：sha256(盐|发票代码|发票号码|金额)，金额以分为单位
+// 各链必须配置相同的盐才能比对指纹；盐只保存在私有数据集合中，不知道盐的参与方无法由发票信息穷举指纹
+func InvoiceFingerprint(salt string, fpdm string, fphm string, amount int64) string {
+	sum := sha256.Sum256([]byte(salt + "|" + fpdm + "|" + fphm + "|" + strconv.FormatInt(amount, 10)))
+	return hex.EncodeToString(sum[:])
+}
+
+// 设置指纹的盐，同一跨链网络中的各链需设置相同的值
+// 盐通过transient字段salt传入，不出现在交易参数中，只写入私有数据集合
+func (broker *Broker) setFingerprintSalt(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 0 {
+		return shim.Error(FormatError(CodeInvalidArgument, "fingerprint salt must be passed in the transient field salt"))
+	}
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	salt := transient["salt"]
+	if len(salt) == 0 {
+		return shim.Error(FormatError(CodeInvalidArgument, "fingerprint salt cannot be empty"))
+	}
+
+	if err := stub.PutPrivateData(FingerprintCollection, FingerprintSalt, salt); err != nil {
+		return shim.Error(fmt.Errorf("save fingerprint salt error: %w", err).Error())
+	}
+	return shim.Success(nil)
+}
+
+// 获取指纹的盐
+func (broker *Broker) getFingerprintSalt(stub shim.ChaincodeStubInterface) (string, error) {
+	salt, err := stub.GetPrivateData(FingerprintCollection, FingerprintSalt)
+	if err != nil {
+		return "", err
+	}
+	if len(salt) == 0 {
+		return "", codeErrorf(CodeNotInitialized, "fingerprint salt not set")
+	}
+	return string(salt), nil
+}
+
+// 记录跨链消息中出现的发票指纹，未设置盐时不记录；未携带金额的发票无法计算指纹，同样不记录
+func (broker *Broker) recordFingerprints(stub shim.ChaincodeStubInterface, direction string, chainID string, values ...string) error {
+	salt, err := stub.GetPrivateData(FingerprintCollection, FingerprintSalt)
+	if err != nil {
+		return err
+	}
+	if len(salt) == 0 {
+		return nil
+	}
+
+	for _, value := range values {
+		inv, err := ParseInvoice(value)
+		if err != nil || inv.Fphm == "" || inv.Amount == "" {
+			continue
+		}
+		amount, err := ParseAmount(inv.Amount)
+		if err != nil {
+			continue
+		}
+		fp := InvoiceFingerprint(string(salt), inv.Fpdm, inv.Fphm, amount)
+
+		key, err := stub.CreateCompositeKey(fingerprintObjectType, []string{fp, direction, chainID})
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(FingerprintRecord{
+			Fingerprint: fp,
+			Direction:   direction,
+			ChainID:     chainID,
+			TxID:        stub.GetTxID(),
+		})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, v); err != nil {
+			return fmt.Errorf("save fingerprint error: %w", err)
+		}
+	}
+	return nil
+}
+
+// 获取本链关于某个指纹的全部记录
+func (broker *Broker) loadFingerprintRecords(stub shim.ChaincodeStubInterface, fp string) ([]FingerprintRecord, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(fingerprintObjectType, []string{fp})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	records := make([]FingerprintRecord, 0)
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		record := FingerprintRecord{}
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// 查询本链关于某个指纹的记录
+func (broker *Broker) getFingerprintRecords(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	records, err := broker.loadFingerprintRecords(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	v, err := json.Marshal(records)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+/*----------------------------------------------------------*/
+/*                      跨链指纹查询                          */
+/*----------------------------------------------------------*/
+
+// 跨链查询发票指纹是否已被其他链发出或收到，请求中只包含指纹，不包含发票内容
+// args[0] 发票代码，args[1] 发票号码，args[2] 金额
+// args[3] 可选，目的链ID列表；为空时发往所有支持InterchainFingerprintQuery的已注册链
+func (broker *Broker) InterchainFingerprintQuery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+
+	salt, err := broker.getFingerprintSalt(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := ParseAmount(args[2])
+	if err != nil {
+		return shim.Error(FormatError(CodeInvalidArgument, err.Error()))
+	}
+	fp := InvoiceFingerprint(salt, args[0], args[1], amount)
+
+	// 已有链声明过的指纹无需再次查询
+	cached, err := stub.GetState(broker.fingerprintResultKey(fp))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if cached != nil {
+		result := FingerprintQueryResult{}
+		if err := json.Unmarshal(cached, &result); err == nil && result.AnyClaimed() {
+			return shim.Success(cached)
+		}
+	}
+
+	dstChainIDs, err := broker.resolveTargets(stub, args[3:], capabilityFingerprintQuery)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ccRequests := make([]CrossChainRequest, 0, len(dstChainIDs))
+	for _, dstChainID := range dstChainIDs {
+		ccRequests = append(ccRequests, CrossChainRequest{
+			DstChainID: dstChainID,
+			Func:       "InterchainFingerprintQuery",
+			Args:       []string{dstChainID, fp},
+		})
+	}
+	answers, err := broker.fanOutByHttp(stub, ccRequests)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := FingerprintQueryResult{
+		Fingerprint: fp,
+		TxID:        stub.GetTxID(),
+		Claimed:     make(map[string]bool),
+		Missing:     make([]string, 0),
+		Errors:      make(map[string]string),
+	}
+	for _, answer := range answers {
+		claim := FingerprintClaim{}
+		if answer.Err == nil {
+			if err := json.Unmarshal(answer.Data, &claim); err != nil {
+				answer.Err = fmt.Errorf("unmarshal fingerprint claim: %w", err)
+			} else if claim.Fingerprint != fp {
+				answer.Err = fmt.Errorf("fingerprint mismatch in answer")
+			}
+		}
+		if answer.Err != nil {
+			result.Missing = append(result.Missing, answer.DstChainID)
+			result.Errors[answer.DstChainID] = answer.Err.Error()
+			continue
+		}
+		result.Claimed[answer.DstChainID] = claim.Claimed
+	}
+
+	ret, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(broker.fingerprintResultKey(fp), ret); err != nil {
+		return shim.Error(fmt.Errorf("save fingerprint result error: %w", err).Error())
+	}
+	return shim.Success(ret)
+}
+
+// 应答其他链的指纹查询，只返回签名的是否存在记录
+// args[3] PAPP转交的跨链请求ID，写入签名的应答
+func (broker *Broker) interchainFingerprintClaimed(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+	if _, err := broker.checkInbound(stub, args[0], args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+	requestID, err := checkRequestID(args, 3)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fp := args[2]
+	records, err := broker.loadFingerprintRecords(stub, fp)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	v, err := json.Marshal(FingerprintClaim{
+		Fingerprint: fp,
+		ChainID:     args[1],
+		Claimed:     len(records) > 0,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return broker.answer(stub, args, requestID, fp, v)
+}
+
+// 查询保存的跨链指纹查询结果
+func (broker *Broker) getFingerprintResult(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+	v, err := stub.GetState(broker.fingerprintResultKey(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 生成跨链指纹查询结果的key
+func (broker *Broker) fingerprintResultKey(fp string) string {
+	return fmt.Sprintf("fingerprint-result-%s", fp)
+}
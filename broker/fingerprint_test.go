@@ -0,0 +1,54 @@
+package broker_test
+
+import (
+	"testing"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/DXPlus/CrosschainContract/relayer"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+func TestInvoiceFingerprintCoversAmount(t *testing.T) {
+	fp := broker.InvoiceFingerprint("salt", "3100204130", "12345678", 10000)
+	if fp == broker.InvoiceFingerprint("salt", "3100204130", "12345678", 10001) {
+		t.Fatal("fingerprint does not depend on the amount")
+	}
+	if fp == broker.InvoiceFingerprint("other", "3100204130", "12345678", 10000) {
+		t.Fatal("fingerprint does not depend on the salt")
+	}
+}
+
+func TestFingerprintSaltIsPrivate(t *testing.T) {
+	chain, err := relayer.NewMockChain("chainA", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 盐不能作为交易参数传入
+	if resp := chain.Invoke("setFingerprintSalt", "salt"); broker.ErrorCodeOf(resp.Message) != broker.CodeInvalidArgument {
+		t.Fatalf("salt in arguments returned %d %q", resp.Status, resp.Message)
+	}
+
+	chain.Broker.TransientMap = map[string][]byte{"salt": []byte("salt")}
+	resp := chain.Invoke("setFingerprintSalt")
+	chain.Broker.TransientMap = nil
+	if resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	if v := chain.Broker.State[broker.FingerprintSalt]; v != nil {
+		t.Fatalf("salt written to public state: %q", v)
+	}
+	if v := chain.Broker.PvtState[broker.FingerprintCollection][broker.FingerprintSalt]; string(v) != "salt" {
+		t.Fatalf("salt in private data is %q", v)
+	}
+
+	// 记录的指纹包含金额
+	value := `{"fpdm":"3100204130","fphm":"12345678","je":"100.00","zt":"locked"}`
+	if resp := chain.Invoke("InterchainSingleModifyInvoice", "chainB", "k1", value); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	fp := broker.InvoiceFingerprint("salt", "3100204130", "12345678", 10000)
+	if resp := chain.Invoke("getFingerprintRecords", fp); string(resp.Payload) == "[]" {
+		t.Fatal("fingerprint of the sent invoice was not recorded")
+	}
+}
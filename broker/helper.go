@@ -1,18 +1,19 @@
 /*-------------------------------------------*/
 /*            跨链辅助功能 helper.go           */
 /*-------------------------------------------*/
-package main
+package broker
 
 import (
 	"crypto/ecdsa"
-	"crypto/rand"
+	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"math/big"
 
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
 )
 
 // putMap
@@ -47,6 +48,15 @@ func (broker *Broker) getMap(stub shim.ChaincodeStubInterface, metaName string)
 	return meta, nil
 }
 
+// 将字符串参数转换为InvokeChaincode的参数
+func toChaincodeArgs(args ...string) [][]byte {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	return bargs
+}
+
 /*-------------------------------------------*/
 /*                  跨链历史记录模块           */
 /*-------------------------------------------*/
@@ -63,7 +73,7 @@ func (broker *Broker) getOuterMeta(stub shim.ChaincodeStubInterface) pb.Response
 // 查询键值中dstChainID指定目的链，idx指定序号，查询结果为以Broker所在的区块链作为来源链的跨链请求
 func (broker *Broker) getOutMessage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) < 2 {
-		return shim.Error("incorrect number of arguments, expecting 2.")
+		return shim.Error(errArgumentCount + ", expecting 2.")
 	}
 	destChainID := args[0]
 	sequenceNum := args[1]
@@ -87,7 +97,7 @@ func (broker *Broker) getInnerMeta(stub shim.ChaincodeStubInterface) pb.Response
 // 查询键值中dstChainID指定目的链，idx指定序号，查询结果为以Broker所在的区块链作为来源链的跨链请求
 func (broker *Broker) getInMessage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) < 2 {
-		return shim.Error("incorrect number of arguments, expecting 2")
+		return shim.Error(errArgumentCount + ", expecting 2")
 	}
 	sourceChainID := args[0]
 	sequenceNum := args[1]
@@ -99,13 +109,79 @@ func (broker *Broker) getInMessage(stub shim.ChaincodeStubInterface, args []stri
 	return shim.Success(v)
 }
 
+// 获取本链ID
+func (broker *Broker) getLocalChainID(stub shim.ChaincodeStubInterface) (string, error) {
+	v, err := stub.GetState(LocalChainID)
+	if err != nil {
+		return "", err
+	}
+	if len(v) == 0 {
+		return "", codeErrorf(CodeNotInitialized, "local chain ID not initialized")
+	}
+	return string(v), nil
+}
+
+// 查询本链ID
+func (broker *Broker) getLocalChainIDResp(stub shim.ChaincodeStubInterface) pb.Response {
+	localChainID, err := broker.getLocalChainID(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(localChainID))
+}
+
+// 校验入链请求：来源链必须已注册，目的链必须为本链，否则拒绝处理
+func (broker *Broker) checkInbound(stub shim.ChaincodeStubInterface, srcChainID string, dstChainID string) (string, error) {
+	localChainID, err := broker.getLocalChainID(stub)
+	if err != nil {
+		return "", err
+	}
+	if srcChainID == "" {
+		return "", codeErrorf(CodeInvalidArgument, "source chain ID cannot be empty")
+	}
+	if dstChainID != localChainID {
+		return "", codeErrorf(CodeWrongChain, "request addressed to chain %s, local chain is %s", dstChainID, localChainID)
+	}
+	if _, err := broker.lookupChain(stub, srcChainID); err != nil {
+		return "", err
+	}
+	return srcChainID, nil
+}
+
+// 查询多链归集结果
+func (broker *Broker) getMultiQueryResult(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+	v, err := stub.GetState(broker.multiQueryKey(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 生成多链归集结果的key
+func (broker *Broker) multiQueryKey(queryID string) string {
+	return fmt.Sprintf("multi-query-%s", queryID)
+}
+
 // 生成发起请求的key
 func (broker *Broker) outMsgKey(to string, idx string) string {
-	return fmt.Sprintf("out-msg-%s-%s", to, idx)
+	return OutMsgKey(to, idx)
 }
 
 // 生成接受请求的key
 func (broker *Broker) inMsgKey(from string, idx string) string {
+	return InMsgKey(from, idx)
+}
+
+// 发往目的链to的第idx条跨链请求在账本中的key
+func OutMsgKey(to string, idx string) string {
+	return fmt.Sprintf("out-msg-%s-%s", to, idx)
+}
+
+// 来自来源链from的第idx条跨链请求处理结果在账本中的key
+func InMsgKey(from string, idx string) string {
 	return fmt.Sprintf("in-msg-%s-%s", from, idx)
 }
 
@@ -113,27 +189,192 @@ func (broker *Broker) inMsgKey(from string, idx string) string {
 /*            PAPP与跨链合约身份认证模块        */
 /*-------------------------------------------*/
 
-// ECC签名
-func EccSign(privateKey []byte,sourceData []byte) ([]byte, []byte) {
-	ECPrivateKey, err := x509.ParseECPrivateKey(privateKey)
+// 为跨链请求填写来源链ID并签名，签名覆盖包括来源链ID在内的整个请求
+func (broker *Broker) signRequest(stub shim.ChaincodeStubInterface, ccRequest CrossChainRequest) (RequestToPAPP, error) {
+	localChainID, err := broker.getLocalChainID(stub)
 	if err != nil {
-		panic(err)
+		return RequestToPAPP{}, err
+	}
+	ccRequest.SrcChainID = localChainID
+
+	ccRJson, err := json.Marshal(ccRequest)
+	if err != nil {
+		return RequestToPAPP{}, err
+	}
+	signR, signS, err := broker.signPayload(stub, ccRJson)
+	if err != nil {
+		return RequestToPAPP{}, err
 	}
-	hashText := sha1.Sum(sourceData)
 
-	r, s, err := ecdsa.Sign(rand.Reader, ECPrivateKey, hashText[:])
+	return RequestToPAPP{
+		CCRequest: ccRequest,
+		SigR:      signR,
+		SigS:      signS,
+	}, nil
+}
+
+// 使用本链私钥对数据签名
+func (broker *Broker) signPayload(stub shim.ChaincodeStubInterface, payload []byte) ([]byte, []byte, error) {
+	// 获取本链的私钥
+	privateKeyText, err := stub.GetState(PrivateKey)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+	if _, err := x509.ParseECPrivateKey(privateKeyText); err != nil {
+		return nil, nil, fmt.Errorf("invalid private key: %w", err)
 	}
-	rText, err := r.MarshalText()
+
+	// 签名是确定性的，各背书节点对同一数据生成相同的签名，写入账本和事件时读写集一致
+	return SignPayload(privateKeyText, payload)
+}
+
+// 使用DER编码的私钥对数据签名，与VerifyPayload对应
+func SignPayload(privateKey []byte, payload []byte) ([]byte, []byte, error) {
+	Sha1Inst := sha1.New()
+	Sha1Inst.Write(payload)
+	sourceData := Sha1Inst.Sum([]byte(""))
+	return EccSign(privateKey, sourceData)
+}
+
+// ECC签名，随机数k按RFC 6979由私钥与数据确定性地生成，同一私钥对同一数据的签名总是相同
+func EccSign(privateKey []byte, sourceData []byte) ([]byte, []byte, error) {
+	ECPrivateKey, err := x509.ParseECPrivateKey(privateKey)
 	if err != nil {
-		panic(err)
+		return nil, nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	hashText := sha1.Sum(sourceData)
+
+	curve := ECPrivateKey.Curve
+	n := curve.Params().N
+	e := bitsToInt(hashText[:], n.BitLen())
+	nonces := newNonceGenerator(ECPrivateKey.D, hashText[:], n)
+	for {
+		k := nonces.next()
+		x, _ := curve.ScalarBaseMult(k.FillBytes(make([]byte, (n.BitLen()+7)/8)))
+		r := new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			continue
+		}
+		// s = k^-1 * (e + r * d) mod n
+		s := new(big.Int).Mul(r, ECPrivateKey.D)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(k, n))
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+
+		rText, err := r.MarshalText()
+		if err != nil {
+			return nil, nil, err
+		}
+		sText, err := s.MarshalText()
+		if err != nil {
+			return nil, nil, err
+		}
+		return rText, sText, nil
+	}
+}
+
+// RFC 6979 3.2中以HMAC-SHA1生成签名随机数k的过程
+type nonceGenerator struct {
+	n    *big.Int
+	k, v []byte
+}
+
+func newNonceGenerator(d *big.Int, hash []byte, n *big.Int) *nonceGenerator {
+	g := &nonceGenerator{n: n, k: make([]byte, sha1.Size), v: make([]byte, sha1.Size)}
+	for i := range g.v {
+		g.v[i] = 0x01
+	}
+	size := (n.BitLen() + 7) / 8
+	x := d.FillBytes(make([]byte, size))
+	h := new(big.Int).Mod(bitsToInt(hash, n.BitLen()), n).FillBytes(make([]byte, size))
+	for _, sep := range []byte{0x00, 0x01} {
+		g.k = g.mac(g.v, []byte{sep}, x, h)
+		g.v = g.mac(g.v)
+	}
+	return g
+}
+
+func (g *nonceGenerator) mac(data ...[]byte) []byte {
+	m := hmac.New(sha1.New, g.k)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
+
+// 生成下一个候选k，1 <= k < n；上一个k不可用时继续调用
+func (g *nonceGenerator) next() *big.Int {
+	size := (g.n.BitLen() + 7) / 8
+	for {
+		t := make([]byte, 0, size+sha1.Size)
+		for len(t) < size {
+			g.v = g.mac(g.v)
+			t = append(t, g.v...)
+		}
+		k := bitsToInt(t, g.n.BitLen())
+		g.k = g.mac(g.v, []byte{0x00})
+		g.v = g.mac(g.v)
+		if k.Sign() > 0 && k.Cmp(g.n) < 0 {
+			return k
+		}
 	}
-	sText, err := s.MarshalText()
+}
+
+// 取数据最左侧的bits位作为整数，与ecdsa对哈希的截断方式一致
+func bitsToInt(b []byte, bits int) *big.Int {
+	size := (bits + 7) / 8
+	if len(b) > size {
+		b = b[:size]
+	}
+	v := new(big.Int).SetBytes(b)
+	if excess := len(b)*8 - bits; excess > 0 {
+		v.Rsh(v, uint(excess))
+	}
+	return v
+}
+
+// ECC验签，与EccSign对应，publicKey为PKIX DER编码的公钥
+func EccVerify(publicKey []byte, sourceData []byte, rText []byte, sText []byte) bool {
+	pub, err := x509.ParsePKIXPublicKey(publicKey)
 	if err != nil {
-		panic(err)
+		return false
+	}
+	ECPublicKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return false
 	}
-	return rText, sText
+	var r, s big.Int
+	if err := r.UnmarshalText(rText); err != nil {
+		return false
+	}
+	if err := s.UnmarshalText(sText); err != nil {
+		return false
+	}
+	hashText := sha1.Sum(sourceData)
+	return ecdsa.Verify(ECPublicKey, hashText[:], &r, &s)
 }
 
+// 使用来源链公钥校验跨链请求的签名，签名覆盖包括来源链ID与序号在内的整个请求
+func VerifyRequest(publicKey []byte, req RequestToPAPP) error {
+	ccRJson, err := json.Marshal(req.CCRequest)
+	if err != nil {
+		return err
+	}
+	if err := VerifyPayload(publicKey, ccRJson, req.SigR, req.SigS); err != nil {
+		return fmt.Errorf("invalid signature on request %d from chain %s to chain %s",
+			req.CCRequest.Index, req.CCRequest.SrcChainID, req.CCRequest.DstChainID)
+	}
+	return nil
+}
 
+// 使用公钥校验signPayload生成的签名
+func VerifyPayload(publicKey []byte, payload []byte, rText []byte, sText []byte) error {
+	sourceData := sha1.Sum(payload)
+	if !EccVerify(publicKey, sourceData[:], rText, sText) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"math/big"
+	"testing"
+)
+
+// RFC 6979 A.2.5，P-256与SHA-1，消息"sample"
+func TestEccSignDeterministic(t *testing.T) {
+	d, _ := new(big.Int).SetString("C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721", 16)
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(d.Bytes())
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, s, err := EccSign(der, []byte("sample"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantR, _ := new(big.Int).SetString("61340C88C3AAEBEB4F6D667F672CA9759A6CCAA9FA8811313039EE4A35471D32", 16)
+	wantS, _ := new(big.Int).SetString("6D7F147DAC089441BB2E2FE8F7A3FA264B9C475098FDCF6E00D7C996E1B8B7EB", 16)
+	if string(r) != wantR.String() || string(s) != wantS.String() {
+		t.Fatalf("signature (%s, %s) does not match the RFC 6979 vector", r, s)
+	}
+
+	r2, s2, err := EccSign(der, []byte("sample"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r, r2) || !bytes.Equal(s, s2) {
+		t.Fatal("signatures of the same data differ")
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !EccVerify(pub, []byte("sample"), r, s) {
+		t.Fatal("signature does not verify")
+	}
+}
+
+func TestEccSignInvalidKey(t *testing.T) {
+	if _, _, err := EccSign([]byte("not a key"), []byte("sample")); err == nil {
+		t.Fatal("expecting an error for an invalid private key")
+	}
+}
@@ -0,0 +1,270 @@
+/*-------------------------------------------*/
+/*            发票数据模块 invoice.go          */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 发票状态
+const (
+	InvoiceIssued      = "issued"       // 已开具
+	InvoiceLocked      = "locked"       // 报销锁定中
+	InvoiceReimbursed  = "reimbursed"   // 已报销
+	InvoiceVoid        = "void"         // 已作废
+	InvoiceRedReversed = "red-reversed" // 已冲红
+)
+
+var (
+	digitsPattern = regexp.MustCompile(`^[0-9]+$`)
+	taxIDPattern  = regexp.MustCompile(`^[0-9A-Z]{15,20}$`)
+	amountPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]{1,2})?$`)
+)
+
+// 发票
+type Invoice struct {
+	Fphm        string `json:"fphm"`             //发票号码
+	Fpdm        string `json:"fpdm,omitempty"`   //发票代码，全电发票没有发票代码
+	Jym         string `json:"jym,omitempty"`    //校验码
+	BuyerTaxID  string `json:"gmfsbh,omitempty"` //购买方纳税人识别号
+	SellerTaxID string `json:"xsfsbh,omitempty"` //销售方纳税人识别号
+	Amount      string `json:"je,omitempty"`     //金额（不含税），单位元，最多两位小数
+	Tax         string `json:"se,omitempty"`     //税额，单位元，最多两位小数
+	IssueDate   string `json:"kprq,omitempty"`   //开票日期，YYYY-MM-DD
+	Status      string `json:"zt,omitempty"`     //发票状态
+}
+
+// 旧版字符串中的字段名与发票字段的对应关系
+var legacyInvoiceFields = map[string]func(*Invoice) *string{
+	"fphm":   func(inv *Invoice) *string { return &inv.Fphm },
+	"fpdm":   func(inv *Invoice) *string { return &inv.Fpdm },
+	"jym":    func(inv *Invoice) *string { return &inv.Jym },
+	"gmfsbh": func(inv *Invoice) *string { return &inv.BuyerTaxID },
+	"xsfsbh": func(inv *Invoice) *string { return &inv.SellerTaxID },
+	"je":     func(inv *Invoice) *string { return &inv.Amount },
+	"se":     func(inv *Invoice) *string { return &inv.Tax },
+	"kprq":   func(inv *Invoice) *string { return &inv.IssueDate },
+	"zt":     func(inv *Invoice) *string { return &inv.Status },
+}
+
+// 判断value是否按发票格式书写：JSON对象或旧版"value-[...]"格式，其他value视为普通数据
+func isInvoiceText(text string) bool {
+	text = strings.TrimSpace(text)
+	return strings.HasPrefix(text, "{") || strings.HasPrefix(strings.TrimPrefix(text, "value-"), "[")
+}
+
+// 解析发票，支持JSON格式和旧版"value-[fphm:12345678,fpdm:3100204130,jym:666666,zt:locked]"格式
+func ParseInvoice(text string) (Invoice, error) {
+	text = strings.TrimSpace(text)
+	inv := Invoice{}
+
+	if strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal([]byte(text), &inv); err != nil {
+			return Invoice{}, codeErrorf(CodeInvalidArgument, "unmarshal invoice: %w", err)
+		}
+		return inv, nil
+	}
+
+	body := strings.TrimPrefix(text, "value-")
+	if !strings.HasPrefix(body, "[") || !strings.HasSuffix(body, "]") {
+		return Invoice{}, codeErrorf(CodeInvalidArgument, "invalid invoice: %s", text)
+	}
+	body = strings.TrimSuffix(strings.TrimPrefix(body, "["), "]")
+	for _, pair := range strings.Split(body, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			return Invoice{}, codeErrorf(CodeInvalidArgument, "invalid invoice field: %s", pair)
+		}
+		field, ok := legacyInvoiceFields[strings.TrimSpace(kv[0])]
+		if !ok {
+			return Invoice{}, codeErrorf(CodeInvalidArgument, "unknown invoice field: %s", kv[0])
+		}
+		*field(&inv) = strings.TrimSpace(kv[1])
+	}
+	return inv, nil
+}
+
+// 校验发票字段
+func (inv Invoice) Validate() error {
+	// 发票号码：8位，全电发票为20位
+	if !digitsPattern.MatchString(inv.Fphm) || (len(inv.Fphm) != 8 && len(inv.Fphm) != 20) {
+		return codeErrorf(CodeInvalidArgument, "invalid fphm %q: expecting 8 or 20 digits", inv.Fphm)
+	}
+	// 发票代码：10位或12位，全电发票可为空
+	if inv.Fpdm == "" {
+		if len(inv.Fphm) != 20 {
+			return codeErrorf(CodeInvalidArgument, "fpdm is required for invoice %s", inv.Fphm)
+		}
+	} else if !digitsPattern.MatchString(inv.Fpdm) || (len(inv.Fpdm) != 10 && len(inv.Fpdm) != 12) {
+		return codeErrorf(CodeInvalidArgument, "invalid fpdm %q: expecting 10 or 12 digits", inv.Fpdm)
+	}
+	// 校验码：完整20位或后6位
+	if inv.Jym != "" && (!digitsPattern.MatchString(inv.Jym) || (len(inv.Jym) != 6 && len(inv.Jym) != 20)) {
+		return codeErrorf(CodeInvalidArgument, "invalid jym %q: expecting 6 or 20 digits", inv.Jym)
+	}
+	if inv.BuyerTaxID != "" && !taxIDPattern.MatchString(inv.BuyerTaxID) {
+		return codeErrorf(CodeInvalidArgument, "invalid gmfsbh %q", inv.BuyerTaxID)
+	}
+	if inv.SellerTaxID != "" && !taxIDPattern.MatchString(inv.SellerTaxID) {
+		return codeErrorf(CodeInvalidArgument, "invalid xsfsbh %q", inv.SellerTaxID)
+	}
+	if inv.Amount != "" {
+		if _, err := ParseAmount(inv.Amount); err != nil {
+			return codeErrorf(CodeInvalidArgument, "invalid je: %w", err)
+		}
+	}
+	if inv.Tax != "" {
+		if _, err := ParseAmount(inv.Tax); err != nil {
+			return codeErrorf(CodeInvalidArgument, "invalid se: %w", err)
+		}
+	}
+	if inv.IssueDate != "" {
+		if _, err := time.Parse("2006-01-02", inv.IssueDate); err != nil {
+			return codeErrorf(CodeInvalidArgument, "invalid kprq %q: expecting YYYY-MM-DD", inv.IssueDate)
+		}
+	}
+	switch inv.Status {
+	case "", InvoiceIssued, InvoiceLocked, InvoiceReimbursed, InvoiceVoid, InvoiceRedReversed:
+	default:
+		return codeErrorf(CodeInvalidArgument, "invalid zt %q", inv.Status)
+	}
+	return nil
+}
+
+// 发票在各条链上的唯一标识：发票代码+发票号码
+func (inv Invoice) ID() string {
+	return inv.Fpdm + inv.Fphm
+}
+
+// 将金额字符串解析为以分为单位的整数，避免浮点误差；红字发票金额可以为负
+func ParseAmount(amount string) (int64, error) {
+	if !amountPattern.MatchString(amount) {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+
+	negative := strings.HasPrefix(amount, "-")
+	parts := strings.SplitN(strings.TrimPrefix(amount, "-"), ".", 2)
+	yuan, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %w", amount, err)
+	}
+	fen := int64(0)
+	if len(parts) == 2 {
+		cents := parts[1]
+		if len(cents) == 1 {
+			cents += "0"
+		}
+		fen, _ = strconv.ParseInt(cents, 10, 64)
+	}
+
+	// 换算成分后不能超出int64
+	if yuan > (math.MaxInt64-fen)/100 {
+		return 0, fmt.Errorf("amount %q out of range", amount)
+	}
+	total := yuan*100 + fen
+	if negative {
+		total = -total
+	}
+	return total, nil
+}
+
+// 将以分为单位的金额格式化为元
+func FormatAmount(fen int64) string {
+	sign := ""
+	if fen < 0 {
+		sign = "-"
+		fen = -fen
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, fen/100, fen%100)
+}
+
+// 解析并校验发票，返回规范化的JSON
+func normalizeInvoice(text string) (Invoice, string, error) {
+	inv, err := ParseInvoice(text)
+	if err != nil {
+		return Invoice{}, "", err
+	}
+	if err := inv.Validate(); err != nil {
+		return Invoice{}, "", err
+	}
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return Invoice{}, "", err
+	}
+	return inv, string(data), nil
+}
+
+/*----------------------------------------------------------*/
+/*                   业务链调用-发票接口实现                    */
+/*----------------------------------------------------------*/
+
+// 跨链单链发票报销，发票经校验后以规范化的JSON发往目的链
+func (broker *Broker) InterchainSingleModifyInvoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+
+	dstChainID := args[0]
+	key := args[1]
+	_, value, err := normalizeInvoice(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := broker.trackInvoices(stub, dstChainID, value); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ccRequest := CrossChainRequest{
+		DstChainID: dstChainID,
+		Func:       "InterchainSingleModifyInvoice",
+		Args:       []string{dstChainID, key, value},
+	}
+
+	return broker.invoke(stub, ccRequest, InvokeOptions{Mode: InvokeModeAsync})
+}
+
+// 跨链双链发票报销
+func (broker *Broker) InterchainDoubleModifyInvoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 5 {
+		return shim.Error(errArgumentCount + ", expecting 5")
+	}
+
+	dstChainID := args[0]
+	key1 := args[1]
+	_, value1, err := normalizeInvoice(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key2 := args[3]
+	_, value2, err := normalizeInvoice(args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := broker.checkNotInFlight(stub, key1); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := broker.trackInvoices(stub, dstChainID, value1, value2); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ccRequest := CrossChainRequest{
+		DstChainID: dstChainID,
+		Func:       "InterchainDoubleModifyInvoice",
+		Args:       []string{dstChainID, key1, value1, key2, value2},
+	}
+
+	return broker.invoke(stub, ccRequest, InvokeOptions{Mode: InvokeModeAsync})
+}
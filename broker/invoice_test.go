@@ -0,0 +1,35 @@
+package broker
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	cases := []struct {
+		amount string
+		fen    int64
+	}{
+		{"0", 0},
+		{"12.5", 1250},
+		{"-3.07", -307},
+		{"92233720368547758.07", math.MaxInt64},
+		{"-92233720368547758.07", -math.MaxInt64},
+	}
+	for _, c := range cases {
+		fen, err := ParseAmount(c.amount)
+		if err != nil {
+			t.Errorf("%q: %v", c.amount, err)
+		} else if fen != c.fen {
+			t.Errorf("%q: got %d, expecting %d", c.amount, fen, c.fen)
+		}
+	}
+}
+
+func TestParseAmountOutOfRange(t *testing.T) {
+	for _, amount := range []string{"92233720368547758.08", "92233720368547759", "-92233720368547758.08", "99999999999999999999"} {
+		if fen, err := ParseAmount(amount); err == nil {
+			t.Errorf("%q parsed as %d, expecting an error", amount, fen)
+		}
+	}
+}
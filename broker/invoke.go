@@ -0,0 +1,464 @@
+/*-------------------------------------------*/
+/*            通用跨链调用模块 invoke.go       */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	Services = "registered-services"
+
+	InvokeModeSync  = "sync"  // 通过Http同步返回结果
+	InvokeModeAsync = "async" // 通过事件发出，结果经回调返回
+
+	callbackStatusOK      = "ok"
+	callbackStatusFailed  = "failed"
+	callbackStatusTimeout = "timeout"
+)
+
+// 跨链调用选项
+type InvokeOptions struct {
+	Mode     string `json:"mode,omitempty"`     //sync或async，默认async
+	Callback string `json:"callback,omitempty"` //异步调用时接收结果的本链业务合约函数
+	Timeout  int64  `json:"timeout,omitempty"`  //超时时间，单位秒，0表示不超时
+}
+
+// 可被跨链调用的合约
+type ServiceInfo struct {
+	Channel   string   `json:"channel,omitempty"` //合约所在通道，为空时与跨链合约相同
+	Functions []string `json:"functions"`         //允许其他链调用的函数
+}
+
+// 异步调用的回调记录
+type CallbackRecord struct {
+	DstChainID string `json:"dstChainID"`       //执行调用的链
+	Index      uint64 `json:"index"`            //跨链请求序号
+	Status     string `json:"status"`           //ok、failed、timeout
+	Result     string `json:"result,omitempty"` //目的链返回的数据或失败原因
+	TxID       string `json:"txID"`             //执行回调的交易ID
+}
+
+// 通用跨链调用
+// args[0] 目的链ID
+// args[1] 目的链上的合约名，为空时调用目的链的默认业务合约
+// args[2] 调用的函数名
+// args[3] 函数参数列表，如`["a","b"]`
+// args[4] 可选，调用选项，如`{"mode":"async","callback":"onResult","timeout":600}`
+func (broker *Broker) InterchainInvoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 4 {
+		return shim.Error(errArgumentCount + ", expecting 4")
+	}
+
+	funcArgs := make([]string, 0)
+	if err := json.Unmarshal([]byte(args[3]), &funcArgs); err != nil {
+		return shim.Error(codeErrorf(CodeInvalidArgument, "unmarshal invoke args: %w", err).Error())
+	}
+	opts := InvokeOptions{}
+	if len(args) > 4 && args[4] != "" {
+		if err := json.Unmarshal([]byte(args[4]), &opts); err != nil {
+			return shim.Error(codeErrorf(CodeInvalidArgument, "unmarshal invoke options: %w", err).Error())
+		}
+	}
+	if args[2] == "" {
+		return shim.Error(FormatError(CodeInvalidArgument, "function name cannot be empty"))
+	}
+
+	ccRequest := CrossChainRequest{
+		DstChainID: args[0],
+		DstService: args[1],
+		Func:       args[2],
+		Args:       funcArgs,
+	}
+	return broker.invoke(stub, ccRequest, opts)
+}
+
+// 按调用选项发出跨链请求，各业务场景的跨链接口均通过此函数发出请求
+func (broker *Broker) invoke(stub shim.ChaincodeStubInterface, ccRequest CrossChainRequest, opts InvokeOptions) pb.Response {
+	if ccRequest.DstChainID == "" {
+		return shim.Error(FormatError(CodeInvalidArgument, "destination chain ID cannot be empty"))
+	}
+	if opts.Mode == "" {
+		opts.Mode = InvokeModeAsync
+	}
+	if opts.Timeout < 0 {
+		return shim.Error(FormatError(CodeInvalidArgument, "timeout cannot be negative"))
+	}
+
+	if opts.Timeout > 0 {
+		ts, err := stub.GetTxTimestamp()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		ccRequest.Deadline = ts.GetSeconds() + opts.Timeout
+	}
+
+	switch opts.Mode {
+	case InvokeModeSync:
+		if opts.Callback != "" {
+			return shim.Error("callback is only supported in async mode")
+		}
+		return broker.InterchainRequestByHttp(stub, ccRequest)
+	case InvokeModeAsync:
+		ccRequest.Callback = opts.Callback
+		return broker.InterchainRequestBySetEvent(stub, ccRequest)
+	default:
+		return shim.Error(FormatError(CodeInvalidArgument, "invalid invoke mode: "+opts.Mode))
+	}
+}
+
+// 目的链执行通用跨链调用，返回签名的执行结果；执行失败时返回签名的失败应答
+// args[0] 来源链ID，args[1] 目的链ID，args[2] 跨链请求ID，args[3] 截止时间，0表示不超时，
+// args[4] 合约名，args[5] 函数名，args[6:] 函数参数
+func (broker *Broker) interchainInvoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 6 {
+		return shim.Error(errArgumentCount + ", expecting at least 6")
+	}
+	if _, err := broker.checkInbound(stub, args[0], args[1]); err != nil {
+		return shim.Error(err.Error())
+	}
+	requestID, err := checkRequestID(args, 2)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	function := args[5]
+
+	// 超过截止时间到达的请求不再执行，来源链按超时处理
+	deadline, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return shim.Error(FormatError(CodeInvalidArgument, "invalid deadline: "+args[3]))
+	}
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if deadline > 0 && ts.GetSeconds() > deadline {
+		return broker.failedAnswer(stub, args, requestID, function, fmt.Sprintf("request %s expired at %d", requestID, deadline))
+	}
+
+	// 只能调用登记时列出的函数，防止绕过发票状态、转移锁定等检查直接调用业务合约
+	service, channel, err := broker.resolveService(stub, args[4], function)
+	if err != nil {
+		return broker.failedAnswer(stub, args, requestID, function, err.Error())
+	}
+
+	b := toChaincodeArgs(args[5:]...)
+	response := broker.invokeService(stub, service, b, channel)
+	if response.Status != shim.OK {
+		return broker.failedAnswer(stub, args, requestID, function, chaincodeError(service, response.Message).Error())
+	}
+
+	return broker.answer(stub, args, requestID, function, response.Payload)
+}
+
+// 来源链收到异步调用的结果，校验目的链的签名后调用发起方指定的回调函数
+// args[0] 来源链ID，即执行调用的链，args[1] 目的链ID，即本链，args[2] 请求序号，args[3] ok或failed，
+// args[4] 目的链interchainInvoke返回的签名应答，执行失败时为其错误信息
+func (broker *Broker) interchainCallback(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 5 {
+		return shim.Error(errArgumentCount + ", expecting 5")
+	}
+	srcChainID, err := broker.checkInbound(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	status := args[3]
+	if status != callbackStatusOK && status != callbackStatusFailed {
+		return shim.Error(FormatError(CodeInvalidArgument, "invalid callback status: "+status))
+	}
+
+	ccRequest, err := broker.outRequest(stub, srcChainID, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	answer, err := broker.verifySignedAnswer(stub, ccRequest, []byte(args[4]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if (answer.Status == answerStatusFailed) != (status == callbackStatusFailed) {
+		return shim.Error(fmt.Sprintf("callback status %s does not match the signed answer", status))
+	}
+
+	return broker.fireCallback(stub, srcChainID, args[2], status, string(answer.Value))
+}
+
+// 异步调用超时后触发超时回调，只有发起调用的身份或管理员组织可以在超时后调用
+// args[0] 目的链ID，args[1] 请求序号
+func (broker *Broker) expireInvoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+
+	requester, err := stub.GetState(broker.requesterKey(args[0], args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := creatorID(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != string(requester) {
+		if err := broker.checkAdmin(stub); err != nil {
+			return shim.Error(FormatError(CodeAccessDenied, fmt.Sprintf("only the requester or the admin MSP can expire request %s to chain %s", args[1], args[0])))
+		}
+	}
+
+	return broker.fireCallback(stub, args[0], args[1], callbackStatusTimeout, "")
+}
+
+// 记录发起异步调用的身份，超时回调只能由其触发
+func (broker *Broker) recordRequester(stub shim.ChaincodeStubInterface, ccRequest CrossChainRequest) error {
+	if ccRequest.Callback == "" {
+		return nil
+	}
+	requester, err := creatorID(stub)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(broker.requesterKey(ccRequest.DstChainID, strconv.FormatUint(ccRequest.Index, 10)), []byte(requester))
+}
+
+// 调用者身份：MSP ID与证书ID
+func creatorID(stub shim.ChaincodeStubInterface) (string, error) {
+	id, err := cid.New(stub)
+	if err != nil {
+		return "", fmt.Errorf("get creator identity error: %w", err)
+	}
+	mspID, err := id.GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("get creator identity error: %w", err)
+	}
+	certID, err := id.GetID()
+	if err != nil {
+		return "", fmt.Errorf("get creator identity error: %w", err)
+	}
+	return mspID + "/" + certID, nil
+}
+
+// 执行回调：每个请求只回调一次，超过截止时间到达的结果按超时处理
+func (broker *Broker) fireCallback(stub shim.ChaincodeStubInterface, dstChainID string, idx string, status string, result string) pb.Response {
+	index, err := strconv.ParseUint(idx, 10, 64)
+	if err != nil {
+		return shim.Error(FormatError(CodeInvalidArgument, "invalid index: "+idx))
+	}
+
+	ccRequest, err := broker.outRequest(stub, dstChainID, idx)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if ccRequest.Callback == "" {
+		return shim.Error(fmt.Sprintf("request %s to chain %s has no callback", idx, dstChainID))
+	}
+
+	done, err := stub.GetState(broker.callbackKey(dstChainID, idx))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if done != nil {
+		return shim.Error(FormatError(CodeDuplicate, fmt.Sprintf("request %s to chain %s already called back", idx, dstChainID)))
+	}
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	expired := ccRequest.Deadline > 0 && ts.GetSeconds() > ccRequest.Deadline
+	if status == callbackStatusTimeout && !expired {
+		return shim.Error(fmt.Sprintf("request %s to chain %s has not timed out", idx, dstChainID))
+	}
+	if expired {
+		status = callbackStatusTimeout
+		result = ""
+	}
+
+	b := toChaincodeArgs(ccRequest.Callback, dstChainID, idx, status, result)
+	response := broker.invokeBusiness(stub, b)
+	if response.Status != shim.OK {
+		return shim.Error(chaincodeError(broker.config.ChaincodeID, response.Message).Error())
+	}
+
+	v, err := json.Marshal(CallbackRecord{
+		DstChainID: dstChainID,
+		Index:      index,
+		Status:     status,
+		Result:     result,
+		TxID:       stub.GetTxID(),
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(broker.callbackKey(dstChainID, idx), v); err != nil {
+		return shim.Error(fmt.Errorf("save callback record error: %w", err).Error())
+	}
+	return shim.Success(v)
+}
+
+// 读取本链发往目的链的跨链请求
+func (broker *Broker) outRequest(stub shim.ChaincodeStubInterface, dstChainID string, idx string) (CrossChainRequest, error) {
+	eb, err := stub.GetState(broker.outMsgKey(dstChainID, idx))
+	if err != nil {
+		return CrossChainRequest{}, err
+	}
+	if eb == nil {
+		return CrossChainRequest{}, fmt.Errorf("no request %s to chain %s", idx, dstChainID)
+	}
+	ccRequest := CrossChainRequest{}
+	if err := json.Unmarshal(eb, &ccRequest); err != nil {
+		return CrossChainRequest{}, err
+	}
+	return ccRequest, nil
+}
+
+// 查询异步调用的回调记录
+func (broker *Broker) getCallback(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+	v, err := stub.GetState(broker.callbackKey(args[0], args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+/*----------------------------------------------------------*/
+/*                   可被跨链调用的合约管理                     */
+/*----------------------------------------------------------*/
+
+// 允许其他链通过interchainInvoke调用的本链合约及函数，默认业务合约同样需要登记
+// args[0] 合约名，args[1] 合约所在通道，为空时与跨链合约相同，args[2] 允许调用的函数列表，如`["audit"]`
+func (broker *Broker) registerService(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+	if args[0] == "" {
+		return shim.Error(FormatError(CodeInvalidArgument, "service name cannot be empty"))
+	}
+	functions := make([]string, 0)
+	if err := json.Unmarshal([]byte(args[2]), &functions); err != nil {
+		return shim.Error(codeErrorf(CodeInvalidArgument, "unmarshal service functions: %w", err).Error())
+	}
+	if len(functions) == 0 {
+		return shim.Error(FormatError(CodeInvalidArgument, "service functions cannot be empty"))
+	}
+	for _, function := range functions {
+		if function == "" {
+			return shim.Error(FormatError(CodeInvalidArgument, "function name cannot be empty"))
+		}
+	}
+
+	services, err := broker.getServices(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	services[args[0]] = ServiceInfo{Channel: args[1], Functions: functions}
+	if err := broker.putServices(stub, services); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 取消合约的跨链调用权限
+func (broker *Broker) removeService(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	services, err := broker.getServices(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, ok := services[args[0]]; !ok {
+		return shim.Error(FormatError(CodeNotRegistered, "service not registered: "+args[0]))
+	}
+	delete(services, args[0])
+	if err := broker.putServices(stub, services); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 查询可被跨链调用的合约，{合约名：{channel, functions}}
+func (broker *Broker) listServices(stub shim.ChaincodeStubInterface) pb.Response {
+	v, err := stub.GetState(Services)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 确定跨链调用的目标合约与通道，未指定合约时使用默认业务合约；函数须在登记的函数列表中
+func (broker *Broker) resolveService(stub shim.ChaincodeStubInterface, service string, function string) (string, string, error) {
+	if service == "" {
+		service = broker.config.ChaincodeID
+	}
+
+	services, err := broker.getServices(stub)
+	if err != nil {
+		return "", "", err
+	}
+	info, ok := services[service]
+	if !ok {
+		return "", "", codeErrorf(CodeNotRegistered, "service not registered: %s", service)
+	}
+	callable := false
+	for _, f := range info.Functions {
+		if f == function {
+			callable = true
+			break
+		}
+	}
+	if !callable {
+		return "", "", codeErrorf(CodeAccessDenied, "function %s of service %s is not callable across chains", function, service)
+	}
+
+	channel := info.Channel
+	if channel == "" {
+		channel = broker.config.ChannelID
+	}
+	return service, channel, nil
+}
+
+// getServices
+func (broker *Broker) getServices(stub shim.ChaincodeStubInterface) (map[string]ServiceInfo, error) {
+	v, err := stub.GetState(Services)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]ServiceInfo)
+	if v == nil {
+		return services, nil
+	}
+	if err := json.Unmarshal(v, &services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+// putServices
+func (broker *Broker) putServices(stub shim.ChaincodeStubInterface, services map[string]ServiceInfo) error {
+	v, err := json.Marshal(services)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(Services, v)
+}
+
+// 生成回调记录的key
+func (broker *Broker) callbackKey(to string, idx string) string {
+	return fmt.Sprintf("callback-%s-%s", to, idx)
+}
+
+// 生成异步调用发起身份的key
+func (broker *Broker) requesterKey(to string, idx string) string {
+	return fmt.Sprintf("invoke-requester-%s-%s", to, idx)
+}
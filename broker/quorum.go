@@ -0,0 +1,408 @@
+/*-------------------------------------------*/
+/*            多中继共识投递 quorum.go         */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 等待其他中继确认的消息状态
+const deliverStatusPending = "pending"
+
+// 来源链的中继集合，登记后该链的入链消息须由Threshold个中继提交相同内容才执行
+type RelayerQuorum struct {
+	Relayers  []string `json:"relayers"`  //中继身份，见getRelayerID
+	Threshold int      `json:"threshold"` //执行所需的相同提交数
+}
+
+// 同一内容的提交
+type Submission struct {
+	Message  CrossChainRequest `json:"message"`
+	Relayers []string          `json:"relayers"` //提交该内容的中继
+}
+
+// 等待达到法定数量的入链消息，保存在pending-msg-<来源链ID>-<序号>下
+type PendingMessage struct {
+	SrcChainID  string                `json:"srcChainID"`
+	Index       uint64                `json:"index"`
+	Votes       map[string]string     `json:"votes"`       //各中继首次提交的消息哈希，只有首次提交计票
+	Submissions map[string]Submission `json:"submissions"` //消息哈希对应的提交
+}
+
+// 本次交易读写过的等待记录，Fabric在交易中读不到本交易写入的状态
+type pendingCache map[string]*PendingMessage
+
+// 同一序号出现不同内容时记录的证据，保存在relay-evidence-<来源链ID>-<序号>下
+type RelayEvidence struct {
+	SrcChainID  string                `json:"srcChainID"`
+	Index       uint64                `json:"index"`
+	Submissions map[string]Submission `json:"submissions"`
+	TxID        string                `json:"txID"` //最近一次发现冲突的交易
+}
+
+// 校验中继集合
+func (q *RelayerQuorum) Validate() error {
+	seen := make(map[string]bool, len(q.Relayers))
+	for _, r := range q.Relayers {
+		if r == "" || seen[r] {
+			return fmt.Errorf("empty or duplicate relayer %q", r)
+		}
+		seen[r] = true
+	}
+	if q.Threshold < 1 || q.Threshold > len(q.Relayers) {
+		return fmt.Errorf("invalid threshold %d, expecting 1-%d", q.Threshold, len(q.Relayers))
+	}
+	return nil
+}
+
+// 判断是否为集合中的中继
+func (q *RelayerQuorum) member(relayer string) bool {
+	for _, r := range q.Relayers {
+		if r == relayer {
+			return true
+		}
+	}
+	return false
+}
+
+// 当前中继集合中首次提交该哈希的中继数
+func (q *RelayerQuorum) count(pending PendingMessage, hash string) int {
+	n := 0
+	for relayer, h := range pending.Votes {
+		if h == hash && q.member(relayer) {
+			n++
+		}
+	}
+	return n
+}
+
+// 调用者的中继身份：MSP ID与证书sha256的十六进制，以冒号分隔
+func relayerID(stub shim.ChaincodeStubInterface) (string, error) {
+	id, err := cid.New(stub)
+	if err != nil {
+		return "", err
+	}
+	mspID, err := id.GetMSPID()
+	if err != nil {
+		return "", err
+	}
+	cert, err := id.GetX509Certificate()
+	if err != nil {
+		return "", err
+	}
+	if cert == nil {
+		return "", fmt.Errorf("creator has no certificate")
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	return mspID + ":" + hex.EncodeToString(fingerprint[:]), nil
+}
+
+// 查询调用者的中继身份，用于setRelayers
+func (broker *Broker) getRelayerID(stub shim.ChaincodeStubInterface) pb.Response {
+	id, err := relayerID(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(id))
+}
+
+// 设置来源链的中继集合
+// args[0] 来源链ID，须已注册，args[1] 中继集合，如`{"relayers":["Org1MSP:3f5a...","Org2MSP:9c1d..."],"threshold":2}`，relayers为空时删除
+func (broker *Broker) setRelayers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+
+	quorum := &RelayerQuorum{}
+	if err := json.Unmarshal([]byte(args[1]), quorum); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal relayers: %w", err).Error())
+	}
+	if len(quorum.Relayers) == 0 {
+		quorum = nil
+	} else if err := quorum.Validate(); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	registry, err := broker.getRegistry(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	info, ok := registry[args[0]]
+	if !ok {
+		return shim.Error(FormatError(CodeNotRegistered, "chain not registered: "+args[0]))
+	}
+	if quorum != nil && (info.Fabric != nil || info.EVM != nil) {
+		return shim.Error("relayer quorum cannot be combined with proof verification")
+	}
+	info.Relayers = quorum
+	registry[args[0]] = info
+	if err := broker.putRegistry(stub, registry); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 查询来源链等待确认的消息
+// args[0] 来源链ID，args[1] 序号
+func (broker *Broker) getPendingMessage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+	v, err := stub.GetState(pendingMsgKey(args[0], args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 查询来源链某序号的冲突证据
+// args[0] 来源链ID，args[1] 序号
+func (broker *Broker) getRelayEvidence(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+	v, err := stub.GetState(relayEvidenceKey(args[0], args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 中继提交入链消息，消息格式同interchainBatchDeliver
+// args[0] 消息列表
+// 每条消息记为调用者的一票，相同内容达到来源链的法定数量且序号连续时执行，之后依次执行已达到法定数量的后续消息
+func (broker *Broker) interchainQuorumDeliver(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+	msgs := make([]CrossChainRequest, 0)
+	if err := json.Unmarshal([]byte(args[0]), &msgs); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal inbound messages: %w", err).Error())
+	}
+	if len(msgs) == 0 {
+		return shim.Error("empty batch")
+	}
+
+	relayer, err := relayerID(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	registry, err := broker.getRegistry(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	inMeta, err := broker.getMap(stub, innerMeta)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	cache := make(pendingCache)
+	results := make([]DeliverResult, 0, len(msgs))
+	for _, msg := range msgs {
+		result := DeliverResult{
+			SrcChainID: msg.SrcChainID,
+			Index:      msg.Index,
+			Func:       msg.Func,
+			Status:     deliverStatusFailed,
+		}
+		quorum := registry[msg.SrcChainID].Relayers
+		switch {
+		case quorum == nil:
+			result.Message = "no relayers registered for chain " + msg.SrcChainID
+		case !quorum.member(relayer):
+			result.Message = fmt.Sprintf("%s is not a relayer of chain %s", relayer, msg.SrcChainID)
+		case msg.Index <= inMeta[msg.SrcChainID]:
+			result.Message = fmt.Sprintf("message %d from chain %s already delivered", msg.Index, msg.SrcChainID)
+		default:
+			if _, err := broker.checkInbound(stub, msg.SrcChainID, msg.DstChainID); err != nil {
+				result.Message = err.Error()
+				break
+			}
+			if err := broker.vote(stub, cache, relayer, msg); err != nil {
+				return shim.Error(err.Error())
+			}
+			result.Status = deliverStatusPending
+		}
+		results = append(results, result)
+		if result.Status != deliverStatusPending {
+			continue
+		}
+
+		// 执行已达到法定数量的连续消息
+		executed, err := broker.executeReady(stub, cache, inMeta, quorum, msg.SrcChainID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for _, r := range executed {
+			if r.Index == msg.Index {
+				results[len(results)-1] = r
+			} else {
+				results = append(results, r)
+			}
+		}
+	}
+
+	if err := broker.putMap(stub, innerMeta, inMeta); err != nil {
+		return shim.Error(err.Error())
+	}
+	ret, err := json.Marshal(results)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(ret)
+}
+
+// 记录一票，同一序号出现不同内容时保存证据
+func (broker *Broker) vote(stub shim.ChaincodeStubInterface, cache pendingCache, relayer string, msg CrossChainRequest) error {
+	msgData, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(msgData)
+	hash := hex.EncodeToString(sum[:])
+
+	idx := strconv.FormatUint(msg.Index, 10)
+	pending, err := broker.getPending(stub, cache, msg.SrcChainID, idx)
+	if err != nil {
+		return err
+	}
+	if _, ok := pending.Votes[relayer]; !ok {
+		pending.Votes[relayer] = hash
+	}
+	submission, ok := pending.Submissions[hash]
+	if !ok {
+		submission = Submission{Message: msg}
+	}
+	submitted := false
+	for _, r := range submission.Relayers {
+		if r == relayer {
+			submitted = true
+		}
+	}
+	if !submitted {
+		submission.Relayers = append(submission.Relayers, relayer)
+	}
+	pending.Submissions[hash] = submission
+	if err := broker.putJSON(stub, pendingMsgKey(msg.SrcChainID, idx), pending); err != nil {
+		return err
+	}
+
+	if len(pending.Submissions) > 1 {
+		evidence := RelayEvidence{
+			SrcChainID:  msg.SrcChainID,
+			Index:       msg.Index,
+			Submissions: pending.Submissions,
+			TxID:        stub.GetTxID(),
+		}
+		if err := broker.putJSON(stub, relayEvidenceKey(msg.SrcChainID, idx), evidence); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 从来源链下一个序号开始依次执行已达到法定数量的消息，执行后删除等待记录
+func (broker *Broker) executeReady(stub shim.ChaincodeStubInterface, cache pendingCache, inMeta map[string]uint64, quorum *RelayerQuorum, srcChainID string) ([]DeliverResult, error) {
+	results := make([]DeliverResult, 0)
+	for {
+		idx := strconv.FormatUint(inMeta[srcChainID]+1, 10)
+		pending, err := broker.getPending(stub, cache, srcChainID, idx)
+		if err != nil {
+			return nil, err
+		}
+
+		// 按哈希排序保证各背书节点结果一致
+		hashes := make([]string, 0, len(pending.Submissions))
+		for hash := range pending.Submissions {
+			hashes = append(hashes, hash)
+		}
+		sort.Strings(hashes)
+		ready := ""
+		for _, hash := range hashes {
+			if quorum.count(*pending, hash) >= quorum.Threshold {
+				ready = hash
+				break
+			}
+		}
+		if ready == "" {
+			return results, nil
+		}
+
+		result, err := broker.deliverMessage(stub, inMeta, pending.Submissions[ready].Message)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+		if err := stub.DelState(pendingMsgKey(srcChainID, idx)); err != nil {
+			return nil, err
+		}
+		cache[pendingMsgKey(srcChainID, idx)] = newPending(srcChainID, pending.Index)
+		if inMeta[srcChainID] != pending.Index {
+			// 未通过校验，序号未推进
+			return results, nil
+		}
+	}
+}
+
+// 读取等待记录，不存在时返回空记录；记录缓存在cache中，修改后由调用方写回
+func (broker *Broker) getPending(stub shim.ChaincodeStubInterface, cache pendingCache, srcChainID string, idx string) (*PendingMessage, error) {
+	key := pendingMsgKey(srcChainID, idx)
+	if pending, ok := cache[key]; ok {
+		return pending, nil
+	}
+	v, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	index, err := strconv.ParseUint(idx, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	pending := newPending(srcChainID, index)
+	if v != nil {
+		if err := json.Unmarshal(v, pending); err != nil {
+			return nil, err
+		}
+	}
+	cache[key] = pending
+	return pending, nil
+}
+
+// 空的等待记录
+func newPending(srcChainID string, index uint64) *PendingMessage {
+	return &PendingMessage{
+		SrcChainID:  srcChainID,
+		Index:       index,
+		Votes:       make(map[string]string),
+		Submissions: make(map[string]Submission),
+	}
+}
+
+// 序列化后保存
+func (broker *Broker) putJSON(stub shim.ChaincodeStubInterface, key string, value interface{}) error {
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, v)
+}
+
+// 等待记录在账本中的key
+func pendingMsgKey(from string, idx string) string {
+	return fmt.Sprintf("pending-msg-%s-%s", from, idx)
+}
+
+// 冲突证据在账本中的key
+func relayEvidenceKey(from string, idx string) string {
+	return fmt.Sprintf("relay-evidence-%s-%s", from, idx)
+}
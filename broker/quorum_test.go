@@ -0,0 +1,196 @@
+package broker_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/DXPlus/CrosschainContract/relayer"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// chainB登记chainA，chainA的消息须由Org1MSP、Org2MSP、Org3MSP三个中继中的两个提交；Org4MSP不是中继
+func newQuorumChain(t *testing.T) (*relayer.MockChain, [][]byte) {
+	chain, err := relayer.NewMockChain("chainB", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := chain.Invoke("registerChain", `{"chainID":"chainA"}`); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+
+	creators := make([][]byte, 0)
+	ids := make([]string, 0)
+	for _, mspID := range []string{"Org1MSP", "Org2MSP", "Org3MSP", "Org4MSP"} {
+		creator, err := relayer.MockIdentity(mspID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := invokeAs(chain, creator, "getRelayerID")
+		if resp.Status != shim.OK {
+			t.Fatal(resp.Message)
+		}
+		creators = append(creators, creator)
+		ids = append(ids, string(resp.Payload))
+	}
+	quorum, err := json.Marshal(broker.RelayerQuorum{Relayers: ids[:3], Threshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := chain.Invoke("setRelayers", "chainA", string(quorum)); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	return chain, creators
+}
+
+// 以creator的身份调用跨链合约
+func invokeAs(chain *relayer.MockChain, creator []byte, function string, args ...string) pb.Response {
+	chain.Broker.Creator = creator
+	defer func() { chain.Broker.Creator = chain.Admin }()
+	return chain.Invoke(function, args...)
+}
+
+// 中继提交chainA发往chainB的index号消息，返回各消息的投递结果
+func submit(t *testing.T, chain *relayer.MockChain, creator []byte, index uint64, key string, value string) []broker.DeliverResult {
+	t.Helper()
+	msgs, err := json.Marshal([]broker.CrossChainRequest{{
+		SrcChainID: "chainA",
+		DstChainID: "chainB",
+		Index:      index,
+		Func:       "interchainSet",
+		Args:       []string{key, value},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := invokeAs(chain, creator, "interchainQuorumDeliver", string(msgs))
+	if resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	results := make([]broker.DeliverResult, 0)
+	if err := json.Unmarshal(resp.Payload, &results); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func pendingMessage(t *testing.T, chain *relayer.MockChain, index string) *broker.PendingMessage {
+	t.Helper()
+	resp := chain.Invoke("getPendingMessage", "chainA", index)
+	if len(resp.Payload) == 0 {
+		return nil
+	}
+	pending := &broker.PendingMessage{}
+	if err := json.Unmarshal(resp.Payload, pending); err != nil {
+		t.Fatal(err)
+	}
+	return pending
+}
+
+func TestQuorumDuplicateSubmissionCountsOnce(t *testing.T) {
+	chain, relayers := newQuorumChain(t)
+
+	for i := 0; i < 2; i++ {
+		results := submit(t, chain, relayers[0], 1, "k1", "v1")
+		if len(results) != 1 || results[0].Status != "pending" {
+			t.Fatalf("submission %d returned %+v", i, results)
+		}
+	}
+	if v := chain.Business.State["k1"]; v != nil {
+		t.Fatalf("k1 written by a single relayer: %q", v)
+	}
+	if pending := pendingMessage(t, chain, "1"); pending == nil || len(pending.Votes) != 1 || len(pending.Submissions) != 1 {
+		t.Fatalf("pending message is %+v", pending)
+	}
+}
+
+func TestQuorumRejectsUnknownRelayer(t *testing.T) {
+	chain, relayers := newQuorumChain(t)
+
+	results := submit(t, chain, relayers[3], 1, "k1", "v1")
+	if len(results) != 1 || results[0].Status != "failed" || !strings.Contains(results[0].Message, "is not a relayer") {
+		t.Fatalf("unknown relayer returned %+v", results)
+	}
+	if pending := pendingMessage(t, chain, "1"); pending != nil {
+		t.Fatalf("vote of an unknown relayer recorded: %+v", pending)
+	}
+
+	// 不是中继的调用者与一个中继不能凑成法定数量
+	submit(t, chain, relayers[0], 1, "k1", "v1")
+	submit(t, chain, relayers[3], 1, "k1", "v1")
+	if v := chain.Business.State["k1"]; v != nil {
+		t.Fatalf("k1 written without a quorum: %q", v)
+	}
+}
+
+func TestQuorumExecutesAfterThreshold(t *testing.T) {
+	chain, relayers := newQuorumChain(t)
+
+	// 2号消息先达到法定数量，等待1号消息
+	submit(t, chain, relayers[0], 2, "k2", "v2")
+	if results := submit(t, chain, relayers[1], 2, "k2", "v2"); results[0].Status != "pending" {
+		t.Fatalf("message 2 before message 1 returned %+v", results)
+	}
+
+	// 内容不同的提交各自计票，并保存证据
+	submit(t, chain, relayers[0], 1, "k1", "v1")
+	if results := submit(t, chain, relayers[2], 1, "k1", "forged"); results[0].Status != "pending" {
+		t.Fatalf("conflicting submission returned %+v", results)
+	}
+	if resp := chain.Invoke("getRelayEvidence", "chainA", "1"); len(resp.Payload) == 0 {
+		t.Fatal("no evidence for conflicting submissions")
+	}
+
+	results := submit(t, chain, relayers[1], 1, "k1", "v1")
+	if len(results) != 2 || results[0].Status != "success" || results[1].Index != 2 || results[1].Status != "success" {
+		t.Fatalf("reaching the quorum returned %+v", results)
+	}
+	if string(chain.Business.State["k1"]) != "v1" || string(chain.Business.State["k2"]) != "v2" {
+		t.Fatalf("business state is %q, %q", chain.Business.State["k1"], chain.Business.State["k2"])
+	}
+	if pending := pendingMessage(t, chain, "1"); pending != nil {
+		t.Fatalf("pending message kept after execution: %+v", pending)
+	}
+
+	// 执行后再次提交不会重复执行
+	for _, r := range relayers[:3] {
+		results := submit(t, chain, r, 1, "k1", "v1")
+		if results[0].Status != "failed" || !strings.Contains(results[0].Message, "already delivered") {
+			t.Fatalf("resubmission returned %+v", results)
+		}
+	}
+	if pending := pendingMessage(t, chain, "1"); pending != nil {
+		t.Fatalf("resubmission recorded: %+v", pending)
+	}
+}
+
+func TestQuorumChainAllowsSignedQueries(t *testing.T) {
+	chain, _ := newQuorumChain(t)
+	chain.Business.State["k1"] = []byte("v1")
+
+	// 写入须经中继确认，只读的签名查询可以直接调用
+	resp := chain.Invoke("interchainSet", "chainA", "chainB", "k1", "v2")
+	if resp.Status == shim.OK || !strings.Contains(resp.Message, "interchainQuorumDeliver") {
+		t.Fatalf("direct interchainSet returned %d %q", resp.Status, resp.Message)
+	}
+	resp = chain.Invoke("interchainGet", "chainA", "chainB", "k1", "chainA-chainB-1")
+	if resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	answer := broker.SignedAnswer{}
+	if err := json.Unmarshal(resp.Payload, &answer); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(answer.Answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.VerifyPayload(chain.PublicKey(), payload, answer.SigR, answer.SigS); err != nil {
+		t.Fatal(err)
+	}
+	if string(answer.Answer.Value) != "v1" {
+		t.Fatalf("answer is %+v", answer.Answer)
+	}
+}
@@ -0,0 +1,305 @@
+/*-------------------------------------------*/
+/*            跨链注册模块 registry.go         */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	chainRegistry = "chain-registry"
+
+	// 链能够响应的跨链请求类型
+	capabilityMultiQuery = "InterchainMultiQuery"
+)
+
+// 已注册的跨链伙伴链信息
+type ChainInfo struct {
+	ChainID      string          `json:"chainID"`             //链ID
+	Capabilities []string        `json:"capabilities"`        //链支持的跨链请求类型，如InterchainMultiQuery
+	PublicKey    string          `json:"publicKey,omitempty"` //链的跨链合约公钥，PEM格式，用于校验该链的查询应答
+	Fabric       *FabricVerifier `json:"fabric,omitempty"`    //Fabric来源链的背书校验配置，登记后该链的入链消息须携带背书证明
+	EVM          *EVMVerifier    `json:"evm,omitempty"`       //以太坊兼容来源链的校验配置，登记后该链的入链消息须携带回执证明
+	Relayers     *RelayerQuorum  `json:"relayers,omitempty"`  //来源链的中继集合，登记后该链的入链消息须由多个中继确认，见setRelayers
+}
+
+// 该链的入链消息须使用的投递接口，可直接投递时返回空
+func (info ChainInfo) InboundDeliver() string {
+	switch {
+	case info.Fabric != nil:
+		return "interchainFabricDeliver"
+	case info.EVM != nil:
+		return "interchainEVMDeliver"
+	case info.Relayers != nil:
+		return "interchainQuorumDeliver"
+	default:
+		return ""
+	}
+}
+
+// 入链消息的证明校验方式：fabric、evm，未登记时为none
+func (info ChainInfo) verifierMode() string {
+	switch {
+	case info.Fabric != nil:
+		return "fabric"
+	case info.EVM != nil:
+		return "evm"
+	default:
+		return "none"
+	}
+}
+
+// 判断链是否支持某类跨链请求
+func (info ChainInfo) HasCapability(capability string) bool {
+	for _, c := range info.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// 注册或更新伙伴链信息
+func (broker *Broker) registerChain(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	info := ChainInfo{}
+	if err := json.Unmarshal([]byte(args[0]), &info); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal chain info: %w", err).Error())
+	}
+	if info.ChainID == "" {
+		return shim.Error(FormatError(CodeInvalidArgument, "chain ID cannot be empty"))
+	}
+	if info.PublicKey != "" {
+		if _, err := parsePublicKey(info.PublicKey); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if info.Fabric != nil && info.EVM != nil {
+		return shim.Error("fabric and evm verifiers cannot be registered together")
+	}
+	if info.Fabric != nil {
+		if err := info.Fabric.Validate(); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if info.EVM != nil {
+		if err := info.EVM.Validate(); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	registry, err := broker.getRegistry(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// 校验方式只能在首次注册时设置，之后由setChainVerifier显式更换；未填写时保留原有设置
+	existing, registered := registry[info.ChainID]
+	if info.Fabric == nil && info.EVM == nil {
+		info.Fabric, info.EVM = existing.Fabric, existing.EVM
+	} else if registered && existing.verifierMode() != info.verifierMode() {
+		return shim.Error(fmt.Sprintf("verification mode of chain %s is %s, use setChainVerifier to change it", info.ChainID, existing.verifierMode()))
+	}
+	// 中继集合一般由setRelayers管理，未填写时保留原有设置
+	if info.Relayers == nil {
+		info.Relayers = existing.Relayers
+	}
+	if info.Relayers != nil {
+		if err := info.Relayers.Validate(); err != nil {
+			return shim.Error(err.Error())
+		}
+		if info.Fabric != nil || info.EVM != nil {
+			return shim.Error("relayer quorum cannot be combined with proof verification")
+		}
+	}
+	registry[info.ChainID] = info
+	if err := broker.putRegistry(stub, registry); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 更换伙伴链的证明校验方式
+// args[0] 链ID，args[1] 校验配置，如`{"fabric":{...}}`或`{"evm":{...}}`，为`{}`时取消证明校验
+func (broker *Broker) setChainVerifier(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+
+	verifier := ChainInfo{}
+	if err := json.Unmarshal([]byte(args[1]), &verifier); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal chain verifier: %w", err).Error())
+	}
+	if verifier.Fabric != nil && verifier.EVM != nil {
+		return shim.Error("fabric and evm verifiers cannot be registered together")
+	}
+	if verifier.Fabric != nil {
+		if err := verifier.Fabric.Validate(); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	if verifier.EVM != nil {
+		if err := verifier.EVM.Validate(); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	registry, err := broker.getRegistry(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	info, ok := registry[args[0]]
+	if !ok {
+		return shim.Error(FormatError(CodeNotRegistered, "chain not registered: "+args[0]))
+	}
+	if info.Relayers != nil && (verifier.Fabric != nil || verifier.EVM != nil) {
+		return shim.Error("relayer quorum cannot be combined with proof verification")
+	}
+	info.Fabric, info.EVM = verifier.Fabric, verifier.EVM
+	registry[args[0]] = info
+	if err := broker.putRegistry(stub, registry); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 删除伙伴链
+func (broker *Broker) removeChain(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	registry, err := broker.getRegistry(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, ok := registry[args[0]]; !ok {
+		return shim.Error(FormatError(CodeNotRegistered, "chain not registered: "+args[0]))
+	}
+	delete(registry, args[0])
+	if err := broker.putRegistry(stub, registry); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 查询单条伙伴链信息
+func (broker *Broker) getChain(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	info, err := broker.lookupChain(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	v, err := json.Marshal(info)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 查询全部伙伴链信息
+func (broker *Broker) listChains(stub shim.ChaincodeStubInterface) pb.Response {
+	v, err := stub.GetState(chainRegistry)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 获取已注册的伙伴链
+func (broker *Broker) lookupChain(stub shim.ChaincodeStubInterface, chainID string) (ChainInfo, error) {
+	registry, err := broker.getRegistry(stub)
+	if err != nil {
+		return ChainInfo{}, err
+	}
+	info, ok := registry[chainID]
+	if !ok {
+		return ChainInfo{}, codeErrorf(CodeNotRegistered, "chain not registered: %s", chainID)
+	}
+	return info, nil
+}
+
+// 获取支持某类跨链请求的全部伙伴链ID，按链ID排序保证各背书节点结果一致
+func (broker *Broker) chainsWithCapability(stub shim.ChaincodeStubInterface, capability string) ([]string, error) {
+	registry, err := broker.getRegistry(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	chains := make([]string, 0)
+	for chainID, info := range registry {
+		if info.HasCapability(capability) {
+			chains = append(chains, chainID)
+		}
+	}
+	sort.Strings(chains)
+	return chains, nil
+}
+
+// 登记了校验配置或中继集合的来源链不接受直接投递的入链消息
+func (broker *Broker) checkUnproven(stub shim.ChaincodeStubInterface, srcChainID string) error {
+	registry, err := broker.getRegistry(stub)
+	if err != nil {
+		return err
+	}
+	if function := registry[srcChainID].InboundDeliver(); function != "" {
+		return fmt.Errorf("messages from chain %s must be delivered through %s", srcChainID, function)
+	}
+	return nil
+}
+
+// getRegistry
+func (broker *Broker) getRegistry(stub shim.ChaincodeStubInterface) (map[string]ChainInfo, error) {
+	v, err := stub.GetState(chainRegistry)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := make(map[string]ChainInfo)
+	if v == nil {
+		return registry, nil
+	}
+	if err := json.Unmarshal(v, &registry); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// putRegistry
+func (broker *Broker) putRegistry(stub shim.ChaincodeStubInterface, registry map[string]ChainInfo) error {
+	v, err := json.Marshal(registry)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(chainRegistry, v)
+}
+
+// 解析PEM格式的ECDSA公钥，返回PKIX DER编码
+func parsePublicKey(text string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(text))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("invalid public key: expecting PEM encoded PUBLIC KEY")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if _, ok := pub.(*ecdsa.PublicKey); !ok {
+		return nil, fmt.Errorf("invalid public key: expecting ECDSA")
+	}
+	return block.Bytes, nil
+}
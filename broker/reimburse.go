@@ -0,0 +1,179 @@
+/*-------------------------------------------*/
+/*            发票报销状态模块 reimburse.go     */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 发票报销状态机，未记录的发票视为已开具
+//
+//	issued     -> locked、void、red-reversed
+//	locked     -> reimbursed、issued（解锁），只能由锁定该发票的链发起
+//	reimbursed -> red-reversed
+//	void、red-reversed 为终态
+var invoiceTransitions = map[string][]string{
+	InvoiceIssued:     {InvoiceLocked, InvoiceVoid, InvoiceRedReversed},
+	InvoiceLocked:     {InvoiceReimbursed, InvoiceIssued},
+	InvoiceReimbursed: {InvoiceRedReversed},
+}
+
+// 发票的报销状态记录
+type InvoiceState struct {
+	Fpdm    string              `json:"fpdm"`    //发票代码
+	Fphm    string              `json:"fphm"`    //发票号码
+	Status  string              `json:"status"`  //当前状态
+	ChainID string              `json:"chainID"` //最近一次状态变更的对端链，locked状态下即锁定该发票的链
+	History []InvoiceTransition `json:"history"` //状态变更历史
+}
+
+// 一次状态变更
+type InvoiceTransition struct {
+	From    string `json:"from"`    //变更前状态
+	To      string `json:"to"`      //变更后状态
+	ChainID string `json:"chainID"` //对端链ID
+	TxID    string `json:"txID"`    //发生变更的交易
+}
+
+// 校验状态变更是否合法
+func checkInvoiceTransition(state InvoiceState, to string, chainID string) error {
+	if state.Status == to {
+		return codeErrorf(CodeInvalidTransition, "invoice %s%s is already %s", state.Fpdm, state.Fphm, to)
+	}
+	allowed := false
+	for _, next := range invoiceTransitions[state.Status] {
+		if next == to {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return codeErrorf(CodeInvalidTransition, "invalid invoice transition %s -> %s for %s%s", state.Status, to, state.Fpdm, state.Fphm)
+	}
+	// 锁定中的发票只能由锁定它的链完成报销或解锁，防止同一张发票在两条链上重复报销
+	if state.Status == InvoiceLocked && state.ChainID != chainID {
+		return codeErrorf(CodeInvalidTransition, "invoice %s%s is locked by chain %s", state.Fpdm, state.Fphm, state.ChainID)
+	}
+	return nil
+}
+
+// 根据跨链消息中的发票计算状态变更，不涉及发票时返回空
+// 按发票格式书写的value（见isInvoiceText）必须是携带状态的合法发票，否则拒绝，防止绕过状态机写入发票
+// 同一消息中同一张发票出现多次时，状态和对端链必须一致，只变更一次
+// 账本读取不到本交易中的写入，因此必须在写入前完成全部校验；批量投递中前面消息写入的状态通过txWrites读取
+func (broker *Broker) prepareInvoiceTransitions(stub shim.ChaincodeStubInterface, chainID string, values ...string) ([]InvoiceState, error) {
+	states := make([]InvoiceState, 0)
+	seen := make(map[string]string)
+	for _, value := range values {
+		if !isInvoiceText(value) {
+			continue
+		}
+		inv, err := ParseInvoice(value)
+		if err != nil {
+			return nil, err
+		}
+		if inv.Status == "" {
+			return nil, fmt.Errorf("invoice %s carries no status", inv.ID())
+		}
+		if err := inv.Validate(); err != nil {
+			return nil, err
+		}
+		if status, ok := seen[inv.ID()]; ok {
+			if status != inv.Status {
+				return nil, fmt.Errorf("conflicting status for invoice %s in one request", inv.ID())
+			}
+			continue
+		}
+		seen[inv.ID()] = inv.Status
+
+		state, err := broker.loadInvoiceState(stub, inv.Fpdm, inv.Fphm)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkInvoiceTransition(state, inv.Status, chainID); err != nil {
+			return nil, err
+		}
+		state.History = append(state.History, InvoiceTransition{
+			From:    state.Status,
+			To:      inv.Status,
+			ChainID: chainID,
+			TxID:    stub.GetTxID(),
+		})
+		state.Status = inv.Status
+		state.ChainID = chainID
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// 保存状态变更
+func (broker *Broker) putInvoiceStates(stub shim.ChaincodeStubInterface, states []InvoiceState) error {
+	for _, state := range states {
+		v, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if err := broker.putTxState(stub, broker.invoiceStateKey(state.Fpdm, state.Fphm), v); err != nil {
+			return fmt.Errorf("save invoice state error: %w", err)
+		}
+	}
+	return nil
+}
+
+// 校验并保存状态变更，用于发出跨链请求之前
+func (broker *Broker) trackInvoices(stub shim.ChaincodeStubInterface, chainID string, values ...string) error {
+	states, err := broker.prepareInvoiceTransitions(stub, chainID, values...)
+	if err != nil {
+		return err
+	}
+	return broker.putInvoiceStates(stub, states)
+}
+
+// 获取发票的报销状态，未记录的发票视为已开具
+func (broker *Broker) loadInvoiceState(stub shim.ChaincodeStubInterface, fpdm string, fphm string) (InvoiceState, error) {
+	v, err := broker.getTxState(stub, broker.invoiceStateKey(fpdm, fphm))
+	if err != nil {
+		return InvoiceState{}, err
+	}
+
+	state := InvoiceState{
+		Fpdm:    fpdm,
+		Fphm:    fphm,
+		Status:  InvoiceIssued,
+		History: make([]InvoiceTransition, 0),
+	}
+	if v == nil {
+		return state, nil
+	}
+	if err := json.Unmarshal(v, &state); err != nil {
+		return InvoiceState{}, err
+	}
+	return state, nil
+}
+
+// 查询发票的报销状态
+func (broker *Broker) getInvoiceState(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+
+	state, err := broker.loadInvoiceState(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	v, err := json.Marshal(state)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 生成发票报销状态的key
+func (broker *Broker) invoiceStateKey(fpdm string, fphm string) string {
+	return fmt.Sprintf("invoice-state-%s-%s", fpdm, fphm)
+}
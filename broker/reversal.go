@@ -0,0 +1,415 @@
+/*-------------------------------------------*/
+/*            发票冲红模块 reversal.go         */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	ReversalFunc = "reversal-func"
+
+	invoiceHolderObjectType = "invoice-holder" // 本链发出的发票：发票代码、发票号码、收到发票的链
+	invoiceSourceObjectType = "invoice-source" // 本链收到的发票：发票代码、发票号码、发出发票的链
+
+	reversalAckOK     = "ok"
+	reversalAckFailed = "failed"
+)
+
+// 冲红记录，保存在开票链
+type ReversalRecord struct {
+	Fpdm   string                 `json:"fpdm"`   //发票代码
+	Fphm   string                 `json:"fphm"`   //发票号码
+	TxID   string                 `json:"txID"`   //发起冲红的交易ID
+	Chains []string               `json:"chains"` //收到过该发票、需要通知冲红的链
+	Acks   map[string]ReversalAck `json:"acks"`   //各链的确认
+}
+
+// 收到冲红通知的链返回的确认
+type ReversalAck struct {
+	Status  string `json:"status"`            //ok或failed
+	Message string `json:"message,omitempty"` //失败原因
+}
+
+// 发票冲红：通知所有收到过该发票的链
+// args[0] 发票代码，args[1] 发票号码
+func (broker *Broker) InterchainRedReverse(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+
+	fpdm := args[0]
+	fphm := args[1]
+
+	// 只有开票链可以发起冲红，从其他链收到该发票的链等待开票链的冲红通知
+	if err := broker.checkInvoiceIssuer(stub, fpdm, fphm); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 1 本链状态变更为已冲红，锁定中的发票需先完成报销或解锁
+	localChainID, err := broker.getLocalChainID(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	reversed, err := json.Marshal(Invoice{Fpdm: fpdm, Fphm: fphm, Status: InvoiceRedReversed})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := broker.trackInvoices(stub, localChainID, string(reversed)); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 2 根据发出发票时建立的索引确定收到过该发票的链
+	chains, err := broker.invoiceChains(stub, invoiceHolderObjectType, fpdm, fphm)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	record := ReversalRecord{
+		Fpdm:   fpdm,
+		Fphm:   fphm,
+		TxID:   stub.GetTxID(),
+		Chains: chains,
+		Acks:   make(map[string]ReversalAck),
+	}
+	v, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(broker.reversalKey(fpdm, fphm), v); err != nil {
+		return shim.Error(fmt.Errorf("save reversal record error: %w", err).Error())
+	}
+	if len(chains) == 0 {
+		return shim.Success(v)
+	}
+
+	// 3 向各链发出冲红通知，合并为一个事件
+	ccRequests := make([]CrossChainRequest, 0, len(chains))
+	for _, dstChainID := range chains {
+		ccRequests = append(ccRequests, CrossChainRequest{
+			DstChainID: dstChainID,
+			Func:       "InterchainRedReverse",
+			Args:       []string{dstChainID, fpdm, fphm},
+		})
+	}
+	response := broker.InterchainRequestBySetEventBatch(stub, ccRequests)
+	if response.Status != shim.OK {
+		return response
+	}
+	return shim.Success(v)
+}
+
+// 收到开票链的冲红通知：调用业务链配置的冲红函数，向开票链发回确认，并转发给从本链收到过该发票的链
+func (broker *Broker) interchainRedReverse(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 4 {
+		return shim.Error(errArgumentCount + ", expecting 4")
+	}
+	srcChainID, err := broker.checkInbound(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fpdm := args[2]
+	fphm := args[3]
+
+	// 只有向本链发出过该发票的链可以通知冲红：开票链，或转发冲红通知的上游链
+	if err := broker.checkInvoiceSource(stub, fpdm, fphm, srcChainID); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	reversalFunc, err := stub.GetState(ReversalFunc)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(reversalFunc) == 0 {
+		return shim.Error(FormatError(CodeNotInitialized, "reversal function not configured"))
+	}
+
+	// 已冲红的发票（如经多条链转发的重复通知）直接确认；本链状态不允许冲红时（如被其他链锁定）确认失败，不调用业务链
+	ack := ReversalAck{Status: reversalAckOK}
+	forward := make([]string, 0)
+	state, err := broker.loadInvoiceState(stub, fpdm, fphm)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if state.Status != InvoiceRedReversed {
+		if err := checkInvoiceTransition(state, InvoiceRedReversed, srcChainID); err != nil {
+			ack.Status = reversalAckFailed
+			ack.Message = err.Error()
+		} else if response := broker.invokeBusiness(stub, toChaincodeArgs(string(reversalFunc), fpdm, fphm)); response.Status != shim.OK {
+			ack.Status = reversalAckFailed
+			ack.Message = chaincodeError(broker.config.ChaincodeID, response.Message).Error()
+		} else {
+			state.History = append(state.History, InvoiceTransition{
+				From:    state.Status,
+				To:      InvoiceRedReversed,
+				ChainID: srcChainID,
+				TxID:    stub.GetTxID(),
+			})
+			state.Status = InvoiceRedReversed
+			state.ChainID = srcChainID
+			if err := broker.putInvoiceStates(stub, []InvoiceState{state}); err != nil {
+				return shim.Error(err.Error())
+			}
+			if forward, err = broker.forwardReversal(stub, fpdm, fphm, srcChainID); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+
+	// 确认同样作为跨链请求发回开票链
+	ccRequests := []CrossChainRequest{{
+		DstChainID: srcChainID,
+		Func:       "InterchainRedReverseAck",
+		Args:       []string{srcChainID, fpdm, fphm, ack.Status, ack.Message},
+	}}
+	for _, dstChainID := range forward {
+		ccRequests = append(ccRequests, CrossChainRequest{
+			DstChainID: dstChainID,
+			Func:       "InterchainRedReverse",
+			Args:       []string{dstChainID, fpdm, fphm},
+		})
+	}
+	if len(ccRequests) == 1 {
+		return broker.InterchainRequestBySetEvent(stub, ccRequests[0])
+	}
+	return broker.InterchainRequestBySetEventBatch(stub, ccRequests)
+}
+
+// 确定需要转发冲红通知的链：从本链收到过该发票的链，通知本链的上游链除外
+// 有需要转发的链时保存本链的冲红记录，用于接收下游链的确认
+func (broker *Broker) forwardReversal(stub shim.ChaincodeStubInterface, fpdm string, fphm string, srcChainID string) ([]string, error) {
+	holders, err := broker.invoiceChains(stub, invoiceHolderObjectType, fpdm, fphm)
+	if err != nil {
+		return nil, err
+	}
+	chains := make([]string, 0, len(holders))
+	for _, chainID := range holders {
+		if chainID != srcChainID {
+			chains = append(chains, chainID)
+		}
+	}
+	if len(chains) == 0 {
+		return chains, nil
+	}
+
+	v, err := json.Marshal(ReversalRecord{
+		Fpdm:   fpdm,
+		Fphm:   fphm,
+		TxID:   stub.GetTxID(),
+		Chains: chains,
+		Acks:   make(map[string]ReversalAck),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := stub.PutState(broker.reversalKey(fpdm, fphm), v); err != nil {
+		return nil, fmt.Errorf("save reversal record error: %w", err)
+	}
+	return chains, nil
+}
+
+// 开票链收到冲红确认
+func (broker *Broker) interchainRedReverseAck(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 5 {
+		return shim.Error(errArgumentCount + ", expecting 5")
+	}
+	srcChainID, err := broker.checkInbound(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fpdm := args[2]
+	fphm := args[3]
+	ack := ReversalAck{Status: args[4]}
+	if len(args) > 5 {
+		ack.Message = args[5]
+	}
+	if ack.Status != reversalAckOK && ack.Status != reversalAckFailed {
+		return shim.Error("invalid reversal ack status: " + ack.Status)
+	}
+
+	v, err := stub.GetState(broker.reversalKey(fpdm, fphm))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if v == nil {
+		return shim.Error(fmt.Sprintf("no reversal record for invoice %s%s", fpdm, fphm))
+	}
+	record := ReversalRecord{}
+	if err := json.Unmarshal(v, &record); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	notified := false
+	for _, chainID := range record.Chains {
+		if chainID == srcChainID {
+			notified = true
+			break
+		}
+	}
+	if !notified {
+		return shim.Error(fmt.Sprintf("chain %s was not notified of reversal of %s%s", srcChainID, fpdm, fphm))
+	}
+	record.Acks[srcChainID] = ack
+
+	v, err = json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(broker.reversalKey(fpdm, fphm), v); err != nil {
+		return shim.Error(fmt.Errorf("save reversal record error: %w", err).Error())
+	}
+	return shim.Success(nil)
+}
+
+// 记录跨链消息中发票的对端链，objectType为invoiceHolderObjectType或invoiceSourceObjectType
+func (broker *Broker) indexInvoiceChains(stub shim.ChaincodeStubInterface, objectType string, chainID string, values ...string) error {
+	for _, value := range values {
+		if !isInvoiceText(value) {
+			continue
+		}
+		inv, err := ParseInvoice(value)
+		if err != nil || inv.Fphm == "" {
+			continue
+		}
+		if objectType == invoiceHolderObjectType {
+			if err := broker.markInvoiceIssuer(stub, inv.Fpdm, inv.Fphm); err != nil {
+				return err
+			}
+		}
+		key, err := stub.CreateCompositeKey(objectType, []string{inv.Fpdm, inv.Fphm, chainID})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, []byte{0x00}); err != nil {
+			return fmt.Errorf("save invoice index error: %w", err)
+		}
+	}
+	return nil
+}
+
+// 查询发出过或收到过某张发票的对端链，按链ID排序
+func (broker *Broker) invoiceChains(stub shim.ChaincodeStubInterface, objectType string, fpdm string, fphm string) ([]string, error) {
+	iter, err := stub.GetStateByPartialCompositeKey(objectType, []string{fpdm, fphm})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	chains := make([]string, 0)
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attrs, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(attrs) == 3 {
+			chains = append(chains, attrs[2])
+		}
+	}
+	sort.Strings(chains)
+	return chains, nil
+}
+
+// 首次发出发票时本链尚未从其他链收到过该发票，则本链为开票链，记录在invoiceIssuerKey下
+func (broker *Broker) markInvoiceIssuer(stub shim.ChaincodeStubInterface, fpdm string, fphm string) error {
+	key := broker.invoiceIssuerKey(fpdm, fphm)
+	v, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		return nil
+	}
+	sources, err := broker.invoiceChains(stub, invoiceSourceObjectType, fpdm, fphm)
+	if err != nil {
+		return err
+	}
+	if len(sources) > 0 {
+		return nil
+	}
+	if err := stub.PutState(key, []byte{0x00}); err != nil {
+		return fmt.Errorf("save invoice issuer error: %w", err)
+	}
+	return nil
+}
+
+// 校验本链是否为开票链：记录为开票链，或从未从其他链收到过该发票
+func (broker *Broker) checkInvoiceIssuer(stub shim.ChaincodeStubInterface, fpdm string, fphm string) error {
+	v, err := stub.GetState(broker.invoiceIssuerKey(fpdm, fphm))
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		return nil
+	}
+	sources, err := broker.invoiceChains(stub, invoiceSourceObjectType, fpdm, fphm)
+	if err != nil {
+		return err
+	}
+	if len(sources) > 0 {
+		return codeErrorf(CodeAccessDenied, "invoice %s%s was received from chain %s, only its issuing chain may reverse it", fpdm, fphm, sources[0])
+	}
+	return nil
+}
+
+// 校验对端链是否向本链发出过某张发票
+func (broker *Broker) checkInvoiceSource(stub shim.ChaincodeStubInterface, fpdm string, fphm string, chainID string) error {
+	chains, err := broker.invoiceChains(stub, invoiceSourceObjectType, fpdm, fphm)
+	if err != nil {
+		return err
+	}
+	for _, c := range chains {
+		if c == chainID {
+			return nil
+		}
+	}
+	return fmt.Errorf("chain %s did not send invoice %s%s", chainID, fpdm, fphm)
+}
+
+// 设置业务链的冲红函数，该函数以发票代码、发票号码为参数
+func (broker *Broker) setReversalFunc(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+	if args[0] == "" {
+		return shim.Error(FormatError(CodeInvalidArgument, "reversal function cannot be empty"))
+	}
+
+	if err := stub.PutState(ReversalFunc, []byte(args[0])); err != nil {
+		return shim.Error(fmt.Errorf("save reversal function error: %w", err).Error())
+	}
+	return shim.Success(nil)
+}
+
+// 查询冲红记录
+func (broker *Broker) getReversal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 {
+		return shim.Error(errArgumentCount + ", expecting 2")
+	}
+	v, err := stub.GetState(broker.reversalKey(args[0], args[1]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 生成冲红记录的key
+func (broker *Broker) reversalKey(fpdm string, fphm string) string {
+	return fmt.Sprintf("reversal-%s-%s", fpdm, fphm)
+}
+
+// 生成开票链标记的key
+func (broker *Broker) invoiceIssuerKey(fpdm string, fphm string) string {
+	return fmt.Sprintf("invoice-issuer-%s-%s", fpdm, fphm)
+}
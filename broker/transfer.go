@@ -0,0 +1,449 @@
+/*-------------------------------------------*/
+/*            发票转移模块 transfer.go         */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const (
+	TransferFunc        = "transfer-func"         // 业务链转出函数在账本中的key
+	defaultTransferFunc = "interchainTransferOut" // 未设置时使用的业务链转出函数
+)
+
+// 发票转移状态
+const (
+	transferInFlight   = "in-flight"   // 已在来源链锁定，等待目的链回执
+	transferOutPending = "out-pending" // 目的链已创建，来源链转出函数执行失败，等待retryTransferOut
+	transferCompleted  = "completed"   // 目的链已创建，来源链已完成转出
+	transferFailed     = "failed"      // 目的链创建失败，来源链已解锁
+	transferCancelled  = "cancelled"   // 超过截止时间未收到回执，来源链已取消并解锁，仍等待目的链回执
+
+	transferReceiptOK     = "ok"
+	transferReceiptFailed = "failed"
+)
+
+// 发票转移记录，保存在来源链
+type TransferRecord struct {
+	Key        string `json:"key"`                //发票在业务链中的key
+	DstChainID string `json:"dstChainID"`         //转入链ID
+	Value      string `json:"value"`              //转移的发票
+	Status     string `json:"status"`             //in-flight、out-pending、completed、failed、cancelled
+	Deadline   int64  `json:"deadline,omitempty"` //截止时间，Unix秒，0表示不超时
+	TxID       string `json:"txID"`               //发起转移的交易ID，回执须带有该ID
+	Message    string `json:"message,omitempty"`  //目的链返回的失败原因
+}
+
+// 跨链发票转移：在本链锁定发票，由目的链创建，根据目的链回执完成转出或解锁
+// args[0] 目的链ID，args[1] 发票的key，args[2] 发票，args[3] 可选，超时秒数，0表示不超时
+func (broker *Broker) InterchainTransferInvoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+
+	dstChainID := args[0]
+	key := args[1]
+	inv, _, err := normalizeInvoice(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := broker.checkNotInFlight(stub, key); err != nil {
+		return shim.Error(err.Error())
+	}
+	// 已取消的转移仍可能收到目的链的成功回执，收到回执前不能再次转移，否则发票可能同时出现在两条链上
+	previous, err := broker.loadTransfer(stub, key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if previous != nil && previous.Status == transferCancelled {
+		return shim.Error(FormatError(CodeInFlight, fmt.Sprintf("cancelled transfer of %s to chain %s is awaiting its receipt", key, previous.DstChainID)))
+	}
+
+	// 本链已作废、已冲红或锁定中的发票不能转移，转移的发票状态须与本链记录一致
+	state, err := broker.loadInvoiceState(stub, inv.Fpdm, inv.Fphm)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(invoiceTransitions[state.Status]) == 0 || state.Status == InvoiceLocked {
+		return shim.Error(FormatError(CodeInvalidTransition, fmt.Sprintf("invoice %s is %s on this chain", inv.ID(), state.Status)))
+	}
+	if inv.Status != "" && inv.Status != state.Status {
+		return shim.Error(FormatError(CodeInvalidTransition, fmt.Sprintf("invoice %s is %s on this chain, not %s", inv.ID(), state.Status, inv.Status)))
+	}
+	inv.Status = state.Status
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	value := string(data)
+
+	deadline := int64(0)
+	if len(args) > 3 && args[3] != "" {
+		timeout, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || timeout < 0 {
+			return shim.Error(FormatError(CodeInvalidArgument, "invalid timeout: "+args[3]))
+		}
+		if timeout > 0 {
+			ts, err := stub.GetTxTimestamp()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			deadline = ts.GetSeconds() + timeout
+		}
+	}
+
+	// 锁定发票
+	record := TransferRecord{
+		Key:        key,
+		DstChainID: dstChainID,
+		Value:      value,
+		Status:     transferInFlight,
+		Deadline:   deadline,
+		TxID:       stub.GetTxID(),
+	}
+	if err := broker.putTransfer(stub, record); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ccRequest := CrossChainRequest{
+		DstChainID: dstChainID,
+		Func:       "InterchainTransferInvoice",
+		Args:       []string{dstChainID, key, value, strconv.FormatInt(deadline, 10), record.TxID},
+		Deadline:   deadline,
+	}
+	return broker.InterchainRequestBySetEvent(stub, ccRequest)
+}
+
+// 超过截止时间仍未收到回执时取消转移并解锁发票，任何人均可在截止时间后调用
+// 目的链不接受超过截止时间到达的转入；取消后仍收到成功回执时以目的链为准完成转出
+// args[0] 发票的key
+func (broker *Broker) cancelTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	record, err := broker.loadTransfer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if record == nil || record.Status != transferInFlight {
+		return shim.Error("no transfer in flight for key " + args[0])
+	}
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if record.Deadline == 0 || ts.GetSeconds() <= record.Deadline {
+		return shim.Error(fmt.Sprintf("transfer of %s has not timed out", args[0]))
+	}
+
+	record.Status = transferCancelled
+	record.Message = fmt.Sprintf("no receipt from chain %s before %d", record.DstChainID, record.Deadline)
+	if err := broker.putTransfer(stub, *record); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 目的链收到转入的发票：校验发票并登记报销状态，写入业务链后向来源链发回回执
+// args[0] 来源链ID，args[1] 目的链ID，args[2] 发票的key，args[3] 发票，args[4] 可选，截止时间，args[5] 可选，转移ID
+func (broker *Broker) interchainTransferIn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 4 {
+		return shim.Error(errArgumentCount + ", expecting 4")
+	}
+	srcChainID, err := broker.checkInbound(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key := args[2]
+	value := args[3]
+	transferID := ""
+	if len(args) > 5 {
+		transferID = args[5]
+	}
+
+	status := transferReceiptOK
+	message := ""
+	if err := broker.checkTransferIn(stub, args); err != nil {
+		status = transferReceiptFailed
+		message = err.Error()
+	} else if err := broker.checkNotInFlight(stub, key); err != nil {
+		status = transferReceiptFailed
+		message = err.Error()
+	} else if state, err := broker.prepareTransferInState(stub, srcChainID, value); err != nil {
+		status = transferReceiptFailed
+		message = err.Error()
+	} else {
+		b := toChaincodeArgs("interchainSet", key, value)
+		response := broker.invokeBusiness(stub, b)
+		if response.Status != shim.OK {
+			status = transferReceiptFailed
+			message = chaincodeError(broker.config.ChaincodeID, response.Message).Error()
+		} else if err := broker.putInvoiceStates(stub, []InvoiceState{state}); err != nil {
+			return shim.Error(err.Error())
+		} else if err := broker.recordFingerprints(stub, fingerprintIn, srcChainID, value); err != nil {
+			return shim.Error(err.Error())
+		} else if err := broker.indexInvoiceChains(stub, invoiceSourceObjectType, srcChainID, value); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// 回执同样作为跨链请求发回来源链
+	ccRequest := CrossChainRequest{
+		DstChainID: srcChainID,
+		Func:       "InterchainTransferReceipt",
+		Args:       []string{srcChainID, key, status, message, transferID},
+	}
+	return broker.InterchainRequestBySetEvent(stub, ccRequest)
+}
+
+// 超过截止时间到达的转入不再执行，来源链届时可取消转移
+func (broker *Broker) checkTransferIn(stub shim.ChaincodeStubInterface, args []string) error {
+	if len(args) < 5 || args[4] == "" {
+		return nil
+	}
+	deadline, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid deadline: %s", args[4])
+	}
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	if deadline > 0 && ts.GetSeconds() > deadline {
+		return fmt.Errorf("transfer expired at %d", deadline)
+	}
+	return nil
+}
+
+// 转入的发票须为合法发票，报销状态沿用来源链，未携带状态时视为已开具
+// 在本链已作废、已冲红或被其他链锁定的发票不能转入；本链已有状态记录时，须为相同状态或合法的状态变更，
+// 防止转入把已报销的发票重置为已开具
+func (broker *Broker) prepareTransferInState(stub shim.ChaincodeStubInterface, srcChainID string, value string) (InvoiceState, error) {
+	inv, err := ParseInvoice(value)
+	if err != nil {
+		return InvoiceState{}, err
+	}
+	if err := inv.Validate(); err != nil {
+		return InvoiceState{}, err
+	}
+	status := inv.Status
+	if status == "" {
+		status = InvoiceIssued
+	}
+
+	state, err := broker.loadInvoiceState(stub, inv.Fpdm, inv.Fphm)
+	if err != nil {
+		return InvoiceState{}, err
+	}
+	if len(invoiceTransitions[state.Status]) == 0 {
+		return InvoiceState{}, codeErrorf(CodeInvalidTransition, "invoice %s is %s on this chain", inv.ID(), state.Status)
+	}
+	if state.Status == InvoiceLocked && state.ChainID != srcChainID {
+		return InvoiceState{}, codeErrorf(CodeInvalidTransition, "invoice %s is locked by chain %s", inv.ID(), state.ChainID)
+	}
+	if len(state.History) > 0 && state.Status != status {
+		if err := checkInvoiceTransition(state, status, srcChainID); err != nil {
+			return InvoiceState{}, err
+		}
+	}
+
+	state.History = append(state.History, InvoiceTransition{
+		From:    state.Status,
+		To:      status,
+		ChainID: srcChainID,
+		TxID:    stub.GetTxID(),
+	})
+	state.Status = status
+	state.ChainID = srcChainID
+	return state, nil
+}
+
+// 来源链收到目的链回执：成功则调用业务链的转出函数完成转出，失败则解锁
+// 已取消的转移收到成功回执时，发票已在目的链创建，同样完成转出
+// 转出函数执行失败时发票保持锁定（out-pending），由retryTransferOut重试
+// args[0] 来源链ID，args[1] 目的链ID，args[2] 发票的key，args[3] ok或failed，args[4] 失败原因，args[5] 转移ID
+func (broker *Broker) interchainTransferReceipt(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 4 {
+		return shim.Error(errArgumentCount + ", expecting 4")
+	}
+	srcChainID, err := broker.checkInbound(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key := args[2]
+	status := args[3]
+	message := ""
+	if len(args) > 4 {
+		message = args[4]
+	}
+
+	record, err := broker.loadTransfer(stub, key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if record == nil || (record.Status != transferInFlight && record.Status != transferCancelled) {
+		return shim.Error("no transfer in flight for key " + key)
+	}
+	if record.DstChainID != srcChainID {
+		return shim.Error(fmt.Sprintf("transfer of %s is addressed to chain %s, receipt from %s", key, record.DstChainID, srcChainID))
+	}
+	if len(args) > 5 && args[5] != record.TxID {
+		return shim.Error(fmt.Sprintf("receipt for transfer %s does not match transfer %s of %s", args[5], record.TxID, key))
+	}
+
+	switch status {
+	case transferReceiptOK:
+		cancelled := record.Status == transferCancelled
+		if err := broker.transferOut(stub, record); err != nil {
+			record.Status = transferOutPending
+			record.Message = err.Error()
+		} else if cancelled {
+			record.Message = "completed after cancellation"
+		}
+	case transferReceiptFailed:
+		record.Status = transferFailed
+		record.Message = message
+	default:
+		return shim.Error(FormatError(CodeInvalidArgument, "invalid transfer receipt status: "+status))
+	}
+
+	if err := broker.putTransfer(stub, *record); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 调用业务链的转出函数，成功后转移完成
+func (broker *Broker) transferOut(stub shim.ChaincodeStubInterface, record *TransferRecord) error {
+	transferFunc, err := broker.transferFunc(stub)
+	if err != nil {
+		return err
+	}
+	b := toChaincodeArgs(transferFunc, record.Key, record.DstChainID)
+	response := broker.invokeBusiness(stub, b)
+	if response.Status != shim.OK {
+		return chaincodeError(broker.config.ChaincodeID, response.Message)
+	}
+	record.Status = transferCompleted
+	record.Message = ""
+	return nil
+}
+
+// 重试转出函数执行失败的转移，目的链已确认创建发票，任何人均可调用
+// args[0] 发票的key
+func (broker *Broker) retryTransferOut(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	record, err := broker.loadTransfer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if record == nil || record.Status != transferOutPending {
+		return shim.Error("no pending transfer out for key " + args[0])
+	}
+	if err := broker.transferOut(stub, record); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := broker.putTransfer(stub, *record); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 设置业务链的转出函数，该函数以发票的key、转入链ID为参数
+func (broker *Broker) setTransferFunc(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+	if args[0] == "" {
+		return shim.Error(FormatError(CodeInvalidArgument, "transfer function cannot be empty"))
+	}
+
+	if err := stub.PutState(TransferFunc, []byte(args[0])); err != nil {
+		return shim.Error(fmt.Errorf("save transfer function error: %w", err).Error())
+	}
+	return shim.Success(nil)
+}
+
+// 业务链的转出函数，未设置时为interchainTransferOut
+func (broker *Broker) transferFunc(stub shim.ChaincodeStubInterface) (string, error) {
+	v, err := stub.GetState(TransferFunc)
+	if err != nil {
+		return "", err
+	}
+	if len(v) == 0 {
+		return defaultTransferFunc, nil
+	}
+	return string(v), nil
+}
+
+// 转移中的发票不允许在本链修改
+func (broker *Broker) checkNotInFlight(stub shim.ChaincodeStubInterface, keys ...string) error {
+	for _, key := range keys {
+		record, err := broker.loadTransfer(stub, key)
+		if err != nil {
+			return err
+		}
+		if record != nil && (record.Status == transferInFlight || record.Status == transferOutPending) {
+			return codeErrorf(CodeInFlight, "invoice %s is being transferred to chain %s", key, record.DstChainID)
+		}
+	}
+	return nil
+}
+
+// 获取发票转移记录，没有记录时返回空
+func (broker *Broker) loadTransfer(stub shim.ChaincodeStubInterface, key string) (*TransferRecord, error) {
+	v, err := stub.GetState(broker.transferKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, nil
+	}
+
+	record := &TransferRecord{}
+	if err := json.Unmarshal(v, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// 保存发票转移记录
+func (broker *Broker) putTransfer(stub shim.ChaincodeStubInterface, record TransferRecord) error {
+	v, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(broker.transferKey(record.Key), v); err != nil {
+		return fmt.Errorf("save transfer record error: %w", err)
+	}
+	return nil
+}
+
+// 查询发票转移记录，业务链可据此拒绝修改转移中的发票
+func (broker *Broker) getTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+	v, err := stub.GetState(broker.transferKey(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 生成发票转移记录的key
+func (broker *Broker) transferKey(key string) string {
+	return fmt.Sprintf("transfer-%s", key)
+}
@@ -0,0 +1,221 @@
+/*-------------------------------------------*/
+/*            PAPP通信配置 transport.go        */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/DXPlus/CrosschainContract/papp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+const PAPPTransport = "papp-transport"
+
+// 通信配置的默认值
+const (
+	defaultTransportTimeout = 30  // 秒
+	defaultTransportRetries = 2   // 次
+	defaultTransportBackoff = 500 // 毫秒
+	maxTransportTimeout     = 300 // 秒
+	maxTransportRetries     = 10  // 次
+)
+
+// 与PAPP通信的配置，保存在账本中，通道成员均可读取
+type TransportConfig struct {
+	Timeout          int64  `json:"timeout,omitempty"`          //单次请求超时秒数
+	Retries          int    `json:"retries"`                    //失败后的最多重试次数
+	Backoff          int64  `json:"backoff,omitempty"`          //首次重试前等待的毫秒数，之后每次加倍
+	MaxResponseBytes int64  `json:"maxResponseBytes,omitempty"` //应答大小上限
+	CACert           string `json:"caCert,omitempty"`           //PAPP服务端证书的CA，PEM格式
+	ClientCert       string `json:"clientCert,omitempty"`       //双向TLS的客户端证书，PEM格式
+	ClientKey        string `json:"clientKey,omitempty"`        //双向TLS的客户端私钥，PEM格式
+}
+
+// 默认通信配置
+func defaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		Timeout:          defaultTransportTimeout,
+		Retries:          defaultTransportRetries,
+		Backoff:          defaultTransportBackoff,
+		MaxResponseBytes: papp.DefaultMaxResponseBytes,
+	}
+}
+
+// 校验通信配置
+func (cfg TransportConfig) Validate() error {
+	if cfg.Timeout <= 0 || cfg.Timeout > maxTransportTimeout {
+		return fmt.Errorf("invalid timeout %d, expecting 1-%d seconds", cfg.Timeout, maxTransportTimeout)
+	}
+	if cfg.Retries < 0 || cfg.Retries > maxTransportRetries {
+		return fmt.Errorf("invalid retries %d, expecting 0-%d", cfg.Retries, maxTransportRetries)
+	}
+	if cfg.Backoff < 0 {
+		return fmt.Errorf("invalid backoff %d", cfg.Backoff)
+	}
+	if cfg.MaxResponseBytes <= 0 {
+		return fmt.Errorf("invalid maxResponseBytes %d", cfg.MaxResponseBytes)
+	}
+	if (cfg.ClientCert == "") != (cfg.ClientKey == "") {
+		return fmt.Errorf("clientCert and clientKey must be set together")
+	}
+	_, err := cfg.tlsConfig()
+	return err
+}
+
+// 是否启用TLS
+func (cfg TransportConfig) TLSEnabled() bool {
+	return cfg.CACert != "" || cfg.ClientCert != ""
+}
+
+// 生成TLS配置，未配置证书时返回nil
+func (cfg TransportConfig) tlsConfig() (*tls.Config, error) {
+	if !cfg.TLSEnabled() {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.CACert)) {
+			return nil, fmt.Errorf("invalid caCert")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(cfg.ClientCert), []byte(cfg.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// 创建PAPP客户端，budget为本次请求的总时长，为0时不限制
+func (cfg TransportConfig) client(pappURL string, budget time.Duration) (*papp.Client, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	client := &papp.Client{
+		URL: pappURL,
+		HTTPClient: &http.Client{
+			Timeout:   time.Duration(cfg.Timeout) * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+		},
+		Retries:          cfg.Retries,
+		Backoff:          time.Duration(cfg.Backoff) * time.Millisecond,
+		MaxResponseBytes: cfg.MaxResponseBytes,
+	}
+	if budget > 0 {
+		client.Deadline = time.Now().Add(budget)
+	}
+	return client, nil
+}
+
+// 校验PAPP地址：必须为http或https的绝对地址，启用TLS时必须为https
+func validatePAPPURL(pappURL string, cfg TransportConfig) error {
+	u, err := url.Parse(pappURL)
+	if err != nil {
+		return fmt.Errorf("invalid PAPP address: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid PAPP address %s: scheme must be http or https", pappURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid PAPP address %s: missing host", pappURL)
+	}
+	if u.User != nil {
+		return fmt.Errorf("invalid PAPP address %s: credentials are not allowed", pappURL)
+	}
+	if cfg.TLSEnabled() && u.Scheme != "https" {
+		return fmt.Errorf("invalid PAPP address %s: https is required when TLS is configured", pappURL)
+	}
+	return nil
+}
+
+// 读取通信配置，未设置时使用默认值
+func (broker *Broker) loadTransport(stub shim.ChaincodeStubInterface) (TransportConfig, error) {
+	v, err := stub.GetState(PAPPTransport)
+	if err != nil {
+		return TransportConfig{}, err
+	}
+	cfg := defaultTransportConfig()
+	if v == nil {
+		return cfg, nil
+	}
+	if err := json.Unmarshal(v, &cfg); err != nil {
+		return TransportConfig{}, err
+	}
+	return cfg, nil
+}
+
+// 设置与PAPP通信的配置
+// args[0] 配置，如`{"timeout":10,"retries":2,"backoff":500,"caCert":"-----BEGIN CERTIFICATE-----..."}`，未填写的项使用默认值
+func (broker *Broker) setPAPPTransport(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 {
+		return shim.Error(errArgumentCount + ", expecting 1")
+	}
+
+	cfg := defaultTransportConfig()
+	if err := json.Unmarshal([]byte(args[0]), &cfg); err != nil {
+		return shim.Error(fmt.Errorf("unmarshal transport config: %w", err).Error())
+	}
+	if err := cfg.Validate(); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 已设置的PAPP地址与各目的链的地址须与新配置相符
+	pappURL, err := stub.GetState(PAPPIP)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if pappURL != nil {
+		if err := validatePAPPURL(string(pappURL), cfg); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	endpoints, err := broker.getEndpoints(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, chain := range endpoints {
+		for _, u := range chain.Endpoints {
+			if err := validatePAPPURL(u, cfg); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+
+	v, err := json.Marshal(cfg)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(PAPPTransport, v); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 查询通信配置，不返回客户端私钥
+func (broker *Broker) getPAPPTransport(stub shim.ChaincodeStubInterface) pb.Response {
+	cfg, err := broker.loadTransport(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if cfg.ClientKey != "" {
+		cfg.ClientKey = "<redacted>"
+	}
+	v, err := json.Marshal(cfg)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
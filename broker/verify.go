@@ -0,0 +1,268 @@
+/*-------------------------------------------*/
+/*            发票核验模块 verify.go           */
+/*-------------------------------------------*/
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 同一来源链对同一发票连续核验不一致的次数上限，达到后该发票的核验一律不一致，须由管理员重置
+const maxVerifyFailures = 5
+
+// 发票核验结果，只说明是否一致，不包含业务链中的发票内容
+type VerifyResult struct {
+	RequestID  string `json:"requestID"`        //跨链请求ID，来源链ID-目的链ID-序号
+	Fpdm       string `json:"fpdm"`             //发票代码
+	Fphm       string `json:"fphm"`             //发票号码
+	QueryHash  string `json:"queryHash"`        //核验的发票代码、号码、校验码与金额的摘要，见VerifyQueryHash
+	Match      bool   `json:"match"`            //校验码与金额是否与业务链记录一致
+	Locked     bool   `json:"locked,omitempty"` //连续核验不一致的次数达到上限，未比对
+	SrcChainID string `json:"srcChainID"`       //发起核验的链
+	ChainID    string `json:"chainID"`          //完成核验的链
+	TxID       string `json:"txID"`             //完成核验的交易ID
+}
+
+// 经目的链跨链合约签名的核验结果
+type SignedVerifyResult struct {
+	Result VerifyResult `json:"result"` //核验结果
+	SigR   []byte       `json:"sig_r"`  //对核验结果的签名
+	SigS   []byte       `json:"sig_s"`  //对核验结果的签名
+}
+
+// 跨链发票核验
+// args[0] 目的链ID，args[1] 发票代码，args[2] 发票号码，args[3] 校验码，args[4] 金额
+func (broker *Broker) InterchainVerifyInvoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 5 {
+		return shim.Error(errArgumentCount + ", expecting 5")
+	}
+
+	dstChainID := args[0]
+	fpdm := args[1]
+	fphm := args[2]
+	jym := args[3]
+	amount := args[4]
+	if _, err := ParseAmount(amount); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ccRequest := CrossChainRequest{
+		DstChainID: dstChainID,
+		Func:       "InterchainVerifyInvoice",
+		Args:       []string{dstChainID, fpdm, fphm, jym, amount},
+	}
+
+	return broker.invoke(stub, ccRequest, InvokeOptions{Mode: InvokeModeSync})
+}
+
+// 应答其他链的发票核验，将校验码与金额和业务链中的发票比对，只返回签名后的比对结果
+// 业务链以发票代码+发票号码作为发票的key
+// args[6] PAPP转交的跨链请求ID，写入签名的核验结果
+func (broker *Broker) interchainVerifyInvoice(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 6 {
+		return shim.Error(errArgumentCount + ", expecting 6")
+	}
+	srcChainID, err := broker.checkInbound(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	requestID, err := checkRequestID(args, 6)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	failures, err := broker.verifyFailures(stub, srcChainID, args[2], args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	query := Invoice{
+		Fpdm:   args[2],
+		Fphm:   args[3],
+		Jym:    args[4],
+		Amount: args[5],
+	}
+	result := VerifyResult{
+		RequestID:  requestID,
+		Fpdm:       query.Fpdm,
+		Fphm:       query.Fphm,
+		QueryHash:  VerifyQueryHash(query.Fpdm, query.Fphm, query.Jym, query.Amount),
+		SrcChainID: srcChainID,
+		ChainID:    args[1],
+		TxID:       stub.GetTxID(),
+	}
+
+	// 查询失败或发票不存在时均视为不一致，不向对方透露原因；连续不一致的次数达到上限后不再比对，防止穷举校验码
+	if failures >= maxVerifyFailures {
+		result.Locked = true
+	} else {
+		b := toChaincodeArgs("interchainGet", query.ID())
+		response := broker.invokeBusiness(stub, b)
+		if response.Status == shim.OK && len(response.Payload) > 0 {
+			if record, err := ParseInvoice(string(response.Payload)); err == nil {
+				result.Match = invoiceMatches(record, query)
+			}
+		}
+		if result.Match {
+			failures = 0
+		} else {
+			failures++
+		}
+		if err := broker.putVerifyFailures(stub, srcChainID, query.Fpdm, query.Fphm, failures); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	resultData, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	signR, signS, err := broker.signPayload(stub, resultData)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	v, err := json.Marshal(SignedVerifyResult{
+		Result: result,
+		SigR:   signR,
+		SigS:   signS,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(v)
+}
+
+// 核验请求的摘要：sha256(发票代码|发票号码|校验码|金额)的十六进制，使签名的核验结果与所核验的校验码、金额绑定
+func VerifyQueryHash(fpdm string, fphm string, jym string, amount string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{fpdm, fphm, jym, amount}, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// 直接调用或经interchainBatchDeliver投递核验请求的须为管理员组织或登记在来源链中继集合中的中继
+func (broker *Broker) checkVerifyCaller(stub shim.ChaincodeStubInterface, srcChainID string) error {
+	if err := broker.checkAdmin(stub); err == nil {
+		return nil
+	} else if ErrorCodeOf(err.Error()) != CodeAccessDenied {
+		return err
+	}
+	registry, err := broker.getRegistry(stub)
+	if err != nil {
+		return err
+	}
+	relayer, err := relayerID(stub)
+	if err != nil {
+		return err
+	}
+	if quorum := registry[srcChainID].Relayers; quorum == nil || !quorum.member(relayer) {
+		return codeErrorf(CodeAccessDenied, "access denied: %s may not verify invoices for chain %s", relayer, srcChainID)
+	}
+	return nil
+}
+
+// 经interchainBatchDeliver投递的核验请求同样校验调用者
+func (broker *Broker) checkInboundCaller(stub shim.ChaincodeStubInterface, msg CrossChainRequest) error {
+	if msg.Func != "interchainVerifyInvoice" {
+		return nil
+	}
+	return broker.checkVerifyCaller(stub, msg.SrcChainID)
+}
+
+// 来源链对发票连续核验不一致的次数，保存在verifyFailuresKey下
+func (broker *Broker) verifyFailures(stub shim.ChaincodeStubInterface, srcChainID string, fpdm string, fphm string) (int, error) {
+	v, err := stub.GetState(verifyFailuresKey(srcChainID, fpdm, fphm))
+	if err != nil {
+		return 0, err
+	}
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+func (broker *Broker) putVerifyFailures(stub shim.ChaincodeStubInterface, srcChainID string, fpdm string, fphm string, failures int) error {
+	key := verifyFailuresKey(srcChainID, fpdm, fphm)
+	if failures == 0 {
+		return stub.DelState(key)
+	}
+	return stub.PutState(key, []byte(strconv.Itoa(failures)))
+}
+
+func verifyFailuresKey(srcChainID string, fpdm string, fphm string) string {
+	return fmt.Sprintf("verify-failures-%s-%s%s", srcChainID, fpdm, fphm)
+}
+
+// 管理员重置来源链对发票的核验失败次数
+// args[0] 来源链ID，args[1] 发票代码，args[2] 发票号码
+func (broker *Broker) resetVerifyFailures(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 {
+		return shim.Error(errArgumentCount + ", expecting 3")
+	}
+	if err := broker.putVerifyFailures(stub, args[0], args[1], args[2], 0); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// 校验目的链签名的核验结果，返回原样的SignedVerifyResult供业务链留存
+func verifyInvoiceAnswer(publicKey []byte, ccRequest CrossChainRequest, requestID string, data []byte) ([]byte, error) {
+	// args: 目的链ID，发票代码，发票号码，校验码，金额
+	if len(ccRequest.Args) < 5 {
+		return nil, fmt.Errorf("malformed %s request %d", ccRequest.Func, ccRequest.Index)
+	}
+	dstChainID := ccRequest.DstChainID
+
+	signed := SignedVerifyResult{}
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("unmarshal verify result from chain %s: %w", dstChainID, err)
+	}
+	payload, err := json.Marshal(signed.Result)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyPayload(publicKey, payload, signed.SigR, signed.SigS); err != nil {
+		return nil, fmt.Errorf("verify result from chain %s: %w", dstChainID, err)
+	}
+
+	result := signed.Result
+	if result.ChainID != dstChainID || result.SrcChainID != ccRequest.SrcChainID {
+		return nil, fmt.Errorf("verify result between chain %s and chain %s, expecting %s and %s",
+			result.SrcChainID, result.ChainID, ccRequest.SrcChainID, dstChainID)
+	}
+	if result.RequestID != requestID {
+		return nil, fmt.Errorf("verify result for request %s, expecting %s", result.RequestID, requestID)
+	}
+	if result.Fpdm != ccRequest.Args[1] || result.Fphm != ccRequest.Args[2] {
+		return nil, fmt.Errorf("verify result for invoice %s%s, expecting %s%s", result.Fpdm, result.Fphm, ccRequest.Args[1], ccRequest.Args[2])
+	}
+	if result.QueryHash != VerifyQueryHash(ccRequest.Args[1], ccRequest.Args[2], ccRequest.Args[3], ccRequest.Args[4]) {
+		return nil, fmt.Errorf("verify result for another jym or amount of invoice %s%s", result.Fpdm, result.Fphm)
+	}
+	return data, nil
+}
+
+// 比对发票的代码、号码、校验码与金额，校验码可只提供后6位，金额按分比较
+func invoiceMatches(record Invoice, query Invoice) bool {
+	if record.Fpdm != query.Fpdm || record.Fphm != query.Fphm {
+		return false
+	}
+	if query.Jym == "" || !strings.HasSuffix(record.Jym, query.Jym) || (len(query.Jym) != len(record.Jym) && len(query.Jym) != 6) {
+		return false
+	}
+	recordAmount, err := ParseAmount(record.Amount)
+	if err != nil {
+		return false
+	}
+	queryAmount, err := ParseAmount(query.Amount)
+	if err != nil {
+		return false
+	}
+	return recordAmount == queryAmount
+}
@@ -0,0 +1,120 @@
+package broker_test
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/DXPlus/CrosschainContract/relayer"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// chainB登记chainA，业务链中有发票3100204130 12345678
+func newVerifyChain(t *testing.T) *relayer.MockChain {
+	chain, err := relayer.NewMockChain("chainB", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := chain.Invoke("registerChain", `{"chainID":"chainA"}`); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	chain.Business.MockTransactionStart("seed")
+	chain.Business.PutState("310020413012345678", []byte(`{"fphm":"12345678","fpdm":"3100204130","jym":"12345678901234567890","je":"100.00"}`))
+	chain.Business.MockTransactionEnd("seed")
+	return chain
+}
+
+var verifySeq int
+
+// 以creator的身份核验发票，返回核验结果
+func verify(t *testing.T, chain *relayer.MockChain, creator []byte, jym string) broker.VerifyResult {
+	t.Helper()
+	verifySeq++
+	resp := invokeAs(chain, creator, "interchainVerifyInvoice", "chainA", "chainB", "3100204130", "12345678", jym, "100.00",
+		"chainA-chainB-"+strconv.Itoa(verifySeq))
+	if resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	signed := broker.SignedVerifyResult{}
+	if err := json.Unmarshal(resp.Payload, &signed); err != nil {
+		t.Fatal(err)
+	}
+	if want := broker.VerifyQueryHash("3100204130", "12345678", jym, "100.00"); signed.Result.QueryHash != want {
+		t.Fatalf("query hash is %s, expecting %s", signed.Result.QueryHash, want)
+	}
+	return signed.Result
+}
+
+func TestVerifyInvoiceRequiresRegisteredCaller(t *testing.T) {
+	chain := newVerifyChain(t)
+	outsider, err := relayer.MockIdentity("Org4MSP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := invokeAs(chain, outsider, "interchainVerifyInvoice", "chainA", "chainB", "3100204130", "12345678", "567890", "100.00", "chainA-chainB-1")
+	if broker.ErrorCodeOf(resp.Message) != broker.CodeAccessDenied {
+		t.Fatalf("outsider returned %d %q", resp.Status, resp.Message)
+	}
+
+	// 经interchainBatchDeliver投递同样校验调用者
+	msgs := `[{"srcChainID":"chainA","dstChainID":"chainB","index":1,"func":"interchainVerifyInvoice",` +
+		`"args":["3100204130","12345678","567890","100.00","chainA-chainB-1"]}]`
+	resp = invokeAs(chain, outsider, "interchainBatchDeliver", msgs)
+	results := make([]broker.DeliverResult, 0)
+	if err := json.Unmarshal(resp.Payload, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || broker.ErrorCodeOf(results[0].Message) != broker.CodeAccessDenied {
+		t.Fatalf("batch delivery by an outsider returned %+v", results)
+	}
+
+	// 管理员组织与来源链的中继可以核验
+	if result := verify(t, chain, chain.Admin, "567890"); !result.Match {
+		t.Fatalf("admin verification returned %+v", result)
+	}
+	relayerCreator, err := relayer.MockIdentity("Org2MSP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := string(invokeAs(chain, relayerCreator, "getRelayerID").Payload)
+	quorum, err := json.Marshal(broker.RelayerQuorum{Relayers: []string{id}, Threshold: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := chain.Invoke("setRelayers", "chainA", string(quorum)); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	if result := verify(t, chain, relayerCreator, "567890"); !result.Match {
+		t.Fatalf("relayer verification returned %+v", result)
+	}
+}
+
+func TestVerifyInvoiceLocksAfterFailures(t *testing.T) {
+	chain := newVerifyChain(t)
+
+	// 一致的核验清零失败次数
+	for i := 0; i < 4; i++ {
+		verify(t, chain, chain.Admin, "000000")
+	}
+	if result := verify(t, chain, chain.Admin, "567890"); !result.Match {
+		t.Fatalf("verification after 4 failures returned %+v", result)
+	}
+
+	for i := 0; i < 5; i++ {
+		if result := verify(t, chain, chain.Admin, strconv.Itoa(100000+i)); result.Match || result.Locked {
+			t.Fatalf("failure %d returned %+v", i, result)
+		}
+	}
+	// 达到上限后正确的校验码同样不一致
+	if result := verify(t, chain, chain.Admin, "567890"); result.Match || !result.Locked {
+		t.Fatalf("verification of a locked invoice returned %+v", result)
+	}
+
+	if resp := chain.Invoke("resetVerifyFailures", "chainA", "3100204130", "12345678"); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	if result := verify(t, chain, chain.Admin, "567890"); !result.Match || result.Locked {
+		t.Fatalf("verification after reset returned %+v", result)
+	}
+}
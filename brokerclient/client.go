@@ -0,0 +1,119 @@
+/*-------------------------------------------*/
+/*        业务合约调用跨链合约的客户端 client.go   */
+/*-------------------------------------------*/
+
+// Package brokerclient 供业务链合约通过stub.InvokeChaincode调用跨链合约，
+// 免去手工拼装README中的参数数组。
+package brokerclient
+
+import (
+	"encoding/json"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const (
+	DefaultChaincodeName = "broker"    // 跨链合约的默认链码名称
+	DefaultChannelName   = "mychannel" // 跨链合约的默认通道名称
+)
+
+// 跨链调用选项，Mode取值为broker.InvokeModeSync或broker.InvokeModeAsync
+type InvokeOptions = broker.InvokeOptions
+
+// 多链归集结果
+type MultiQueryResult = broker.MultiQueryResult
+
+// 跨链合约客户端
+type Client struct {
+	ChaincodeName string // 跨链合约的链码名称
+	ChannelName   string // 跨链合约所在通道，为空时与调用方相同
+}
+
+// 创建客户端
+func New(chaincodeName string, channelName string) *Client {
+	return &Client{
+		ChaincodeName: chaincodeName,
+		ChannelName:   channelName,
+	}
+}
+
+// 使用默认链码名称与通道创建客户端
+func NewDefault() *Client {
+	return New(DefaultChaincodeName, DefaultChannelName)
+}
+
+// 跨链单链查询，返回目的链的查询结果
+func (c *Client) SingleQuery(stub shim.ChaincodeStubInterface, dstChainID string, key string) ([]byte, error) {
+	return c.call(stub, "InterchainSingleQuery", dstChainID, key)
+}
+
+// 跨链多链查询，chains为空时发往所有支持多链查询的已注册链
+func (c *Client) MultiQuery(stub shim.ChaincodeStubInterface, queryBy string, queryKey string, chains []string) (*MultiQueryResult, error) {
+	args := []string{queryBy, queryKey}
+	if len(chains) > 0 {
+		v, err := json.Marshal(chains)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(v))
+	}
+
+	payload, err := c.call(stub, "InterchainMultiQuery", args...)
+	if err != nil {
+		return nil, err
+	}
+	result := &MultiQueryResult{}
+	if err := json.Unmarshal(payload, result); err != nil {
+		return nil, &Error{Code: CodeDecode, Message: err.Error()}
+	}
+	return result, nil
+}
+
+// 跨链单链写入
+func (c *Client) SingleModify(stub shim.ChaincodeStubInterface, dstChainID string, key string, value string) error {
+	_, err := c.call(stub, "InterchainSingleModify", dstChainID, key, value)
+	return err
+}
+
+// 跨链双链同步写入，key1/value1为本链数据，key2/value2为目的链数据
+func (c *Client) DoubleModify(stub shim.ChaincodeStubInterface, dstChainID string, key1 string, value1 string, key2 string, value2 string) error {
+	_, err := c.call(stub, "InterchainDoubleModify", dstChainID, key1, value1, key2, value2)
+	return err
+}
+
+// 通用跨链调用，同步调用返回目的链的结果，异步调用返回空
+func (c *Client) Invoke(stub shim.ChaincodeStubInterface, dstChainID string, dstService string, function string, args []string, opts InvokeOptions) ([]byte, error) {
+	if args == nil {
+		args = []string{}
+	}
+	argsData, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	optsData, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.call(stub, "InterchainInvoke", dstChainID, dstService, function, string(argsData), string(optsData))
+}
+
+// 调用跨链合约，非成功状态转换为Error
+func (c *Client) call(stub shim.ChaincodeStubInterface, function string, args ...string) ([]byte, error) {
+	b := toChaincodeArgs(append([]string{function}, args...)...)
+	response := stub.InvokeChaincode(c.ChaincodeName, b, c.ChannelName)
+	if response.Status != shim.OK {
+		return nil, newError(response.Status, response.Message)
+	}
+	return response.Payload, nil
+}
+
+// 将字符串参数转换为InvokeChaincode的参数
+func toChaincodeArgs(args ...string) [][]byte {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	return bargs
+}
@@ -0,0 +1,104 @@
+package brokerclient
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 通过Client调用跨链合约的业务合约，错误时返回错误码
+type invoiceChaincode struct {
+	client *Client
+}
+
+func (cc *invoiceChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (cc *invoiceChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	var payload []byte
+	var err error
+	switch function {
+	case "query":
+		payload, err = cc.client.SingleQuery(stub, args[0], args[1])
+	case "modify":
+		err = cc.client.SingleModify(stub, args[0], args[1], args[2])
+	case "invoke":
+		payload, err = cc.client.Invoke(stub, args[0], "", args[1], args[2:], InvokeOptions{Mode: "sync"})
+	}
+	if err != nil {
+		return shim.Error(string(CodeOf(err)))
+	}
+	return shim.Success(payload)
+}
+
+func newInvoiceStub(fake *FakeBroker) *shimtest.MockStub {
+	stub := shimtest.NewMockStub("invoicecc", &invoiceChaincode{client: NewDefault()})
+	stub.MockPeerChaincode(DefaultChaincodeName, shimtest.NewMockStub(DefaultChaincodeName, fake), DefaultChannelName)
+	return stub
+}
+
+func invoke(stub *shimtest.MockStub, args ...string) pb.Response {
+	b := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		b = append(b, []byte(arg))
+	}
+	return stub.MockInvoke("tx1", b)
+}
+
+func TestClientCallsBroker(t *testing.T) {
+	fake := NewFakeBroker()
+	fake.Respond("InterchainSingleQuery", shim.Success([]byte(`{"fphm":"12345678"}`)))
+	stub := newInvoiceStub(fake)
+
+	resp := invoke(stub, "query", "chainB", "k1")
+	if resp.Status != shim.OK || string(resp.Payload) != `{"fphm":"12345678"}` {
+		t.Fatalf("query returned %d %q %q", resp.Status, resp.Message, resp.Payload)
+	}
+	call, err := fake.LastCall("InterchainSingleQuery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(call.Args) != 2 || call.Args[0] != "chainB" || call.Args[1] != "k1" {
+		t.Fatalf("broker received %v", call.Args)
+	}
+
+	fake.Handle("InterchainInvoke", func(args []string) pb.Response {
+		if len(args) != 5 || args[2] != "audit" || args[3] != `["a","b"]` || args[4] != `{"mode":"sync"}` {
+			return shim.Error("incorrect number of arguments")
+		}
+		return shim.Success([]byte("done"))
+	})
+	if resp := invoke(stub, "invoke", "chainB", "audit", "a", "b"); string(resp.Payload) != "done" {
+		t.Fatalf("invoke returned %d %q", resp.Status, resp.Message)
+	}
+}
+
+func TestClientErrorCodes(t *testing.T) {
+	cases := []struct {
+		message string
+		code    Code
+	}{
+		{"[in-flight] invoice 310020413012345678 is being transferred to chain chainB", CodeInFlight},
+		{"[invalid-transition] invalid invoice transition issued -> reimbursed for 310020413012345678", CodeInvalidTransition},
+		{"[invalid-argument] incorrect number of arguments, expecting 3", CodeInvalidArgument},
+		{"[not-registered] chain not registered: chainC", CodeNotRegistered},
+		{"[access-denied] access denied: Org2MSP is not the admin MSP", CodeAccessDenied},
+		{"[transport] request to chain chainB timed out", CodeTransport},
+		{"invalid signature", CodeUnknown},
+		{"invoice has not timed out", CodeUnknown},
+		{"[no-such-code] something else", CodeUnknown},
+		{"something else", CodeUnknown},
+	}
+	for _, c := range cases {
+		fake := NewFakeBroker()
+		fake.Fail("InterchainSingleModify", c.message)
+		resp := invoke(newInvoiceStub(fake), "modify", "chainB", "k1", "v1")
+		if resp.Message != string(c.code) {
+			t.Errorf("%q: code %s, expecting %s", c.message, resp.Message, c.code)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*-------------------------------------------*/
+/*            跨链合约错误码 errors.go         */
+/*-------------------------------------------*/
+package brokerclient
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+)
+
+// 错误码
+type Code string
+
+const (
+	CodeUnknown           Code = "unknown"                    // 无法识别的错误
+	CodeInvalidArgument   Code = broker.CodeInvalidArgument   // 参数个数或格式错误
+	CodeNotInitialized    Code = broker.CodeNotInitialized    // 跨链合约未初始化或缺少配置
+	CodeNotRegistered     Code = broker.CodeNotRegistered     // 链、合约或公钥未注册
+	CodeInvalidTransition Code = broker.CodeInvalidTransition // 发票状态变更不合法
+	CodeInFlight          Code = broker.CodeInFlight          // 发票正在转移，不能修改
+	CodeWrongChain        Code = broker.CodeWrongChain        // 请求的目的链不是本链
+	CodeAccessDenied      Code = broker.CodeAccessDenied      // 调用者不是管理员组织
+	CodeTransport         Code = broker.CodeTransport         // 与PAPP通信失败
+	CodeChaincode         Code = broker.CodeChaincode         // 跨链合约调用业务合约失败
+	CodeDuplicate         Code = broker.CodeDuplicate         // 请求已处理过，如重复回调
+	CodeDecode            Code = "decode"                     // 无法解析跨链合约的返回
+)
+
+// 跨链合约使用的错误码
+var knownCodes = map[Code]bool{
+	CodeInvalidArgument:   true,
+	CodeNotInitialized:    true,
+	CodeNotRegistered:     true,
+	CodeInvalidTransition: true,
+	CodeInFlight:          true,
+	CodeWrongChain:        true,
+	CodeAccessDenied:      true,
+	CodeTransport:         true,
+	CodeChaincode:         true,
+	CodeDuplicate:         true,
+}
+
+// 跨链合约返回的错误
+type Error struct {
+	Code    Code   // 错误码
+	Status  int32  // 跨链合约返回的状态
+	Message string // 跨链合约返回的错误消息
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("broker error [%s]: %s", e.Code, e.Message)
+}
+
+// 根据跨链合约返回的状态与消息生成错误，错误码取自消息开头的"[错误码] "
+func newError(status int32, message string) *Error {
+	code := Code(broker.ErrorCodeOf(message))
+	if !knownCodes[code] {
+		code = CodeUnknown
+	}
+	return &Error{Code: code, Status: status, Message: message}
+}
+
+// 获取错误的错误码，非跨链合约错误返回CodeUnknown
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeUnknown
+}
+
+// 判断错误是否为指定错误码
+func IsCode(err error, code Code) bool {
+	return err != nil && CodeOf(err) == code
+}
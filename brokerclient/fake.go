@@ -0,0 +1,92 @@
+/*-------------------------------------------*/
+/*            单元测试用跨链合约 fake.go        */
+/*-------------------------------------------*/
+package brokerclient
+
+import (
+	"fmt"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 跨链合约收到的一次调用
+type Call struct {
+	Function string
+	Args     []string
+}
+
+// 业务合约单元测试中代替跨链合约的链码，记录收到的调用并返回预设结果
+//
+//	fake := brokerclient.NewFakeBroker()
+//	fake.Respond("InterchainSingleQuery", shim.Success([]byte(`{"fphm":"12345678"}`)))
+//	brokerStub := shimtest.NewMockStub("broker", fake)
+//	stub := shimtest.NewMockStub("invoicecc", new(InvoiceChaincode))
+//	stub.MockPeerChaincode("broker", brokerStub, "mychannel")
+type FakeBroker struct {
+	Calls     []Call                                // 按顺序记录的调用
+	Responses map[string]pb.Response                // 按函数名预设的返回
+	Handlers  map[string]func([]string) pb.Response // 按函数名预设的处理函数，优先于Responses
+}
+
+// 创建FakeBroker，未预设的函数返回成功
+func NewFakeBroker() *FakeBroker {
+	return &FakeBroker{
+		Calls:     make([]Call, 0),
+		Responses: make(map[string]pb.Response),
+		Handlers:  make(map[string]func([]string) pb.Response),
+	}
+}
+
+// 预设函数的返回
+func (f *FakeBroker) Respond(function string, response pb.Response) {
+	f.Responses[function] = response
+}
+
+// 预设函数返回错误，错误消息须与真实跨链合约一致，即以"[错误码] "开头
+func (f *FakeBroker) Fail(function string, message string) {
+	f.Responses[function] = shim.Error(message)
+}
+
+// 预设函数返回带错误码的错误
+func (f *FakeBroker) FailCode(function string, code Code, message string) {
+	f.Fail(function, broker.FormatError(string(code), message))
+}
+
+// 预设函数的处理函数
+func (f *FakeBroker) Handle(function string, handler func([]string) pb.Response) {
+	f.Handlers[function] = handler
+}
+
+// 最近一次调用指定函数的参数
+func (f *FakeBroker) LastCall(function string) (Call, error) {
+	for i := len(f.Calls) - 1; i >= 0; i-- {
+		if f.Calls[i].Function == function {
+			return f.Calls[i], nil
+		}
+	}
+	return Call{}, fmt.Errorf("%s was not called", function)
+}
+
+// 清空调用记录
+func (f *FakeBroker) Reset() {
+	f.Calls = f.Calls[:0]
+}
+
+func (f *FakeBroker) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (f *FakeBroker) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	f.Calls = append(f.Calls, Call{Function: function, Args: args})
+
+	if handler, ok := f.Handlers[function]; ok {
+		return handler(args)
+	}
+	if response, ok := f.Responses[function]; ok {
+		return response
+	}
+	return shim.Success(nil)
+}
@@ -0,0 +1,43 @@
+/*-------------------------------------------*/
+/*            跨链合约启动入口 main.go          */
+/*-------------------------------------------*/
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// 通过环境变量配置本链业务合约，未设置时使用默认值
+//
+//	BROKER_CHAINCODE_ID  本链业务合约的链码名称
+//	BROKER_CHANNEL_ID    本链业务合约所在通道
+//	BROKER_MODE          为server时以外部链码服务方式运行，否则由peer管理链码容器
+func main() {
+	config := broker.Config{
+		ChaincodeID: os.Getenv("BROKER_CHAINCODE_ID"),
+		ChannelID:   os.Getenv("BROKER_CHANNEL_ID"),
+	}
+	cc := broker.New(config)
+
+	if os.Getenv("BROKER_MODE") != "server" {
+		err := shim.Start(cc)
+		if err != nil {
+			fmt.Printf("Error starting chaincode: %s .....", err)
+		}
+		return
+	}
+
+	serverConfig, err := serverConfigFromEnv()
+	if err != nil {
+		fmt.Printf("Error loading chaincode server config: %s\n", err)
+		os.Exit(1)
+	}
+	if err := runServer(cc, serverConfig); err != nil {
+		fmt.Printf("Error running chaincode server: %s\n", err)
+		os.Exit(1)
+	}
+}
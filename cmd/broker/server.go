@@ -0,0 +1,180 @@
+/*-------------------------------------------*/
+/*          外部链码服务模式 server.go          */
+/*-------------------------------------------*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 停机时等待处理中调用完成的默认时长
+const defaultShutdownTimeout = 30 * time.Second
+
+// 外部链码服务配置
+type serverConfig struct {
+	CCID            string             // 链码包ID，需与peer上安装的链码包一致
+	Address         string             // 监听地址，如0.0.0.0:9999
+	TLSProps        shim.TLSProperties // TLS证书与私钥，配置客户端CA时校验peer证书
+	ShutdownTimeout time.Duration      // 停机时等待处理中调用完成的时长
+}
+
+// 从环境变量读取外部链码服务配置
+//
+//	CHAINCODE_ID              链码包ID
+//	CHAINCODE_SERVER_ADDRESS  监听地址
+//	CHAINCODE_TLS_DISABLED    为true时不启用TLS
+//	CHAINCODE_TLS_KEY         TLS私钥文件
+//	CHAINCODE_TLS_CERT        TLS证书文件
+//	CHAINCODE_CLIENT_CA_CERT  peer客户端证书的CA文件，设置后启用双向TLS
+//	BROKER_SHUTDOWN_TIMEOUT   停机时等待处理中调用完成的秒数
+func serverConfigFromEnv() (serverConfig, error) {
+	config := serverConfig{
+		CCID:            os.Getenv("CHAINCODE_ID"),
+		Address:         os.Getenv("CHAINCODE_SERVER_ADDRESS"),
+		ShutdownTimeout: defaultShutdownTimeout,
+	}
+	if config.CCID == "" {
+		return serverConfig{}, fmt.Errorf("CHAINCODE_ID must be set")
+	}
+	if config.Address == "" {
+		return serverConfig{}, fmt.Errorf("CHAINCODE_SERVER_ADDRESS must be set")
+	}
+
+	if v := os.Getenv("BROKER_SHUTDOWN_TIMEOUT"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			return serverConfig{}, fmt.Errorf("invalid BROKER_SHUTDOWN_TIMEOUT: %s", v)
+		}
+		config.ShutdownTimeout = time.Duration(seconds) * time.Second
+	}
+
+	if disabled, _ := strconv.ParseBool(os.Getenv("CHAINCODE_TLS_DISABLED")); disabled {
+		config.TLSProps.Disabled = true
+		return config, nil
+	}
+
+	var err error
+	if config.TLSProps.Key, err = readFileEnv("CHAINCODE_TLS_KEY", true); err != nil {
+		return serverConfig{}, err
+	}
+	if config.TLSProps.Cert, err = readFileEnv("CHAINCODE_TLS_CERT", true); err != nil {
+		return serverConfig{}, err
+	}
+	if config.TLSProps.ClientCACerts, err = readFileEnv("CHAINCODE_CLIENT_CA_CERT", false); err != nil {
+		return serverConfig{}, err
+	}
+	return config, nil
+}
+
+// 读取环境变量指定的文件，未设置且非必需时返回nil
+func readFileEnv(name string, required bool) ([]byte, error) {
+	path := os.Getenv(name)
+	if path == "" {
+		if required {
+			return nil, fmt.Errorf("%s must be set when TLS is enabled", name)
+		}
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// 以外部链码服务方式运行，收到SIGINT或SIGTERM后不再接受新调用，
+// 等待处理中的调用完成或超时后退出
+func runServer(cc shim.Chaincode, config serverConfig) error {
+	draining := &drainingChaincode{cc: cc}
+	server := &shim.ChaincodeServer{
+		CCID:     config.CCID,
+		Address:  config.Address,
+		CC:       draining,
+		TLSProps: config.TLSProps,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Start()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-sigCh:
+		fmt.Printf("received %s, draining in-flight calls\n", sig)
+		if !draining.drain(config.ShutdownTimeout) {
+			return fmt.Errorf("shutdown timed out after %s with calls still in flight", config.ShutdownTimeout)
+		}
+		return nil
+	}
+}
+
+// 记录处理中调用的链码包装，停机后拒绝新调用
+type drainingChaincode struct {
+	cc       shim.Chaincode
+	mu       sync.Mutex
+	closing  bool
+	inflight sync.WaitGroup
+}
+
+func (d *drainingChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	if !d.enter() {
+		return shim.Error("broker is shutting down")
+	}
+	defer d.inflight.Done()
+	return d.cc.Init(stub)
+}
+
+func (d *drainingChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	if !d.enter() {
+		return shim.Error("broker is shutting down")
+	}
+	defer d.inflight.Done()
+	return d.cc.Invoke(stub)
+}
+
+// 登记一次调用，停机后返回false
+func (d *drainingChaincode) enter() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closing {
+		return false
+	}
+	d.inflight.Add(1)
+	return true
+}
+
+// 停止接受新调用并等待处理中的调用完成，超时返回false
+func (d *drainingChaincode) drain(timeout time.Duration) bool {
+	d.mu.Lock()
+	d.closing = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,141 @@
+/*-------------------------------------------*/
+/*            跨链事件ABI解码 abi.go           */
+/*-------------------------------------------*/
+package evm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 来源链跨链合约发出跨链请求时触发的事件，参数均不带indexed
+//
+//	event InterchainRequest(string dstChainID, uint64 index, string dstService, string func, string[] args, string callback);
+const InterchainEventSignature = "InterchainRequest(string,uint64,string,string,string[],string)"
+
+// 跨链事件的Topics[0]
+var InterchainEventTopic = Keccak256([]byte(InterchainEventSignature))
+
+// 跨链事件的参数
+type InterchainEvent struct {
+	DstChainID string
+	Index      uint64
+	DstService string
+	Func       string
+	Args       []string
+	Callback   string
+}
+
+// 解码跨链事件的Data
+func DecodeInterchainEvent(data []byte) (InterchainEvent, error) {
+	d := abiData(data)
+	ev := InterchainEvent{}
+	var err error
+	if ev.DstChainID, err = d.stringAt(0); err != nil {
+		return InterchainEvent{}, err
+	}
+	if ev.Index, err = d.uint(32); err != nil {
+		return InterchainEvent{}, err
+	}
+	if ev.DstService, err = d.stringAt(64); err != nil {
+		return InterchainEvent{}, err
+	}
+	if ev.Func, err = d.stringAt(96); err != nil {
+		return InterchainEvent{}, err
+	}
+	if ev.Args, err = d.stringArrayAt(128); err != nil {
+		return InterchainEvent{}, err
+	}
+	if ev.Callback, err = d.stringAt(160); err != nil {
+		return InterchainEvent{}, err
+	}
+	return ev, nil
+}
+
+// ABI编码的数据，动态类型以相对于所在元组开头的偏移量引用
+type abiData []byte
+
+// 读取pos处的32字节
+func (d abiData) word(pos int) ([]byte, error) {
+	if pos < 0 || pos+32 > len(d) || pos+32 < pos {
+		return nil, fmt.Errorf("abi: data too short")
+	}
+	return d[pos : pos+32], nil
+}
+
+// 读取pos处不超过uint64的整数
+func (d abiData) uint(pos int) (uint64, error) {
+	w, err := d.word(pos)
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range w[:24] {
+		if b != 0 {
+			return 0, fmt.Errorf("abi: integer overflows uint64")
+		}
+	}
+	return binary.BigEndian.Uint64(w[24:]), nil
+}
+
+// 读取pos处的长度或偏移量
+func (d abiData) size(pos int) (int, error) {
+	n, err := d.uint(pos)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d)) {
+		return 0, fmt.Errorf("abi: offset out of range")
+	}
+	return int(n), nil
+}
+
+// 读取base处的string：长度后为内容
+func (d abiData) str(base int) (string, error) {
+	n, err := d.size(base)
+	if err != nil {
+		return "", err
+	}
+	start := base + 32
+	if start+n > len(d) {
+		return "", fmt.Errorf("abi: string exceeds data")
+	}
+	return string(d[start : start+n]), nil
+}
+
+// 读取头部pos处偏移量指向的string
+func (d abiData) stringAt(pos int) (string, error) {
+	offset, err := d.size(pos)
+	if err != nil {
+		return "", err
+	}
+	return d.str(offset)
+}
+
+// 读取头部pos处偏移量指向的string[]：长度后为各元素的偏移量，偏移量相对于长度之后的位置
+func (d abiData) stringArrayAt(pos int) ([]string, error) {
+	offset, err := d.size(pos)
+	if err != nil {
+		return nil, err
+	}
+	n, err := d.size(offset)
+	if err != nil {
+		return nil, err
+	}
+	base := offset + 32
+	if n > (len(d)-base)/32 {
+		return nil, fmt.Errorf("abi: array exceeds data")
+	}
+	values := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		elem, err := d.size(base + 32*i)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.str(base + elem)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
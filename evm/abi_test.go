@@ -0,0 +1,70 @@
+package evm
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 按Solidity ABI规范逐字编写的跨链事件Data：
+// InterchainRequest("chainB", 7, "", "interchainSet", ["k1", "v1"], "")
+const interchainEventData = "" +
+	"00000000000000000000000000000000000000000000000000000000000000c0" + // dstChainID的偏移
+	"0000000000000000000000000000000000000000000000000000000000000007" + // index
+	"0000000000000000000000000000000000000000000000000000000000000100" + // dstService的偏移
+	"0000000000000000000000000000000000000000000000000000000000000120" + // func的偏移
+	"0000000000000000000000000000000000000000000000000000000000000160" + // args的偏移
+	"0000000000000000000000000000000000000000000000000000000000000240" + // callback的偏移
+	"0000000000000000000000000000000000000000000000000000000000000006" + // dstChainID
+	"636861696e420000000000000000000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" + // dstService
+	"000000000000000000000000000000000000000000000000000000000000000d" + // func
+	"696e746572636861696e53657400000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000002" + // args的长度
+	"0000000000000000000000000000000000000000000000000000000000000040" + // args[0]的偏移，相对于长度之后
+	"0000000000000000000000000000000000000000000000000000000000000080" + // args[1]的偏移
+	"0000000000000000000000000000000000000000000000000000000000000002" +
+	"6b31000000000000000000000000000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000002" +
+	"7631000000000000000000000000000000000000000000000000000000000000" +
+	"0000000000000000000000000000000000000000000000000000000000000000" // callback
+
+func TestDecodeInterchainEvent(t *testing.T) {
+	ev, err := DecodeInterchainEvent(mustHex(t, interchainEventData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InterchainEvent{DstChainID: "chainB", Index: 7, Func: "interchainSet", Args: []string{"k1", "v1"}}
+	if !reflect.DeepEqual(ev, want) {
+		t.Fatalf("event decoded as %+v", ev)
+	}
+	if got := hex.EncodeToString(InterchainEventTopic); got != hex.EncodeToString(Keccak256([]byte("InterchainRequest(string,uint64,string,string,string[],string)"))) {
+		t.Fatalf("event topic is %s", got)
+	}
+}
+
+func TestDecodeInterchainEventRejectsMalformed(t *testing.T) {
+	data := mustHex(t, interchainEventData)
+	if len(data) != 19*32 {
+		t.Fatalf("event data is %d bytes", len(data))
+	}
+
+	for name, tamper := range map[string]func([]byte){
+		"truncated":         func(d []byte) {},
+		"index overflow":    func(d []byte) { d[32+23] = 1 },
+		"offset past data":  func(d []byte) { d[30] = 0xff },
+		"string past data":  func(d []byte) { d[32*6+30] = 0x10 },
+		"array past data":   func(d []byte) { d[32*11+31] = 0xff },
+		"element past data": func(d []byte) { d[32*12+30] = 0x10 },
+	} {
+		d := append([]byte(nil), data...)
+		if name == "truncated" {
+			d = d[:len(d)-32]
+		}
+		tamper(d)
+		if _, err := DecodeInterchainEvent(d); err == nil || !strings.HasPrefix(err.Error(), "abi:") {
+			t.Fatalf("%s data returned %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*-------------------------------------------*/
+/*            区块头与交易回执 receipt.go      */
+/*-------------------------------------------*/
+package evm
+
+import (
+	"fmt"
+)
+
+// 区块头中校验回执所需的字段
+type Header struct {
+	Hash         []byte // 区块哈希，即区块头编码的keccak256
+	Number       uint64 // 区块高度
+	ReceiptsRoot []byte // 回执树的根
+}
+
+// 交易回执中的日志
+type Log struct {
+	Address []byte   // 产生日志的合约地址
+	Topics  [][]byte // 日志主题，Topics[0]为事件签名的哈希
+	Data    []byte   // 非indexed参数的ABI编码
+}
+
+// 交易回执
+type Receipt struct {
+	Status uint64 // 1为执行成功
+	Logs   []Log
+}
+
+// 解析RLP编码的区块头
+func DecodeHeader(raw []byte) (Header, error) {
+	item, err := Decode(raw)
+	if err != nil {
+		return Header{}, err
+	}
+	// parentHash, uncleHash, coinbase, stateRoot, txRoot, receiptsRoot, bloom, difficulty, number, ...
+	if !item.List || len(item.Items) < 15 {
+		return Header{}, fmt.Errorf("header: malformed header")
+	}
+	if len(item.Items[5].Bytes) != 32 {
+		return Header{}, fmt.Errorf("header: malformed receipts root")
+	}
+	number, err := item.Items[8].Uint()
+	if err != nil {
+		return Header{}, fmt.Errorf("header: malformed number: %w", err)
+	}
+	return Header{
+		Hash:         Keccak256(raw),
+		Number:       number,
+		ReceiptsRoot: item.Items[5].Bytes,
+	}, nil
+}
+
+// 解析回执树中的回执，支持EIP-2718类型化回执；不支持拜占庭分叉前以状态根代替状态码的回执
+func DecodeReceipt(raw []byte) (Receipt, error) {
+	if len(raw) > 0 && raw[0] < 0x80 {
+		// 类型化回执：类型字节后为RLP编码的回执
+		raw = raw[1:]
+	}
+	item, err := Decode(raw)
+	if err != nil {
+		return Receipt{}, err
+	}
+	// status, cumulativeGasUsed, logsBloom, logs
+	if !item.List || len(item.Items) != 4 || !item.Items[3].List {
+		return Receipt{}, fmt.Errorf("receipt: malformed receipt")
+	}
+	if len(item.Items[0].Bytes) > 1 {
+		return Receipt{}, fmt.Errorf("receipt: pre-Byzantium receipts are not supported")
+	}
+	status, err := item.Items[0].Uint()
+	if err != nil {
+		return Receipt{}, fmt.Errorf("receipt: malformed status: %w", err)
+	}
+
+	receipt := Receipt{Status: status}
+	for _, l := range item.Items[3].Items {
+		// address, topics, data
+		if !l.List || len(l.Items) != 3 || len(l.Items[0].Bytes) != 20 || !l.Items[1].List || l.Items[2].List {
+			return Receipt{}, fmt.Errorf("receipt: malformed log")
+		}
+		log := Log{Address: l.Items[0].Bytes, Data: l.Items[2].Bytes}
+		for _, topic := range l.Items[1].Items {
+			if len(topic.Bytes) != 32 {
+				return Receipt{}, fmt.Errorf("receipt: malformed topic")
+			}
+			log.Topics = append(log.Topics, topic.Bytes)
+		}
+		receipt.Logs = append(receipt.Logs, log)
+	}
+	return receipt, nil
+}
@@ -0,0 +1,101 @@
+package evm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// 以太坊主网创世区块的区块头
+func TestDecodeMainnetGenesisHeader(t *testing.T) {
+	emptyRoot := mustHex(t, "56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+	raw := encodeList(
+		encodeString(make([]byte, 32)), // parentHash
+		encodeString(mustHex(t, "1dcc4de8dec75d7aab85b567b6ccd41ad312451b948a7413f0a142fd40d49347")), // uncleHash
+		encodeString(make([]byte, 20)), // coinbase
+		encodeString(mustHex(t, "d7f8974fb5ac78d9ac099b9ad5018bedc2ce0a72dad1827a1709da30580f0544")), // stateRoot
+		encodeString(emptyRoot),                // txRoot
+		encodeString(emptyRoot),                // receiptsRoot
+		encodeString(make([]byte, 256)),        // logsBloom
+		encodeString(mustHex(t, "0400000000")), // difficulty
+		EncodeUint(0),                          // number
+		EncodeUint(5000),                       // gasLimit
+		EncodeUint(0),                          // gasUsed
+		EncodeUint(0),                          // timestamp
+		encodeString(mustHex(t, "11bbe8db4e347b4e8c937c1c8370e4b5ed33adb3db69cbdb7a38e1e50b1b82fa")), // extraData
+		encodeString(make([]byte, 32)),               // mixHash
+		encodeString(mustHex(t, "0000000000000042")), // nonce
+	)
+
+	header, err := DecodeHeader(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(header.Hash); got != "d4e56740f876aef8c010b86a40d5f56745a118d0906a34e69aec8c0db1cb8fa3" {
+		t.Fatalf("genesis hash is %s", got)
+	}
+	if header.Number != 0 || !bytes.Equal(header.ReceiptsRoot, emptyRoot) {
+		t.Fatalf("genesis header decoded as %+v", header)
+	}
+
+	if _, err := DecodeHeader(encodeList(encodeString(make([]byte, 32)))); err == nil {
+		t.Fatal("truncated header decoded without error")
+	}
+}
+
+// 回执的RLP编码：status, cumulativeGasUsed, logsBloom, logs
+func encodeReceipt(status uint64, logs ...[]byte) []byte {
+	return encodeList(EncodeUint(status), EncodeUint(21000), encodeString(make([]byte, 256)), encodeList(logs...))
+}
+
+func encodeLog(address []byte, topics [][]byte, data []byte) []byte {
+	encoded := make([][]byte, 0, len(topics))
+	for _, topic := range topics {
+		encoded = append(encoded, encodeString(topic))
+	}
+	return encodeList(encodeString(address), encodeList(encoded...), encodeString(data))
+}
+
+func TestDecodeReceipt(t *testing.T) {
+	address := mustHex(t, "a0b86991c6218b36c1d19d4a2e9eb0ce3606eb48")
+	transfer := Keccak256([]byte("Transfer(address,address,uint256)"))
+	from, to := make([]byte, 32), make([]byte, 32)
+	to[31] = 1
+	amount := make([]byte, 32)
+	amount[31] = 100
+	raw := encodeReceipt(1, encodeLog(address, [][]byte{transfer, from, to}, amount))
+
+	// 旧式回执与EIP-1559类型化回执
+	for _, enc := range [][]byte{raw, append([]byte{0x02}, raw...)} {
+		receipt, err := DecodeReceipt(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Status != 1 || len(receipt.Logs) != 1 {
+			t.Fatalf("receipt decoded as %+v", receipt)
+		}
+		log := receipt.Logs[0]
+		if !bytes.Equal(log.Address, address) || len(log.Topics) != 3 || !bytes.Equal(log.Topics[0], transfer) || !bytes.Equal(log.Data, amount) {
+			t.Fatalf("log decoded as %+v", log)
+		}
+	}
+
+	// 失败的交易
+	if receipt, err := DecodeReceipt(encodeReceipt(0)); err != nil || receipt.Status != 0 {
+		t.Fatalf("failed receipt decoded as %+v, %v", receipt, err)
+	}
+}
+
+func TestDecodeReceiptRejectsMalformed(t *testing.T) {
+	address := make([]byte, 20)
+	for name, raw := range map[string][]byte{
+		"pre-Byzantium": encodeList(encodeString(make([]byte, 32)), EncodeUint(21000), encodeString(make([]byte, 256)), encodeList()),
+		"short address": encodeReceipt(1, encodeLog(address[:19], nil, nil)),
+		"short topic":   encodeReceipt(1, encodeLog(address, [][]byte{make([]byte, 31)}, nil)),
+		"missing logs":  encodeList(EncodeUint(1), EncodeUint(21000), encodeString(make([]byte, 256))),
+	} {
+		if _, err := DecodeReceipt(raw); err == nil {
+			t.Fatalf("%s receipt decoded without error", name)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*-------------------------------------------*/
+/*            RLP解码 rlp.go                  */
+/*-------------------------------------------*/
+
+// Package evm 校验以太坊兼容链的跨链事件：RLP解码、区块头与交易回执解析、
+// 回执树的Merkle Patricia证明校验以及跨链事件的ABI解码。
+package evm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// RLP编码的字符串或列表
+type Item struct {
+	List  bool   // 是否为列表
+	Bytes []byte // 字符串的内容
+	Items []Item // 列表的元素
+	Raw   []byte // 完整编码
+}
+
+// 解码一个RLP元素，输入必须恰好为一个完整的元素
+func Decode(b []byte) (Item, error) {
+	item, n, err := decodeItem(b)
+	if err != nil {
+		return Item{}, err
+	}
+	if n != len(b) {
+		return Item{}, fmt.Errorf("rlp: %d trailing bytes", len(b)-n)
+	}
+	return item, nil
+}
+
+// 解码b开头的RLP元素，返回元素及其编码长度
+func decodeItem(b []byte) (Item, int, error) {
+	if len(b) == 0 {
+		return Item{}, 0, fmt.Errorf("rlp: unexpected end of input")
+	}
+	prefix := b[0]
+	var list bool
+	var offset, size int
+	switch {
+	case prefix < 0x80:
+		return Item{Bytes: b[:1], Raw: b[:1]}, 1, nil
+	case prefix <= 0xb7:
+		offset, size = 1, int(prefix-0x80)
+	case prefix <= 0xbf:
+		n, err := decodeSize(b, int(prefix-0xb7))
+		if err != nil {
+			return Item{}, 0, err
+		}
+		offset, size = 1+int(prefix-0xb7), n
+	case prefix <= 0xf7:
+		list, offset, size = true, 1, int(prefix-0xc0)
+	default:
+		n, err := decodeSize(b, int(prefix-0xf7))
+		if err != nil {
+			return Item{}, 0, err
+		}
+		list, offset, size = true, 1+int(prefix-0xf7), n
+	}
+	if size < 0 || offset+size > len(b) || offset+size < offset {
+		return Item{}, 0, fmt.Errorf("rlp: element exceeds input")
+	}
+
+	end := offset + size
+	item := Item{List: list, Raw: b[:end]}
+	if !list {
+		item.Bytes = b[offset:end]
+		return item, end, nil
+	}
+	for pos := offset; pos < end; {
+		child, n, err := decodeItem(b[pos:end])
+		if err != nil {
+			return Item{}, 0, err
+		}
+		item.Items = append(item.Items, child)
+		pos += n
+	}
+	return item, end, nil
+}
+
+// 读取长编码中lenOfLen字节的长度
+func decodeSize(b []byte, lenOfLen int) (int, error) {
+	if lenOfLen > 8 || 1+lenOfLen > len(b) {
+		return 0, fmt.Errorf("rlp: invalid length prefix")
+	}
+	var buf [8]byte
+	copy(buf[8-lenOfLen:], b[1:1+lenOfLen])
+	n := binary.BigEndian.Uint64(buf[:])
+	if n > uint64(len(b)) {
+		return 0, fmt.Errorf("rlp: element exceeds input")
+	}
+	return int(n), nil
+}
+
+// 按大端整数解析字符串
+func (item Item) Uint() (uint64, error) {
+	if item.List || len(item.Bytes) > 8 {
+		return 0, fmt.Errorf("rlp: not an unsigned integer")
+	}
+	var buf [8]byte
+	copy(buf[8-len(item.Bytes):], item.Bytes)
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// 整数的RLP编码，回执树以交易序号的编码为key
+func EncodeUint(i uint64) []byte {
+	if i == 0 {
+		return []byte{0x80}
+	}
+	if i < 0x80 {
+		return []byte{byte(i)}
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], i)
+	n := 0
+	for buf[n] == 0 {
+		n++
+	}
+	return append([]byte{0x80 + byte(8-n)}, buf[n:]...)
+}
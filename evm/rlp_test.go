@@ -0,0 +1,112 @@
+package evm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// 测试用的RLP编码
+func encodeString(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return b
+	}
+	return append(encodeLength(len(b), 0x80), b...)
+}
+
+func encodeList(items ...[]byte) []byte {
+	payload := bytes.Join(items, nil)
+	return append(encodeLength(len(payload), 0xc0), payload...)
+}
+
+func encodeLength(n int, offset byte) []byte {
+	if n <= 55 {
+		return []byte{offset + byte(n)}
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n))
+	i := 0
+	for buf[i] == 0 {
+		i++
+	}
+	return append([]byte{offset + 55 + byte(8-i)}, buf[i:]...)
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RLP规范中的示例
+func TestDecodeSpecVectors(t *testing.T) {
+	dog := mustHex(t, "83646f67")
+	item, err := Decode(dog)
+	if err != nil || item.List || string(item.Bytes) != "dog" {
+		t.Fatalf("dog decoded as %+v, %v", item, err)
+	}
+
+	item, err = Decode(mustHex(t, "c88363617483646f67"))
+	if err != nil || !item.List || len(item.Items) != 2 || string(item.Items[0].Bytes) != "cat" || string(item.Items[1].Bytes) != "dog" {
+		t.Fatalf("[cat, dog] decoded as %+v, %v", item, err)
+	}
+
+	// 集合论表示 [ [], [[]], [ [], [[]] ] ]
+	item, err = Decode(mustHex(t, "c7c0c1c0c3c0c1c0"))
+	if err != nil || len(item.Items) != 3 || len(item.Items[1].Items) != 1 || len(item.Items[2].Items[1].Items) != 1 {
+		t.Fatalf("set representation decoded as %+v, %v", item, err)
+	}
+
+	lorem := "Lorem ipsum dolor sit amet, consectetur adipisicing elit"
+	item, err = Decode(append(mustHex(t, "b838"), lorem...))
+	if err != nil || string(item.Bytes) != lorem {
+		t.Fatalf("long string decoded as %+v, %v", item, err)
+	}
+
+	for _, c := range []struct {
+		enc  string
+		want uint64
+	}{{"80", 0}, {"0f", 15}, {"820400", 1024}} {
+		item, err := Decode(mustHex(t, c.enc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := item.Uint(); err != nil || n != c.want {
+			t.Fatalf("%s decoded as %d, %v", c.enc, n, err)
+		}
+		if got := hex.EncodeToString(EncodeUint(c.want)); got != c.enc {
+			t.Fatalf("%d encoded as %s, expecting %s", c.want, got, c.enc)
+		}
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	for _, enc := range []string{
+		"",                   // 空输入
+		"83646f",             // 字符串超出输入
+		"c88363617483646f",   // 列表超出输入
+		"83646f6700",         // 多余的字节
+		"b9ffff",             // 长度超出输入
+		"c3836361",           // 列表内元素超出列表
+		"bfffffffffffffffff", // 长度溢出
+	} {
+		if _, err := Decode(mustHex(t, enc)); err == nil {
+			t.Fatalf("%s decoded without error", enc)
+		}
+	}
+}
+
+func TestKeccak256Vectors(t *testing.T) {
+	if got := hex.EncodeToString(Keccak256()); got != "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470" {
+		t.Fatalf("keccak256 of empty input is %s", got)
+	}
+	// ERC-20 Transfer事件的主题
+	if got := hex.EncodeToString(Keccak256([]byte("Transfer(address,address,uint256)"))); got != "ddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef" {
+		t.Fatalf("Transfer topic is %s", got)
+	}
+}
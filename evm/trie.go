@@ -0,0 +1,128 @@
+/*-------------------------------------------*/
+/*            Merkle Patricia证明 trie.go      */
+/*-------------------------------------------*/
+package evm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// keccak256哈希
+func Keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// 校验Merkle Patricia Trie的存在性证明，返回key对应的值
+// proof为从根节点到叶子节点路径上的节点编码，与eth_getProof等接口返回的格式相同
+func VerifyProof(root []byte, key []byte, proof [][]byte) ([]byte, error) {
+	nodes := make(map[string][]byte, len(proof))
+	for _, p := range proof {
+		nodes[hex.EncodeToString(Keccak256(p))] = p
+	}
+
+	// 根节点总是以哈希引用
+	node, err := loadNode(nodes, root)
+	if err != nil {
+		return nil, err
+	}
+	path := keyToNibbles(key)
+	for {
+		var child Item
+		switch len(node.Items) {
+		case 17:
+			// 分支节点
+			if len(path) == 0 {
+				if node.Items[16].List || len(node.Items[16].Bytes) == 0 {
+					return nil, fmt.Errorf("trie: key not found")
+				}
+				return node.Items[16].Bytes, nil
+			}
+			child = node.Items[path[0]]
+			path = path[1:]
+		case 2:
+			// 扩展节点或叶子节点
+			if node.Items[0].List {
+				return nil, fmt.Errorf("trie: malformed node")
+			}
+			nibbles, leaf, err := decodeHexPrefix(node.Items[0].Bytes)
+			if err != nil {
+				return nil, err
+			}
+			if len(path) < len(nibbles) || !bytes.Equal(path[:len(nibbles)], nibbles) {
+				return nil, fmt.Errorf("trie: key not found")
+			}
+			path = path[len(nibbles):]
+			if leaf {
+				if len(path) != 0 {
+					return nil, fmt.Errorf("trie: key not found")
+				}
+				return node.Items[1].Bytes, nil
+			}
+			child = node.Items[1]
+		default:
+			return nil, fmt.Errorf("trie: malformed node")
+		}
+
+		// 子节点编码不足32字节时直接嵌入父节点，否则以哈希引用
+		switch {
+		case child.List:
+			node = child
+		case len(child.Bytes) == 32:
+			if node, err = loadNode(nodes, child.Bytes); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("trie: key not found")
+		}
+	}
+}
+
+// 按哈希取出证明中的节点
+func loadNode(nodes map[string][]byte, hash []byte) (Item, error) {
+	raw, ok := nodes[hex.EncodeToString(hash)]
+	if !ok {
+		return Item{}, fmt.Errorf("trie: missing node %x in proof", hash)
+	}
+	node, err := Decode(raw)
+	if err != nil {
+		return Item{}, err
+	}
+	if !node.List {
+		return Item{}, fmt.Errorf("trie: malformed node")
+	}
+	return node, nil
+}
+
+// 将key拆分为半字节
+func keyToNibbles(key []byte) []byte {
+	nibbles := make([]byte, 0, len(key)*2)
+	for _, b := range key {
+		nibbles = append(nibbles, b>>4, b&0x0f)
+	}
+	return nibbles
+}
+
+// 解析Hex-Prefix编码的路径，返回半字节路径及是否为叶子节点
+func decodeHexPrefix(b []byte) ([]byte, bool, error) {
+	if len(b) == 0 {
+		return nil, false, fmt.Errorf("trie: empty path")
+	}
+	flag := b[0] >> 4
+	if flag > 3 {
+		return nil, false, fmt.Errorf("trie: invalid path prefix")
+	}
+	nibbles := keyToNibbles(b)[2:]
+	if flag&1 == 1 {
+		// 奇数长度，首字节的低半字节属于路径
+		nibbles = append([]byte{b[0] & 0x0f}, nibbles...)
+	}
+	return nibbles, flag&2 == 2, nil
+}
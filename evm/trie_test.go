@@ -0,0 +1,191 @@
+package evm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 测试用的Merkle Patricia Trie，由全部键值对一次性构建，同时收集某个key的证明
+type trieEntry struct {
+	path  []byte // 半字节路径
+	value []byte
+}
+
+// 构建trie，返回根哈希及target的证明
+func buildTrie(kvs map[string]string, target string) ([]byte, [][]byte) {
+	entries := make([]trieEntry, 0, len(kvs))
+	for k, v := range kvs {
+		entries = append(entries, trieEntry{path: keyToNibbles([]byte(k)), value: []byte(v)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].path, entries[j].path) < 0 })
+
+	proof := make([][]byte, 0)
+	root := encodeNode(entries, keyToNibbles([]byte(target)), true, &proof)
+	if len(root) < 32 {
+		proof = append(proof, root)
+	}
+	return Keccak256(root), proof
+}
+
+func encodeNode(entries []trieEntry, target []byte, onPath bool, proof *[][]byte) []byte {
+	var enc []byte
+	if len(entries) == 1 {
+		enc = encodeList(encodeString(hexPrefix(entries[0].path, true)), encodeString(entries[0].value))
+	} else if p := commonPrefix(entries); p > 0 {
+		prefix := entries[0].path[:p]
+		children := make([]trieEntry, 0, len(entries))
+		for _, e := range entries {
+			children = append(children, trieEntry{path: e.path[p:], value: e.value})
+		}
+		onPath = onPath && bytes.HasPrefix(target, prefix)
+		next := target
+		if onPath {
+			next = target[p:]
+		}
+		enc = encodeList(encodeString(hexPrefix(prefix, false)), nodeRef(encodeNode(children, next, onPath, proof)))
+	} else {
+		items := make([][]byte, 17)
+		for i := range items {
+			items[i] = encodeString(nil)
+		}
+		for nibble := byte(0); nibble < 16; nibble++ {
+			children := make([]trieEntry, 0)
+			for _, e := range entries {
+				if len(e.path) > 0 && e.path[0] == nibble {
+					children = append(children, trieEntry{path: e.path[1:], value: e.value})
+				}
+			}
+			if len(children) == 0 {
+				continue
+			}
+			childOnPath := onPath && len(target) > 0 && target[0] == nibble
+			next := target
+			if childOnPath {
+				next = target[1:]
+			}
+			items[nibble] = nodeRef(encodeNode(children, next, childOnPath, proof))
+		}
+		for _, e := range entries {
+			if len(e.path) == 0 {
+				items[16] = encodeString(e.value)
+			}
+		}
+		enc = encodeList(items...)
+	}
+	if onPath && len(enc) >= 32 {
+		*proof = append(*proof, enc)
+	}
+	return enc
+}
+
+// 子节点编码不足32字节时直接嵌入，否则以哈希引用
+func nodeRef(enc []byte) []byte {
+	if len(enc) < 32 {
+		return enc
+	}
+	return encodeString(Keccak256(enc))
+}
+
+func commonPrefix(entries []trieEntry) int {
+	p := len(entries[0].path)
+	for _, e := range entries[1:] {
+		n := 0
+		for n < p && n < len(e.path) && e.path[n] == entries[0].path[n] {
+			n++
+		}
+		p = n
+	}
+	return p
+}
+
+func hexPrefix(nibbles []byte, leaf bool) []byte {
+	flag := byte(0)
+	if leaf {
+		flag = 2
+	}
+	var b []byte
+	if len(nibbles)%2 == 1 {
+		b = []byte{(flag+1)<<4 | nibbles[0]}
+		nibbles = nibbles[1:]
+	} else {
+		b = []byte{flag << 4}
+	}
+	for i := 0; i < len(nibbles); i += 2 {
+		b = append(b, nibbles[i]<<4|nibbles[i+1])
+	}
+	return b
+}
+
+// go-ethereum trie测试中的根哈希，用于确认测试trie的构建与以太坊一致
+func TestBuildTrieMatchesReference(t *testing.T) {
+	if got := hex.EncodeToString(Keccak256([]byte{0x80})); got != "56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421" {
+		t.Fatalf("empty trie root is %s", got)
+	}
+
+	root, _ := buildTrie(map[string]string{"doe": "reindeer", "dog": "puppy", "dogglesworth": "cat"}, "dog")
+	if got := hex.EncodeToString(root); got != "8aad789dff2f538bca5d8ea56e8abe10f4c7ba3a5dea95fea4cd6e7c3a1168d3" {
+		t.Fatalf("root is %s", got)
+	}
+}
+
+func TestVerifyProof(t *testing.T) {
+	kvs := map[string]string{
+		"do":                            "verb",
+		"horse":                         "stallion",
+		"doge":                          "coin",
+		"dog":                           "puppy",
+		"somethingveryoddindeedthis is": "myothernodedata",
+	}
+	for key, value := range kvs {
+		root, proof := buildTrie(kvs, key)
+		got, err := VerifyProof(root, []byte(key), proof)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if string(got) != value {
+			t.Fatalf("%s is %q, expecting %q", key, got, value)
+		}
+	}
+
+	// 证明中不存在的key
+	root, proof := buildTrie(kvs, "dog")
+	for _, key := range []string{"dogs", "d", "cat"} {
+		if v, err := VerifyProof(root, []byte(key), proof); err == nil {
+			t.Fatalf("%s proved as %q", key, v)
+		}
+	}
+}
+
+func TestVerifyProofRejectsBadNode(t *testing.T) {
+	kvs := map[string]string{"doe": "reindeer", "dog": "puppy", "dogglesworth": "cat"}
+	root, proof := buildTrie(kvs, "dogglesworth")
+	if len(proof) < 2 {
+		t.Fatalf("proof has %d nodes", len(proof))
+	}
+
+	// 篡改路径上任一节点后哈希不符，证明中找不到被引用的节点
+	for i := range proof {
+		tampered := make([][]byte, len(proof))
+		copy(tampered, proof)
+		node := append([]byte(nil), proof[i]...)
+		node[len(node)-1] ^= 0x01
+		tampered[i] = node
+		if _, err := VerifyProof(root, []byte("dogglesworth"), tampered); err == nil || !strings.Contains(err.Error(), "missing node") {
+			t.Fatalf("tampered node %d returned %v", i, err)
+		}
+	}
+
+	// 缺少路径上的节点
+	if _, err := VerifyProof(root, []byte("dogglesworth"), proof[1:]); err == nil {
+		t.Fatal("proof without its leaf accepted")
+	}
+
+	// 以哈希正确但结构非法的节点作为根
+	bad := encodeList(encodeString([]byte("a")), encodeString([]byte("b")), encodeString([]byte("c")))
+	if _, err := VerifyProof(Keccak256(bad), []byte("dog"), [][]byte{bad}); err == nil || !strings.Contains(err.Error(), "malformed") {
+		t.Fatalf("malformed node returned %v", err)
+	}
+}
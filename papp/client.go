@@ -0,0 +1,133 @@
+/*-------------------------------------------*/
+/*            PAPP客户端 client.go             */
+/*-------------------------------------------*/
+package papp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// 应答大小的默认上限
+const DefaultMaxResponseBytes = 4 << 20
+
+// 跨链合约使用的PAPP客户端
+// 通信失败、PAPP内部错误或超时会按Backoff、2*Backoff...间隔重试，PAPP须按requestID去重
+type Client struct {
+	URL              string       // PAPP地址
+	HTTPClient       *http.Client // 为nil时使用不超时的默认客户端
+	Retries          int          // 首次失败后的最多重试次数
+	Backoff          time.Duration
+	MaxResponseBytes int64     // 应答大小上限，为0时使用DefaultMaxResponseBytes
+	Deadline         time.Time // 截止时间，为零值时不限制；截止时间后不再重试
+}
+
+// 创建PAPP客户端，timeout为0时不超时
+func NewClient(url string, timeout time.Duration) *Client {
+	return &Client{
+		URL:        url,
+		HTTPClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// 发送跨链请求，返回目的链的数据
+// PAPP返回的错误为*Error，通信失败时为Http客户端的错误
+func (c *Client) Send(requestID string, message []byte) ([]byte, error) {
+	reqData, err := json.Marshal(Request{
+		Version:   Version,
+		RequestID: requestID,
+		Message:   message,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		data, err := c.post(requestID, reqData)
+		if err == nil || !retryable(err) || attempt >= c.Retries {
+			return data, err
+		}
+		if !c.Deadline.IsZero() && time.Now().Add(backoff).After(c.Deadline) {
+			return nil, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// 发送一次请求
+func (c *Client) post(requestID string, reqData []byte) ([]byte, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if !c.Deadline.IsZero() {
+		remaining := time.Until(c.Deadline)
+		if remaining <= 0 {
+			return nil, &Error{Code: CodeTimeout, Message: "request " + requestID + " timed out"}
+		}
+		if httpClient.Timeout == 0 || remaining < httpClient.Timeout {
+			limited := *httpClient
+			limited.Timeout = remaining
+			httpClient = &limited
+		}
+	}
+
+	res, err := httpClient.Post(c.URL, ContentType, bytes.NewReader(reqData))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	maxBytes := c.MaxResponseBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxResponseBytes
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, &Error{Code: CodeBadRequest, Message: fmt.Sprintf("response exceeds %d bytes", maxBytes)}
+	}
+	return decodeResponse(requestID, res.StatusCode, body)
+}
+
+// 通信失败、PAPP内部错误与超时可以重试，其他PAPP错误说明请求已被处理或无法处理
+func retryable(err error) bool {
+	perr, ok := err.(*Error)
+	if !ok {
+		return true
+	}
+	return perr.Code == CodeInternal || perr.Code == CodeTimeout
+}
+
+// 解析PAPP的应答，非2xx状态码一律视为失败
+func decodeResponse(requestID string, statusCode int, body []byte) ([]byte, error) {
+	resp := Response{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		if statusCode < 200 || statusCode > 299 {
+			return nil, &Error{Code: CodeInternal, Message: fmt.Sprintf("http status %d", statusCode)}
+		}
+		return nil, &Error{Code: CodeBadRequest, Message: fmt.Sprintf("malformed response: %s", err)}
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if statusCode < 200 || statusCode > 299 {
+		return nil, &Error{Code: CodeInternal, Message: fmt.Sprintf("http status %d", statusCode)}
+	}
+	if err := CheckVersion(resp.Version); err != nil {
+		return nil, err
+	}
+	if resp.RequestID != requestID {
+		return nil, &Error{Code: CodeBadRequest, Message: fmt.Sprintf("response for request %s, expecting %s", resp.RequestID, requestID)}
+	}
+	return resp.Data, nil
+}
@@ -0,0 +1,69 @@
+package papp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClientSend(t *testing.T) {
+	server := NewMockServer(func(req Request) ([]byte, error) {
+		return append([]byte("echo:"), req.Message...), nil
+	})
+	defer server.Close()
+
+	data, err := NewClient(server.URL, time.Second).Send("chainA-chainB-1", []byte(`{"k":"v"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `echo:{"k":"v"}` {
+		t.Fatalf("unexpected data %q", data)
+	}
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].RequestID != "chainA-chainB-1" || requests[0].Version != Version {
+		t.Fatalf("server received %+v", requests)
+	}
+}
+
+func TestClientError(t *testing.T) {
+	server := NewMockServer(func(req Request) ([]byte, error) {
+		return nil, &Error{Code: CodeUnknownChain, Message: "chain chainC not connected"}
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL, time.Second)
+	client.Retries = 3
+	_, err := client.Send("chainA-chainC-1", []byte(`{}`))
+	perr := &Error{}
+	if !errors.As(err, &perr) || perr.Code != CodeUnknownChain {
+		t.Fatalf("expecting an %s error, got %v", CodeUnknownChain, err)
+	}
+	// 不可重试的错误只发送一次
+	if n := len(server.Requests()); n != 1 {
+		t.Fatalf("server received %d requests, expecting 1", n)
+	}
+}
+
+func TestClientRetriesInternalError(t *testing.T) {
+	server := NewMockServer(nil)
+	defer server.Close()
+	attempts := 0
+	server.SetHandler(func(req Request) ([]byte, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("destination busy")
+		}
+		return []byte("ok"), nil
+	})
+
+	client := NewClient(server.URL, time.Second)
+	client.Retries = 3
+	client.Backoff = time.Millisecond
+	data, err := client.Send("chainA-chainB-2", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ok" || len(server.Requests()) != 3 {
+		t.Fatalf("got %q after %d requests", data, len(server.Requests()))
+	}
+}
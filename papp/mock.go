@@ -0,0 +1,56 @@
+/*-------------------------------------------*/
+/*            模拟PAPP服务 mock.go             */
+/*-------------------------------------------*/
+package papp
+
+import (
+	"net/http/httptest"
+	"sync"
+)
+
+// 基于httptest的模拟PAPP服务，记录收到的请求并按预设的处理函数应答
+//
+//	server := papp.NewMockServer(func(req papp.Request) ([]byte, error) {
+//		return []byte(`{"fphm":"12345678"}`), nil
+//	})
+//	defer server.Close()
+//	// 将server.URL通过modifyPAPPIP写入跨链合约
+type MockServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	handler  HandlerFunc
+	requests []Request
+}
+
+// 启动模拟PAPP服务，handler为nil时返回空数据
+func NewMockServer(handler HandlerFunc) *MockServer {
+	m := &MockServer{handler: handler}
+	m.Server = httptest.NewServer(Handler(m.handle))
+	return m
+}
+
+// 替换处理函数
+func (m *MockServer) SetHandler(handler HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handler = handler
+}
+
+// 按顺序返回收到的请求
+func (m *MockServer) Requests() []Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Request(nil), m.requests...)
+}
+
+func (m *MockServer) handle(req Request) ([]byte, error) {
+	m.mu.Lock()
+	m.requests = append(m.requests, req)
+	handler := m.handler
+	m.mu.Unlock()
+
+	if handler == nil {
+		return nil, nil
+	}
+	return handler(req)
+}
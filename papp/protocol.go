@@ -0,0 +1,77 @@
+/*-------------------------------------------*/
+/*            PAPP通信协议 protocol.go         */
+/*-------------------------------------------*/
+
+// Package papp 定义跨链合约与PAPP之间的Http协议：请求、应答与错误的格式及版本，
+// 并提供跨链合约使用的客户端和测试用的模拟PAPP服务。
+//
+// 跨链合约以POST方式发送Request，Content-Type为application/json；
+// PAPP处理成功时返回200及Response，失败时返回4xx/5xx及带Error的Response。
+package papp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 协议版本，主版本号不同的双方不能互通
+const Version = "1.0"
+
+const ContentType = "application/json;charset=utf-8"
+
+// 错误码
+const (
+	CodeBadRequest         = "bad-request"         // 请求格式错误
+	CodeUnsupportedVersion = "unsupported-version" // 协议主版本号不支持
+	CodeUnknownChain       = "unknown-chain"       // 目的链未接入PAPP
+	CodeDeliveryFailed     = "delivery-failed"     // 目的链执行失败
+	CodeTimeout            = "timeout"             // 目的链未在规定时间内应答
+	CodeInternal           = "internal"            // PAPP内部错误
+)
+
+// 跨链合约发给PAPP的请求
+type Request struct {
+	Version   string          `json:"version"`   //协议版本
+	RequestID string          `json:"requestID"` //请求ID，见RequestID
+	Message   json.RawMessage `json:"message"`   //跨链请求，即broker.RequestToPAPP
+}
+
+// PAPP返回给跨链合约的应答，Error为空表示成功
+type Response struct {
+	Version   string `json:"version"`         //协议版本
+	RequestID string `json:"requestID"`       //对应请求的ID
+	Data      []byte `json:"data,omitempty"`  //目的链返回的数据
+	Error     *Error `json:"error,omitempty"` //失败原因
+}
+
+// PAPP返回的错误
+type Error struct {
+	Code    string `json:"code"`    //错误码
+	Message string `json:"message"` //错误描述
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("papp error [%s]: %s", e.Code, e.Message)
+}
+
+// 跨链请求的ID：来源链ID-目的链ID-序号
+func RequestID(srcChainID string, dstChainID string, index uint64) string {
+	return srcChainID + "-" + dstChainID + "-" + strconv.FormatUint(index, 10)
+}
+
+// 校验对方的协议版本，主版本号相同即可互通
+func CheckVersion(version string) error {
+	if version == "" {
+		return &Error{Code: CodeUnsupportedVersion, Message: "missing protocol version"}
+	}
+	if major(version) != major(Version) {
+		return &Error{Code: CodeUnsupportedVersion, Message: fmt.Sprintf("protocol version %s, expecting %s", version, Version)}
+	}
+	return nil
+}
+
+func major(version string) string {
+	return strings.SplitN(version, ".", 2)[0]
+}
@@ -0,0 +1,92 @@
+/*-------------------------------------------*/
+/*            PAPP服务端 server.go             */
+/*-------------------------------------------*/
+package papp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// PAPP处理一条跨链请求，返回目的链的数据；返回*Error时按错误码确定Http状态码，其他错误视为内部错误
+type HandlerFunc func(req Request) ([]byte, error)
+
+// 按协议解析请求、校验版本并写回应答的Http处理器
+func Handler(fn HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, "", &Error{Code: CodeBadRequest, Message: "method not allowed: " + r.Method})
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, "", &Error{Code: CodeBadRequest, Message: err.Error()})
+			return
+		}
+		req := Request{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, "", &Error{Code: CodeBadRequest, Message: "malformed request: " + err.Error()})
+			return
+		}
+		if err := CheckVersion(req.Version); err != nil {
+			writeError(w, req.RequestID, err)
+			return
+		}
+		if req.RequestID == "" || len(req.Message) == 0 {
+			writeError(w, req.RequestID, &Error{Code: CodeBadRequest, Message: "missing request ID or message"})
+			return
+		}
+
+		data, err := fn(req)
+		if err != nil {
+			writeError(w, req.RequestID, err)
+			return
+		}
+		writeResponse(w, http.StatusOK, Response{
+			Version:   Version,
+			RequestID: req.RequestID,
+			Data:      data,
+		})
+	})
+}
+
+// 写回错误应答
+func writeError(w http.ResponseWriter, requestID string, err error) {
+	perr, ok := err.(*Error)
+	if !ok {
+		perr = &Error{Code: CodeInternal, Message: err.Error()}
+	}
+	writeResponse(w, httpStatus(perr.Code), Response{
+		Version:   Version,
+		RequestID: requestID,
+		Error:     perr,
+	})
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp Response) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// 错误码对应的Http状态码
+func httpStatus(code string) int {
+	switch code {
+	case CodeBadRequest, CodeUnsupportedVersion:
+		return http.StatusBadRequest
+	case CodeUnknownChain:
+		return http.StatusNotFound
+	case CodeDeliveryFailed:
+		return http.StatusBadGateway
+	case CodeTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,182 @@
+/*-------------------------------------------*/
+/*            中继游标存储 cursor.go           */
+/*-------------------------------------------*/
+package relayer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// 保存在本地文件中的中继游标，记录每条来源链发往每条目的链已投递的最新序号，以及尚未完成的回调
+// 文件内容如{"cursors":{"chainA":{"chainB":3,"chainC":1}},"callbacks":[{"srcChainID":"chainA","dstChainID":"chainB","index":3}]}，
+// 每次更新先写临时文件再重命名，进程中断不会损坏游标。旧版本只含游标的文件{"chainA":{"chainB":3}}仍可读取
+type CursorStore struct {
+	path      string
+	mu        sync.Mutex
+	cursors   map[string]map[string]uint64
+	callbacks []PendingCallback
+}
+
+// 待回调的异步调用：投递前登记，回调来源链成功后删除，投递后进程中断或回调失败时由下次轮询重试
+type PendingCallback struct {
+	SrcChainID string `json:"srcChainID"` //发起调用的来源链
+	DstChainID string `json:"dstChainID"` //执行调用的目的链
+	Index      uint64 `json:"index"`      //来源链发往目的链的请求序号
+}
+
+// 游标文件的内容
+type cursorFile struct {
+	Cursors   map[string]map[string]uint64 `json:"cursors"`
+	Callbacks []PendingCallback            `json:"callbacks,omitempty"`
+}
+
+// 打开游标文件，文件不存在时从零开始
+func OpenCursorStore(path string) (*CursorStore, error) {
+	store := &CursorStore{
+		path:    path,
+		cursors: make(map[string]map[string]uint64),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file := cursorFile{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil || file.Cursors == nil {
+		// 旧版本的游标文件
+		if err := json.Unmarshal(data, &store.cursors); err != nil {
+			return nil, fmt.Errorf("unmarshal cursor file %s: %w", path, err)
+		}
+		return store, nil
+	}
+	store.cursors = file.Cursors
+	store.callbacks = file.Callbacks
+	return store, nil
+}
+
+// 来源链发往各目的链已投递的最新序号，格式同pollingEvent的参数
+func (store *CursorStore) Snapshot(srcChainID string) map[string]uint64 {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	snapshot := make(map[string]uint64, len(store.cursors[srcChainID]))
+	for dstChainID, idx := range store.cursors[srcChainID] {
+		snapshot[dstChainID] = idx
+	}
+	return snapshot
+}
+
+// 来源链发往目的链已投递的最新序号
+func (store *CursorStore) Get(srcChainID string, dstChainID string) uint64 {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.cursors[srcChainID][dstChainID]
+}
+
+// 更新来源链发往目的链已投递的最新序号并写回文件，游标只前进不后退
+func (store *CursorStore) Advance(srcChainID string, dstChainID string, idx uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if idx <= store.cursors[srcChainID][dstChainID] {
+		return nil
+	}
+	if store.cursors[srcChainID] == nil {
+		store.cursors[srcChainID] = make(map[string]uint64)
+	}
+	store.cursors[srcChainID][dstChainID] = idx
+	return store.save()
+}
+
+// 来源链发往目的链的待回调请求，按序号排列
+func (store *CursorStore) Callbacks(srcChainID string, dstChainID string) []PendingCallback {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	pending := make([]PendingCallback, 0)
+	for _, cb := range store.callbacks {
+		if cb.SrcChainID == srcChainID && cb.DstChainID == dstChainID {
+			pending = append(pending, cb)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Index < pending[j].Index })
+	return pending
+}
+
+// 登记待回调的请求并写回文件，已登记的请求忽略
+func (store *CursorStore) AddCallbacks(callbacks []PendingCallback) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	added := false
+	for _, cb := range callbacks {
+		if store.indexOf(cb) < 0 {
+			store.callbacks = append(store.callbacks, cb)
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	return store.save()
+}
+
+// 删除已完成的回调并写回文件
+func (store *CursorStore) RemoveCallback(cb PendingCallback) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	i := store.indexOf(cb)
+	if i < 0 {
+		return nil
+	}
+	store.callbacks = append(store.callbacks[:i], store.callbacks[i+1:]...)
+	return store.save()
+}
+
+func (store *CursorStore) indexOf(cb PendingCallback) int {
+	for i, c := range store.callbacks {
+		if c == cb {
+			return i
+		}
+	}
+	return -1
+}
+
+// 写临时文件、同步到磁盘后重命名为游标文件
+func (store *CursorStore) save() error {
+	data, err := json.Marshal(cursorFile{Cursors: store.cursors, Callbacks: store.callbacks})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), store.path)
+}
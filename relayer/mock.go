@@ -0,0 +1,350 @@
+/*-------------------------------------------*/
+/*            进程内模拟链 mock.go             */
+/*-------------------------------------------*/
+package relayer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// 模拟链的管理员组织
+const MockAdminMSP = "Org1MSP"
+
+// 进程内的模拟链，跨链合约与业务合约均运行在shimtest.MockStub上，同时实现Source、QuorumDestination与ProofDestination，
+// 用于不依赖Fabric网络测试中继：
+//
+//	chainA, _ := relayer.NewMockChain("chainA", nil)
+//	chainB, _ := relayer.NewMockChain("chainB", nil)
+//	store, _ := relayer.OpenCursorStore(filepath.Join(dir, "cursors.json"))
+//	r := relayer.New(store)
+//	r.AddSource(chainA, chainA.PublicKey())
+//	r.AddDestination(chainB)
+//	chainB.Invoke("registerChain", `{"chainID":"chainA"}`)
+//	chainA.Invoke("InterchainSingleModify", "chainB", "key", "value")
+//	r.Poll()
+//
+// 跨链合约以Admin身份初始化并调用，模拟其他调用者时临时替换Broker.Creator。
+// 注意MockStub不会回滚失败交易已写入的状态
+type MockChain struct {
+	Broker    *shimtest.MockStub   // 跨链合约
+	Business  *shimtest.MockStub   // 业务合约
+	Events    []*pb.ChaincodeEvent // 跨链合约发出的事件
+	Admin     []byte               // 管理员组织MockAdminMSP的调用者身份
+	chainID   string
+	publicKey []byte
+	txSeq     int
+}
+
+// 创建模拟链并初始化跨链合约，business为nil时使用MockBusiness
+func NewMockChain(chainID string, business shim.Chaincode) (*MockChain, error) {
+	if business == nil {
+		business = new(MockBusiness)
+	}
+	chain := &MockChain{
+		Broker:   shimtest.NewMockStub("broker", broker.New(broker.DefaultConfig())),
+		Business: shimtest.NewMockStub(broker.DefaultChaincodeID, business),
+		chainID:  chainID,
+	}
+	chain.Broker.MockPeerChaincode(broker.DefaultChaincodeID, chain.Business, broker.DefaultChannelID)
+
+	admin, err := MockIdentity(MockAdminMSP)
+	if err != nil {
+		return nil, err
+	}
+	chain.Admin = admin
+	chain.Broker.Creator = admin
+
+	if resp := chain.Broker.MockInit(chain.nextTxID(), [][]byte{[]byte("init"), []byte(chainID)}); resp.Status != shim.OK {
+		return nil, fmt.Errorf("init broker: %s", resp.Message)
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	chain.publicKey, err = x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if resp := chain.Invoke("setPrivateKey", string(privateKeyDER)); resp.Status != shim.OK {
+		return nil, fmt.Errorf("set private key: %s", resp.Message)
+	}
+	return chain, nil
+}
+
+// 本链ID
+func (chain *MockChain) ChainID() string {
+	return chain.chainID
+}
+
+// 跨链合约的公钥，PKIX DER编码
+func (chain *MockChain) PublicKey() []byte {
+	return chain.publicKey
+}
+
+// 以一个新交易调用跨链合约，并收集交易发出的事件
+func (chain *MockChain) Invoke(function string, args ...string) pb.Response {
+	b := make([][]byte, 0, len(args)+1)
+	b = append(b, []byte(function))
+	for _, arg := range args {
+		b = append(b, []byte(arg))
+	}
+	resp := chain.Broker.MockInvoke(chain.nextTxID(), b)
+	for {
+		select {
+		case event := <-chain.Broker.ChaincodeEventsChannel:
+			chain.Events = append(chain.Events, event)
+		default:
+			return resp
+		}
+	}
+}
+
+// 生成模拟调用者身份：属于mspID的自签名证书，可赋给MockStub.Creator
+func MockIdentity(mspID string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "mock", Organization: []string{mspID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	})
+}
+
+func (chain *MockChain) nextTxID() string {
+	chain.txSeq++
+	return chain.chainID + "-tx-" + strconv.Itoa(chain.txSeq)
+}
+
+// 实现Source
+func (chain *MockChain) PollSignedEvents(cursor map[string]uint64) ([]broker.RequestToPAPP, error) {
+	cursorData, err := json.Marshal(cursor)
+	if err != nil {
+		return nil, err
+	}
+	resp := chain.Invoke("pollingSignedEvent", string(cursorData))
+	if resp.Status != shim.OK {
+		return nil, fmt.Errorf("pollingSignedEvent: %s", resp.Message)
+	}
+	reqs := make([]broker.RequestToPAPP, 0)
+	if err := json.Unmarshal(resp.Payload, &reqs); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// 实现Source
+func (chain *MockChain) Callback(execChainID string, index uint64, status string, result string) error {
+	resp := chain.Invoke("interchainCallback", execChainID, chain.chainID, strconv.FormatUint(index, 10), status, result)
+	if resp.Status != shim.OK && broker.ErrorCodeOf(resp.Message) != broker.CodeDuplicate {
+		return fmt.Errorf("interchainCallback: %s", resp.Message)
+	}
+	return nil
+}
+
+// 实现Destination
+func (chain *MockChain) Deliver(msgs []broker.CrossChainRequest, policy string) ([]broker.DeliverResult, error) {
+	msgData, err := json.Marshal(msgs)
+	if err != nil {
+		return nil, err
+	}
+	return chain.deliverResults("interchainBatchDeliver", string(msgData), policy)
+}
+
+// 实现QuorumDestination，以Broker.Creator的身份提交
+func (chain *MockChain) QuorumDeliver(msgs []broker.CrossChainRequest) ([]broker.DeliverResult, error) {
+	msgData, err := json.Marshal(msgs)
+	if err != nil {
+		return nil, err
+	}
+	return chain.deliverResults("interchainQuorumDeliver", string(msgData))
+}
+
+// 实现ProofDestination
+func (chain *MockChain) DeliverProof(mode string, srcChainID string, proof []byte) ([]broker.DeliverResult, error) {
+	switch mode {
+	case ModeFabric:
+		return chain.deliverResults("interchainFabricDeliver", srcChainID, chain.chainID, string(proof))
+	case ModeEVM:
+		return chain.deliverResults("interchainEVMDeliver", srcChainID, chain.chainID, string(proof))
+	default:
+		return nil, fmt.Errorf("unknown proof mode: %s", mode)
+	}
+}
+
+// 调用返回投递结果列表的跨链接口
+func (chain *MockChain) deliverResults(function string, args ...string) ([]broker.DeliverResult, error) {
+	resp := chain.Invoke(function, args...)
+	if resp.Status != shim.OK {
+		return nil, fmt.Errorf("%s: %s", function, resp.Message)
+	}
+	results := make([]broker.DeliverResult, 0)
+	if err := json.Unmarshal(resp.Payload, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// 实现Destination
+func (chain *MockChain) InMessage(srcChainID string, index uint64) (*broker.DeliverResult, error) {
+	resp := chain.Invoke("getInMessage", srcChainID, strconv.FormatUint(index, 10))
+	if resp.Status != shim.OK {
+		return nil, fmt.Errorf("getInMessage: %s", resp.Message)
+	}
+	if len(resp.Payload) == 0 {
+		return nil, nil
+	}
+	result := &broker.DeliverResult{}
+	if err := json.Unmarshal(resp.Payload, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// 实现Destination
+func (chain *MockChain) InnerMeta() (map[string]uint64, error) {
+	resp := chain.Invoke("getInnerMeta")
+	if resp.Status != shim.OK {
+		return nil, fmt.Errorf("getInnerMeta: %s", resp.Message)
+	}
+	meta := make(map[string]uint64)
+	if len(resp.Payload) == 0 {
+		return meta, nil
+	}
+	if err := json.Unmarshal(resp.Payload, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// 模拟业务合约，以key-value形式保存发票
+type MockBusiness struct{}
+
+func (cc *MockBusiness) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (cc *MockBusiness) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	switch function {
+	case "interchainGet":
+		if len(args) < 1 {
+			return shim.Error("incorrect number of arguments, expecting 1")
+		}
+		v, err := stub.GetState(args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(v)
+	case "interchainSet":
+		if len(args) < 2 {
+			return shim.Error("incorrect number of arguments, expecting 2")
+		}
+		if err := stub.PutState(args[0], []byte(args[1])); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	case "interchainTransferOut":
+		if len(args) < 2 {
+			return shim.Error("incorrect number of arguments, expecting 2")
+		}
+		if err := stub.DelState(args[0]); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	case "redReverse":
+		// 冲红函数：以发票代码、发票号码为参数
+		if len(args) < 2 {
+			return shim.Error("incorrect number of arguments, expecting 2")
+		}
+		if err := stub.PutState("red-reversed-"+args[0]+args[1], []byte("true")); err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	case "queryByValue":
+		if len(args) < 1 {
+			return shim.Error("incorrect number of arguments, expecting 1")
+		}
+		iter, err := stub.GetStateByRange("", "")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer iter.Close()
+		values := make([]string, 0)
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if strings.Contains(string(kv.Value), args[0]) {
+				values = append(values, string(kv.Value))
+			}
+		}
+		ret, err := json.Marshal(values)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(ret)
+	case "queryByCriteria":
+		// 返回全部JSON格式的发票，由跨链合约按条件过滤
+		iter, err := stub.GetStateByRange("", "")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer iter.Close()
+		invoices := make([]json.RawMessage, 0)
+		for iter.HasNext() {
+			kv, err := iter.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if json.Valid(kv.Value) && strings.HasPrefix(string(kv.Value), "{") {
+				invoices = append(invoices, kv.Value)
+			}
+		}
+		ret, err := json.Marshal(invoices)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(ret)
+	default:
+		return shim.Error("invalid function: " + function)
+	}
+}
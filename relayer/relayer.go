@@ -0,0 +1,430 @@
+/*-------------------------------------------*/
+/*            PAPP参考实现 relayer.go          */
+/*-------------------------------------------*/
+
+// Package relayer 是PAPP的参考实现：从来源链跨链合约获取跨链请求，校验后按序号投递到目的链跨链合约。
+// 投递方式与目的链登记来源链时设置的校验方式一致：用来源链公钥校验签名后通过interchainBatchDeliver投递，
+// 以本中继身份通过interchainQuorumDeliver提交，或附上来源链的证明通过interchainFabricDeliver、interchainEVMDeliver投递。
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+)
+
+// 跨链合约发出跨链请求的事件名
+const (
+	EventName      = "interchain-event-name"       // 单条请求，内容为RequestToPAPP
+	BatchEventName = "interchain-batch-event-name" // 批量请求，内容为RequestToPAPP列表
+)
+
+// PAPP须同时订阅的事件名，只订阅EventName会漏掉批量发出的请求
+var EventNames = []string{EventName, BatchEventName}
+
+// 投递失败时的处理策略，与interchainBatchDeliver一致
+const deliverPolicy = "stop"
+
+// 向目的链投递的方式
+const (
+	ModeBatch  = "batch"  // interchainBatchDeliver，目的链信任中继，默认方式
+	ModeQuorum = "quorum" // interchainQuorumDeliver，目的链以setRelayers登记的中继集合确认
+	ModeFabric = "fabric" // interchainFabricDeliver，附来源链交易的背书证明
+	ModeEVM    = "evm"    // interchainEVMDeliver，附来源链交易回执的Merkle证明
+)
+
+// 多中继确认时尚未达到法定数量的投递结果
+const deliverStatusPending = "pending"
+
+// 跨链请求的来源链
+type Source interface {
+	ChainID() string
+	// 调用pollingSignedEvent，返回发往各目的链序号大于cursor的已签名跨链请求
+	PollSignedEvents(cursor map[string]uint64) ([]broker.RequestToPAPP, error)
+	// 调用interchainCallback，将目的链的执行结果回调给发起异步调用的来源链
+	// 请求已回调过（错误码duplicate）时返回nil
+	Callback(execChainID string, index uint64, status string, result string) error
+}
+
+// 跨链请求的目的链
+type Destination interface {
+	ChainID() string
+	// 调用interchainBatchDeliver投递入链消息
+	Deliver(msgs []broker.CrossChainRequest, policy string) ([]broker.DeliverResult, error)
+	// 调用getInnerMeta，返回各来源链已处理的最新序号
+	InnerMeta() (map[string]uint64, error)
+	// 调用getInMessage，返回来源链index号请求的处理结果，未处理时返回nil
+	InMessage(srcChainID string, index uint64) (*broker.DeliverResult, error)
+}
+
+// 支持多中继确认的目的链，用于ModeQuorum
+type QuorumDestination interface {
+	Destination
+	// 以本中继的身份调用interchainQuorumDeliver提交入链消息
+	QuorumDeliver(msgs []broker.CrossChainRequest) ([]broker.DeliverResult, error)
+}
+
+// 支持证明校验的目的链，用于ModeFabric、ModeEVM
+type ProofDestination interface {
+	Destination
+	// 按mode调用interchainFabricDeliver或interchainEVMDeliver，提交来源链srcChainID的证明
+	DeliverProof(mode string, srcChainID string, proof []byte) ([]broker.DeliverResult, error)
+}
+
+// 能为跨链请求生成证明的来源链，用于ModeFabric、ModeEVM
+type Prover interface {
+	// 返回请求所在交易的证明：ModeFabric为FabricProof，ModeEVM为EVMProof的JSON编码；
+	// EVMProof引用的区块头须已由区块头签名者通过submitEVMHeader提交到目的链
+	Prove(mode string, req broker.RequestToPAPP) ([]byte, error)
+}
+
+// 已登记的来源链
+type source struct {
+	Source
+	publicKey []byte // 来源链跨链合约的公钥，PKIX DER编码
+}
+
+// 中继，游标与待回调的请求保存在CursorStore中，重启后从上次投递的位置继续
+type Relayer struct {
+	OnError      func(error) // Run中轮询出错时调用，为nil时忽略错误
+	cursors      *CursorStore
+	sources      map[string]source
+	destinations map[string]Destination
+	modes        map[string]map[string]string
+}
+
+// 创建中继
+func New(cursors *CursorStore) *Relayer {
+	return &Relayer{
+		cursors:      cursors,
+		sources:      make(map[string]source),
+		destinations: make(map[string]Destination),
+		modes:        make(map[string]map[string]string),
+	}
+}
+
+// 登记来源链及其跨链合约公钥，来源链发出的请求须能用该公钥验签
+func (r *Relayer) AddSource(src Source, publicKey []byte) {
+	r.sources[src.ChainID()] = source{Source: src, publicKey: publicKey}
+}
+
+// 登记目的链，发往未登记目的链的请求不处理
+func (r *Relayer) AddDestination(dst Destination) {
+	r.destinations[dst.ChainID()] = dst
+}
+
+// 设置来源链发往目的链的投递方式，须与目的链登记来源链时设置的校验方式一致，未设置时为ModeBatch
+// ModeQuorum要求目的链实现QuorumDestination；ModeFabric、ModeEVM要求目的链实现ProofDestination、来源链实现Prover
+func (r *Relayer) SetMode(srcChainID string, dstChainID string, mode string) error {
+	switch mode {
+	case ModeBatch, ModeQuorum, ModeFabric, ModeEVM:
+	default:
+		return fmt.Errorf("unknown deliver mode: %s", mode)
+	}
+	if r.modes[srcChainID] == nil {
+		r.modes[srcChainID] = make(map[string]string)
+	}
+	r.modes[srcChainID][dstChainID] = mode
+	return nil
+}
+
+func (r *Relayer) mode(srcChainID string, dstChainID string) string {
+	if mode, ok := r.modes[srcChainID][dstChainID]; ok {
+		return mode
+	}
+	return ModeBatch
+}
+
+// 按interval轮询所有来源链，直到ctx结束
+func (r *Relayer) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Poll(); err != nil && r.OnError != nil {
+			r.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// 轮询所有来源链一次，返回投递的消息数；先重试以往未完成的回调
+func (r *Relayer) Poll() (int, error) {
+	srcChainIDs := make([]string, 0, len(r.sources))
+	for srcChainID := range r.sources {
+		srcChainIDs = append(srcChainIDs, srcChainID)
+	}
+	sort.Strings(srcChainIDs)
+	dstChainIDs := make([]string, 0, len(r.destinations))
+	for dstChainID := range r.destinations {
+		dstChainIDs = append(dstChainIDs, dstChainID)
+	}
+	sort.Strings(dstChainIDs)
+
+	total := 0
+	var firstErr error
+	for _, srcChainID := range srcChainIDs {
+		src := r.sources[srcChainID]
+		for _, dstChainID := range dstChainIDs {
+			if err := r.callbacks(src, r.destinations[dstChainID], nil); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("callback %s -> %s: %w", srcChainID, dstChainID, err)
+			}
+		}
+
+		reqs, err := src.PollSignedEvents(r.cursors.Snapshot(srcChainID))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("poll chain %s: %w", srcChainID, err)
+			}
+			continue
+		}
+		n, err := r.relay(src, reqs)
+		total += n
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return total, firstErr
+}
+
+// 处理来源链跨链合约的事件，返回投递的消息数
+// 事件可能乱序或重复到达，已投递的请求会被忽略，不连续的请求留待轮询补齐
+func (r *Relayer) HandleEvent(srcChainID string, name string, payload []byte) (int, error) {
+	src, ok := r.sources[srcChainID]
+	if !ok {
+		return 0, fmt.Errorf("unknown source chain: %s", srcChainID)
+	}
+
+	reqs := make([]broker.RequestToPAPP, 0)
+	switch name {
+	case EventName:
+		req := broker.RequestToPAPP{}
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return 0, fmt.Errorf("unmarshal event: %w", err)
+		}
+		reqs = append(reqs, req)
+	case BatchEventName:
+		if err := json.Unmarshal(payload, &reqs); err != nil {
+			return 0, fmt.Errorf("unmarshal batch event: %w", err)
+		}
+	default:
+		return 0, nil
+	}
+	return r.relay(src, reqs)
+}
+
+// 校验来源链的请求并按目的链分组投递
+func (r *Relayer) relay(src source, reqs []broker.RequestToPAPP) (int, error) {
+	byDst := make(map[string][]broker.RequestToPAPP)
+	for _, req := range reqs {
+		byDst[req.CCRequest.DstChainID] = append(byDst[req.CCRequest.DstChainID], req)
+	}
+	dstChainIDs := make([]string, 0, len(byDst))
+	for dstChainID := range byDst {
+		dstChainIDs = append(dstChainIDs, dstChainID)
+	}
+	sort.Strings(dstChainIDs)
+
+	total := 0
+	var firstErr error
+	for _, dstChainID := range dstChainIDs {
+		dst, ok := r.destinations[dstChainID]
+		if !ok {
+			continue
+		}
+		n, err := r.relayTo(src, dst, byDst[dstChainID])
+		total += n
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("relay %s -> %s: %w", src.ChainID(), dstChainID, err)
+		}
+	}
+	return total, firstErr
+}
+
+// 将发往同一目的链的请求按序号投递，签名无效或序号不连续时在该处停止
+func (r *Relayer) relayTo(src source, dst Destination, reqs []broker.RequestToPAPP) (int, error) {
+	srcChainID := src.ChainID()
+	mode := r.mode(srcChainID, dst.ChainID())
+	sort.Slice(reqs, func(i, j int) bool {
+		return reqs[i].CCRequest.Index < reqs[j].CCRequest.Index
+	})
+
+	// 游标落后于目的链时（如投递后未及写回游标即中断）以目的链为准
+	inMeta, err := dst.InnerMeta()
+	if err != nil {
+		return 0, err
+	}
+	if err := r.cursors.Advance(srcChainID, dst.ChainID(), inMeta[srcChainID]); err != nil {
+		return 0, err
+	}
+
+	next := r.cursors.Get(srcChainID, dst.ChainID()) + 1
+	selected := make([]broker.RequestToPAPP, 0, len(reqs))
+	msgs := make([]broker.CrossChainRequest, 0, len(reqs))
+	var verifyErr error
+	for _, req := range reqs {
+		if req.CCRequest.Index < next {
+			continue
+		}
+		if req.CCRequest.Index > next {
+			break
+		}
+		if req.CCRequest.SrcChainID != srcChainID {
+			verifyErr = fmt.Errorf("request %d claims source chain %s", req.CCRequest.Index, req.CCRequest.SrcChainID)
+			break
+		}
+		// 证明方式由目的链校验来源链的证明，不要求来源链签名
+		if mode == ModeBatch || mode == ModeQuorum {
+			if err := broker.VerifyRequest(src.publicKey, req); err != nil {
+				verifyErr = err
+				break
+			}
+		}
+		msg, err := broker.ToInbound(req.CCRequest)
+		if err != nil {
+			verifyErr = err
+			break
+		}
+		selected = append(selected, req)
+		msgs = append(msgs, msg)
+		next++
+	}
+	if len(msgs) == 0 {
+		return 0, verifyErr
+	}
+
+	// 投递前登记待回调的请求，投递后进程中断时回调不会丢失
+	pending := make([]PendingCallback, 0)
+	for _, msg := range msgs {
+		if msg.Callback != "" {
+			pending = append(pending, PendingCallback{SrcChainID: srcChainID, DstChainID: dst.ChainID(), Index: msg.Index})
+		}
+	}
+	if err := r.cursors.AddCallbacks(pending); err != nil {
+		return 0, err
+	}
+
+	results, deliverErr := r.deliver(src, dst, mode, selected, msgs)
+	if deliverErr != nil && len(results) == 0 {
+		return 0, deliverErr
+	}
+	if deliverErr != nil && verifyErr == nil {
+		verifyErr = deliverErr
+	}
+
+	// 目的链记录的序号为准：未通过校验或尚未达到法定数量的消息不占用序号，执行失败的消息同样已处理
+	inMeta, err = dst.InnerMeta()
+	if err != nil {
+		return 0, err
+	}
+	delivered := inMeta[srcChainID]
+	if err := r.cursors.Advance(srcChainID, dst.ChainID(), delivered); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, result := range results {
+		if result.Index > delivered {
+			break
+		}
+		count++
+	}
+	if err := r.callbacks(src, dst, results); err != nil && verifyErr == nil {
+		verifyErr = err
+	}
+	if count < len(results) && results[count].Status != deliverStatusPending && verifyErr == nil {
+		verifyErr = fmt.Errorf("request %d rejected: %s", results[count].Index, results[count].Message)
+	}
+	return count, verifyErr
+}
+
+// 按投递方式投递消息，msgs与reqs一一对应
+// 证明方式逐条证明并投递，一个证明可能包含多条请求，已随前一证明投递的请求跳过
+func (r *Relayer) deliver(src source, dst Destination, mode string, reqs []broker.RequestToPAPP, msgs []broker.CrossChainRequest) ([]broker.DeliverResult, error) {
+	switch mode {
+	case ModeQuorum:
+		qdst, ok := dst.(QuorumDestination)
+		if !ok {
+			return nil, fmt.Errorf("chain %s does not support quorum delivery", dst.ChainID())
+		}
+		return qdst.QuorumDeliver(msgs)
+	case ModeFabric, ModeEVM:
+		pdst, ok := dst.(ProofDestination)
+		if !ok {
+			return nil, fmt.Errorf("chain %s does not support %s proofs", dst.ChainID(), mode)
+		}
+		prover, ok := src.Source.(Prover)
+		if !ok {
+			return nil, fmt.Errorf("chain %s cannot prove its requests", src.ChainID())
+		}
+		results := make([]broker.DeliverResult, 0, len(reqs))
+		var last uint64
+		for _, req := range reqs {
+			if req.CCRequest.Index <= last {
+				continue
+			}
+			proof, err := prover.Prove(mode, req)
+			if err != nil {
+				return results, fmt.Errorf("prove request %d: %w", req.CCRequest.Index, err)
+			}
+			rs, err := pdst.DeliverProof(mode, src.ChainID(), proof)
+			if err != nil {
+				return results, err
+			}
+			results = append(results, rs...)
+			for _, result := range rs {
+				if result.Status != "success" {
+					return results, nil
+				}
+				last = result.Index
+			}
+		}
+		return results, nil
+	default:
+		return dst.Deliver(msgs, deliverPolicy)
+	}
+}
+
+// 对已投递的待回调请求回调来源链，成功后从CursorStore删除，失败的留待下次轮询
+// results为本次投递的结果，其中没有的请求向目的链查询处理结果
+func (r *Relayer) callbacks(src source, dst Destination, results []broker.DeliverResult) error {
+	known := make(map[uint64]broker.DeliverResult, len(results))
+	for _, result := range results {
+		known[result.Index] = result
+	}
+	delivered := r.cursors.Get(src.ChainID(), dst.ChainID())
+	for _, cb := range r.cursors.Callbacks(src.ChainID(), dst.ChainID()) {
+		if cb.Index > delivered {
+			break
+		}
+		result, ok := known[cb.Index]
+		if !ok {
+			stored, err := dst.InMessage(src.ChainID(), cb.Index)
+			if err != nil {
+				return err
+			}
+			if stored == nil {
+				return fmt.Errorf("no result for request %d on chain %s", cb.Index, dst.ChainID())
+			}
+			result = *stored
+		}
+		status, message := "ok", string(result.Payload)
+		if result.Status != "success" {
+			status, message = "failed", result.Message
+		}
+		if err := src.Callback(dst.ChainID(), cb.Index, status, message); err != nil {
+			return fmt.Errorf("callback request %d: %w", cb.Index, err)
+		}
+		if err := r.cursors.RemoveCallback(cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,466 @@
+package relayer
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// 创建两条模拟链chainA、chainB，chainB登记chainA为来源链
+func newChains(t *testing.T) (*MockChain, *MockChain) {
+	chainA, err := NewMockChain("chainA", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainB, err := NewMockChain("chainB", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(t, chainB, chainA)
+	return chainA, chainB
+}
+
+// 在local上登记remote及其公钥
+func register(t *testing.T, local *MockChain, remote *MockChain, capabilities ...string) {
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: remote.PublicKey()})
+	info, err := json.Marshal(map[string]interface{}{
+		"chainID":      remote.ChainID(),
+		"capabilities": capabilities,
+		"publicKey":    string(publicKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := local.Invoke("registerChain", string(info)); resp.Status != shim.OK {
+		t.Fatalf("register %s on %s: %s", remote.ChainID(), local.ChainID(), resp.Message)
+	}
+}
+
+// 从chainA向chainB中继的relayer，游标保存在临时目录
+func newRelayer(t *testing.T, path string, chainA *MockChain, chainB *MockChain) *Relayer {
+	store, err := OpenCursorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(store)
+	r.AddSource(chainA, chainA.PublicKey())
+	r.AddDestination(chainB)
+	return r
+}
+
+func modify(t *testing.T, chain *MockChain, dstChainID string, key string, value string) {
+	if resp := chain.Invoke("InterchainSingleModify", dstChainID, key, value); resp.Status != shim.OK {
+		t.Fatalf("InterchainSingleModify: %s", resp.Message)
+	}
+}
+
+func assertState(t *testing.T, chain *MockChain, key string, want string) {
+	t.Helper()
+	if got := string(chain.Business.State[key]); got != want {
+		t.Fatalf("%s on %s is %q, expecting %q", key, chain.ChainID(), got, want)
+	}
+}
+
+func TestRelayDelivers(t *testing.T) {
+	chainA, chainB := newChains(t)
+	r := newRelayer(t, filepath.Join(t.TempDir(), "cursors.json"), chainA, chainB)
+
+	modify(t, chainA, "chainB", "k1", "v1")
+	modify(t, chainA, "chainB", "k2", "v2")
+	n, err := r.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("delivered %d messages, expecting 2", n)
+	}
+	assertState(t, chainB, "k1", "v1")
+	assertState(t, chainB, "k2", "v2")
+
+	inMeta, err := chainB.InnerMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inMeta["chainA"] != 2 {
+		t.Fatalf("inner meta of chainA is %d, expecting 2", inMeta["chainA"])
+	}
+	if n, err := r.Poll(); err != nil || n != 0 {
+		t.Fatalf("second poll delivered %d messages, err %v", n, err)
+	}
+}
+
+func TestRelayResumesFromCursor(t *testing.T) {
+	chainA, chainB := newChains(t)
+	path := filepath.Join(t.TempDir(), "cursors.json")
+
+	modify(t, chainA, "chainB", "k1", "v1")
+	if _, err := newRelayer(t, path, chainA, chainB).Poll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后从游标文件继续
+	modify(t, chainA, "chainB", "k2", "v2")
+	r := newRelayer(t, path, chainA, chainB)
+	if got := r.cursors.Get("chainA", "chainB"); got != 1 {
+		t.Fatalf("cursor is %d after restart, expecting 1", got)
+	}
+	n, err := r.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("delivered %d messages after restart, expecting 1", n)
+	}
+	assertState(t, chainB, "k2", "v2")
+
+	// 游标文件丢失时以目的链的序号为准，不重复投递
+	r = newRelayer(t, filepath.Join(t.TempDir(), "cursors.json"), chainA, chainB)
+	if n, err := r.Poll(); err != nil || n != 0 {
+		t.Fatalf("poll with a lost cursor delivered %d messages, err %v", n, err)
+	}
+	if got := r.cursors.Get("chainA", "chainB"); got != 2 {
+		t.Fatalf("cursor is %d, expecting 2", got)
+	}
+}
+
+func TestRelayWaitsForIndexGap(t *testing.T) {
+	chainA, chainB := newChains(t)
+	r := newRelayer(t, filepath.Join(t.TempDir(), "cursors.json"), chainA, chainB)
+
+	modify(t, chainA, "chainB", "k1", "v1")
+	modify(t, chainA, "chainB", "k2", "v2")
+	if len(chainA.Events) != 2 {
+		t.Fatalf("chainA emitted %d events, expecting 2", len(chainA.Events))
+	}
+
+	// 序号2先到达时不投递
+	second := chainA.Events[1]
+	n, err := r.HandleEvent("chainA", second.EventName, second.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("delivered %d messages across a gap, expecting 0", n)
+	}
+	assertState(t, chainB, "k2", "")
+
+	first := chainA.Events[0]
+	if n, err := r.HandleEvent("chainA", first.EventName, first.Payload); err != nil || n != 1 {
+		t.Fatalf("first event delivered %d messages, err %v", n, err)
+	}
+	// 缺失的请求由轮询补齐，重复的事件被忽略
+	if n, err := r.HandleEvent("chainA", first.EventName, first.Payload); err != nil || n != 0 {
+		t.Fatalf("duplicate event delivered %d messages, err %v", n, err)
+	}
+	if n, err := r.Poll(); err != nil || n != 1 {
+		t.Fatalf("poll delivered %d messages, err %v", n, err)
+	}
+	assertState(t, chainB, "k1", "v1")
+	assertState(t, chainB, "k2", "v2")
+}
+
+func TestRelayHandlesBatchEvent(t *testing.T) {
+	chainA, chainB := newChains(t)
+	r := newRelayer(t, filepath.Join(t.TempDir(), "cursors.json"), chainA, chainB)
+
+	entries := `[{"dstChainID":"chainB","key":"k1","value":"v1"},{"dstChainID":"chainB","key":"k2","value":"v2"}]`
+	if resp := chainA.Invoke("InterchainBatchModify", entries); resp.Status != shim.OK {
+		t.Fatalf("InterchainBatchModify: %s", resp.Message)
+	}
+	if len(chainA.Events) != 1 || chainA.Events[0].EventName != BatchEventName {
+		t.Fatalf("chainA emitted %v, expecting one %s event", chainA.Events, BatchEventName)
+	}
+	event := chainA.Events[0]
+	if n, err := r.HandleEvent("chainA", event.EventName, event.Payload); err != nil || n != 2 {
+		t.Fatalf("batch event delivered %d messages, err %v", n, err)
+	}
+	assertState(t, chainB, "k1", "v1")
+	assertState(t, chainB, "k2", "v2")
+}
+
+func TestRelayRejectsBadSignature(t *testing.T) {
+	chainA, chainB := newChains(t)
+	r := newRelayer(t, filepath.Join(t.TempDir(), "cursors.json"), chainA, chainB)
+
+	modify(t, chainA, "chainB", "k1", "v1")
+	event := chainA.Events[0]
+	req := broker.RequestToPAPP{}
+	if err := json.Unmarshal(event.Payload, &req); err != nil {
+		t.Fatal(err)
+	}
+	req.CCRequest.Args = []string{"chainB", "k1", "forged"}
+	forged, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.HandleEvent("chainA", event.EventName, forged); err == nil || n != 0 {
+		t.Fatalf("forged request delivered %d messages, err %v", n, err)
+	}
+	assertState(t, chainB, "k1", "")
+
+	// 来源链公钥不匹配时同样拒绝
+	store, err := OpenCursorStore(filepath.Join(t.TempDir(), "cursors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKey := New(store)
+	wrongKey.AddSource(chainA, chainB.PublicKey())
+	wrongKey.AddDestination(chainB)
+	if n, err := wrongKey.Poll(); err == nil || n != 0 {
+		t.Fatalf("request with a wrong public key delivered %d messages, err %v", n, err)
+	}
+	assertState(t, chainB, "k1", "")
+
+	if n, err := r.Poll(); err != nil || n != 1 {
+		t.Fatalf("poll delivered %d messages, err %v", n, err)
+	}
+	assertState(t, chainB, "k1", "v1")
+}
+
+func TestCursorStoreReadsLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cursors.json")
+	if err := ioutil.WriteFile(path, []byte(`{"chainA":{"chainB":3}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenCursorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := store.Get("chainA", "chainB"); got != 3 {
+		t.Fatalf("cursor is %d, expecting 3", got)
+	}
+
+	// 写回后为新格式，待回调的请求一并保存
+	if err := store.AddCallbacks([]PendingCallback{{SrcChainID: "chainA", DstChainID: "chainB", Index: 4}}); err != nil {
+		t.Fatal(err)
+	}
+	store, err = OpenCursorStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := store.Get("chainA", "chainB"); got != 3 {
+		t.Fatalf("cursor is %d after rewrite, expecting 3", got)
+	}
+	if got := store.Callbacks("chainA", "chainB"); len(got) != 1 || got[0].Index != 4 {
+		t.Fatalf("pending callbacks are %+v", got)
+	}
+}
+
+// 以指定中继身份提交的目的链
+type relayerIdentity struct {
+	*MockChain
+	creator []byte
+}
+
+func (dst *relayerIdentity) QuorumDeliver(msgs []broker.CrossChainRequest) ([]broker.DeliverResult, error) {
+	dst.Broker.Creator = dst.creator
+	defer func() { dst.Broker.Creator = dst.Admin }()
+	return dst.MockChain.QuorumDeliver(msgs)
+}
+
+func TestRelayQuorumMode(t *testing.T) {
+	chainA, chainB := newChains(t)
+	relayers := make([]*Relayer, 0, 2)
+	ids := make([]string, 0, 2)
+	for _, mspID := range []string{"Org1MSP", "Org2MSP"} {
+		creator, err := MockIdentity(mspID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := &relayerIdentity{MockChain: chainB, creator: creator}
+		chainB.Broker.Creator = creator
+		ids = append(ids, string(chainB.Invoke("getRelayerID").Payload))
+		chainB.Broker.Creator = chainB.Admin
+
+		store, err := OpenCursorStore(filepath.Join(t.TempDir(), "cursors.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := New(store)
+		r.AddSource(chainA, chainA.PublicKey())
+		r.AddDestination(dst)
+		if err := r.SetMode("chainA", "chainB", ModeQuorum); err != nil {
+			t.Fatal(err)
+		}
+		relayers = append(relayers, r)
+	}
+	quorum, err := json.Marshal(broker.RelayerQuorum{Relayers: ids, Threshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := chainB.Invoke("setRelayers", "chainA", string(quorum)); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+
+	modify(t, chainA, "chainB", "k1", "v1")
+
+	// 未达到法定数量时不执行，游标不前进，不视为错误
+	if n, err := relayers[0].Poll(); err != nil || n != 0 {
+		t.Fatalf("first relayer delivered %d messages, err %v", n, err)
+	}
+	assertState(t, chainB, "k1", "")
+	if n, err := relayers[1].Poll(); err != nil || n != 1 {
+		t.Fatalf("second relayer delivered %d messages, err %v", n, err)
+	}
+	assertState(t, chainB, "k1", "v1")
+
+	// 第一个中继以目的链的序号为准，不再提交
+	if n, err := relayers[0].Poll(); err != nil || n != 0 {
+		t.Fatalf("first relayer delivered %d messages after execution, err %v", n, err)
+	}
+	if got := relayers[0].cursors.Get("chainA", "chainB"); got != 1 {
+		t.Fatalf("cursor is %d, expecting 1", got)
+	}
+}
+
+// 以请求本身作为证明的来源链
+type fakeProver struct {
+	*MockChain
+}
+
+func (src *fakeProver) Prove(mode string, req broker.RequestToPAPP) ([]byte, error) {
+	return json.Marshal(req.CCRequest)
+}
+
+// 收下证明后按批量方式投递的目的链，代替目的链的证明校验
+type fakeProofDestination struct {
+	*MockChain
+	modes []string
+}
+
+func (dst *fakeProofDestination) DeliverProof(mode string, srcChainID string, proof []byte) ([]broker.DeliverResult, error) {
+	dst.modes = append(dst.modes, mode)
+	req := broker.CrossChainRequest{}
+	if err := json.Unmarshal(proof, &req); err != nil {
+		return nil, err
+	}
+	msg, err := broker.ToInbound(req)
+	if err != nil {
+		return nil, err
+	}
+	return dst.Deliver([]broker.CrossChainRequest{msg}, deliverPolicy)
+}
+
+func TestRelayProofMode(t *testing.T) {
+	chainA, chainB := newChains(t)
+	dst := &fakeProofDestination{MockChain: chainB}
+	store, err := OpenCursorStore(filepath.Join(t.TempDir(), "cursors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(store)
+	// 证明方式不校验来源链签名
+	r.AddSource(&fakeProver{MockChain: chainA}, nil)
+	r.AddDestination(dst)
+	if err := r.SetMode("chainA", "chainB", "proof"); err == nil {
+		t.Fatal("unknown mode accepted")
+	}
+	if err := r.SetMode("chainA", "chainB", ModeEVM); err != nil {
+		t.Fatal(err)
+	}
+
+	modify(t, chainA, "chainB", "k1", "v1")
+	modify(t, chainA, "chainB", "k2", "v2")
+	if n, err := r.Poll(); err != nil || n != 2 {
+		t.Fatalf("poll delivered %d messages, err %v", n, err)
+	}
+	assertState(t, chainB, "k1", "v1")
+	assertState(t, chainB, "k2", "v2")
+	if len(dst.modes) != 2 || dst.modes[0] != ModeEVM {
+		t.Fatalf("proofs delivered as %v", dst.modes)
+	}
+
+	// 来源链不能生成证明时不投递
+	plain := New(store)
+	plain.AddSource(chainA, nil)
+	plain.AddDestination(dst)
+	if err := plain.SetMode("chainA", "chainB", ModeFabric); err != nil {
+		t.Fatal(err)
+	}
+	modify(t, chainA, "chainB", "k3", "v3")
+	if n, err := plain.Poll(); err == nil || !strings.Contains(err.Error(), "cannot prove") || n != 0 {
+		t.Fatalf("poll without a prover delivered %d messages, err %v", n, err)
+	}
+	assertState(t, chainB, "k3", "")
+}
+
+// 轮询来源链失败的来源链
+type unreachableSource struct {
+	*MockChain
+}
+
+func (src *unreachableSource) PollSignedEvents(cursor map[string]uint64) ([]broker.RequestToPAPP, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestRunReportsErrors(t *testing.T) {
+	chainA, chainB := newChains(t)
+	store, err := OpenCursorStore(filepath.Join(t.TempDir(), "cursors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(store)
+	r.AddSource(&unreachableSource{MockChain: chainA}, chainA.PublicKey())
+	r.AddDestination(chainB)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	errs := make([]error, 0)
+	r.OnError = func(err error) {
+		errs = append(errs, err)
+		cancel()
+	}
+	if err := r.Run(ctx, time.Millisecond); err != context.Canceled {
+		t.Fatalf("run returned %v", err)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "connection refused") {
+		t.Fatalf("reported errors are %v", errs)
+	}
+}
+
+func TestRelayLegacyInvoice(t *testing.T) {
+	chainA, chainB := newChains(t)
+	r := newRelayer(t, filepath.Join(t.TempDir(), "cursors.json"), chainA, chainB)
+
+	// 旧版字符串同样须携带状态并通过字段校验
+	legacy := "value-[fphm:12345678,fpdm:3100204130,jym:666666,zt:locked]"
+	modify(t, chainA, "chainB", "key-12345678", legacy)
+	if resp := chainA.Invoke("InterchainSingleModifyInvoice", "chainB", "key-87654321", "value-[fphm:87654321,fpdm:3100204130,jym:777777,zt:locked]"); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	if n, err := r.Poll(); err != nil || n != 2 {
+		t.Fatalf("poll delivered %d messages, err %v", n, err)
+	}
+	assertState(t, chainB, "key-12345678", legacy)
+	assertState(t, chainB, "key-87654321", `{"fphm":"87654321","fpdm":"3100204130","jym":"777777","zt":"locked"}`)
+	for _, fphm := range []string{"12345678", "87654321"} {
+		state := broker.InvoiceState{}
+		if err := json.Unmarshal(chainB.Invoke("getInvoiceState", "3100204130", fphm).Payload, &state); err != nil {
+			t.Fatal(err)
+		}
+		if state.Status != broker.InvoiceLocked || state.ChainID != "chainA" {
+			t.Fatalf("invoice %s state is %+v", fphm, state)
+		}
+	}
+
+	// 号码位数不符或未携带状态的旧版字符串在来源链即被拒绝
+	for _, value := range []string{"value-[fphm:213123,fpdm:1238123,jym:666666,zt:locked]", "value-[fphm:11111111,fpdm:3100204130,jym:666666]"} {
+		for _, function := range []string{"InterchainSingleModify", "InterchainSingleModifyInvoice"} {
+			if resp := chainA.Invoke(function, "chainB", "bad", value); resp.Status == shim.OK {
+				t.Fatalf("%s accepted %s", function, value)
+			}
+		}
+	}
+	if n, err := r.Poll(); err != nil || n != 0 {
+		t.Fatalf("poll delivered %d messages, err %v", n, err)
+	}
+}
@@ -0,0 +1,139 @@
+package relayer
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const reversedKey = "red-reversed-310020413012345678"
+
+// chainA、chainB、chainC三条链，chainB分别与chainA、chainC互相登记，各链配置冲红函数
+func newReversalChains(t *testing.T) (*MockChain, *MockChain, *MockChain, map[string]*Relayer) {
+	chainA, chainB, ab, ba := newTransferChains(t)
+	chainC, err := NewMockChain("chainC", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(t, chainB, chainC)
+	register(t, chainC, chainB)
+	for _, chain := range []*MockChain{chainA, chainB, chainC} {
+		if resp := chain.Invoke("setReversalFunc", "redReverse"); resp.Status != shim.OK {
+			t.Fatal(resp.Message)
+		}
+	}
+	dir := t.TempDir()
+	return chainA, chainB, chainC, map[string]*Relayer{
+		"ab": ab,
+		"ba": ba,
+		"bc": newRelayer(t, filepath.Join(dir, "bc.json"), chainB, chainC),
+		"cb": newRelayer(t, filepath.Join(dir, "cb.json"), chainC, chainB),
+	}
+}
+
+func sendInvoice(t *testing.T, chain *MockChain, dstChainID string, status string) {
+	t.Helper()
+	value := `{"fpdm":"3100204130","fphm":"12345678","zt":"` + status + `"}`
+	if resp := chain.Invoke("InterchainSingleModifyInvoice", dstChainID, "k1", value); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+}
+
+func reversalRecord(t *testing.T, chain *MockChain) broker.ReversalRecord {
+	t.Helper()
+	resp := chain.Invoke("getReversal", "3100204130", "12345678")
+	record := broker.ReversalRecord{}
+	if err := json.Unmarshal(resp.Payload, &record); err != nil {
+		t.Fatalf("reversal record on %s: %v", chain.ChainID(), err)
+	}
+	return record
+}
+
+func TestRedReverseForwardsToHolders(t *testing.T) {
+	chainA, chainB, chainC, r := newReversalChains(t)
+
+	// chainA在chainB上报销发票，chainB再将发票转移到chainC
+	for _, status := range []string{broker.InvoiceLocked, broker.InvoiceReimbursed} {
+		sendInvoice(t, chainA, "chainB", status)
+		poll(t, r["ab"])
+	}
+	if resp := chainB.Invoke("InterchainTransferInvoice", "chainC", "k1", transferInvoice); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	poll(t, r["bc"])
+	poll(t, r["cb"])
+	assertTransfer(t, chainB, "k1", "completed")
+
+	// 从其他链收到发票的链不能发起冲红
+	for _, chain := range []*MockChain{chainB, chainC} {
+		resp := chain.Invoke("InterchainRedReverse", "3100204130", "12345678")
+		if broker.ErrorCodeOf(resp.Message) != broker.CodeAccessDenied {
+			t.Fatalf("reversal started on %s returned %d %q", chain.ChainID(), resp.Status, resp.Message)
+		}
+	}
+
+	if resp := chainA.Invoke("InterchainRedReverse", "3100204130", "12345678"); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	poll(t, r["ab"])
+	assertInvoiceStatus(t, chainB, broker.InvoiceRedReversed)
+	if chainB.Business.State[reversedKey] == nil {
+		t.Fatal("reversal function not called on chainB")
+	}
+
+	// chainB确认chainA，并将冲红通知转发给chainC
+	poll(t, r["ba"])
+	if ack := reversalRecord(t, chainA).Acks["chainB"]; ack.Status != "ok" {
+		t.Fatalf("chainB acked %+v", ack)
+	}
+	poll(t, r["bc"])
+	assertInvoiceStatus(t, chainC, broker.InvoiceRedReversed)
+	if chainC.Business.State[reversedKey] == nil {
+		t.Fatal("reversal function not called on chainC")
+	}
+	poll(t, r["cb"])
+	record := reversalRecord(t, chainB)
+	if len(record.Chains) != 1 || record.Chains[0] != "chainC" || record.Acks["chainC"].Status != "ok" {
+		t.Fatalf("reversal record on chainB is %+v", record)
+	}
+}
+
+func TestRedReverseChecksReceiverState(t *testing.T) {
+	chainA, chainB, chainC, r := newReversalChains(t)
+
+	// chainA将发票锁定后解锁，chainB随后为chainC锁定该发票
+	for _, status := range []string{broker.InvoiceLocked, broker.InvoiceIssued} {
+		sendInvoice(t, chainA, "chainB", status)
+		poll(t, r["ab"])
+	}
+	sendInvoice(t, chainB, "chainC", broker.InvoiceLocked)
+	poll(t, r["bc"])
+	assertInvoiceStatus(t, chainB, broker.InvoiceLocked)
+
+	// chainB上的发票被chainC锁定，不能冲红：确认失败，不调用业务链
+	if resp := chainA.Invoke("InterchainRedReverse", "3100204130", "12345678"); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	poll(t, r["ab"])
+	assertInvoiceStatus(t, chainB, broker.InvoiceLocked)
+	if chainB.Business.State[reversedKey] != nil {
+		t.Fatal("reversal function called for a locked invoice")
+	}
+	poll(t, r["ba"])
+	ack := reversalRecord(t, chainA).Acks["chainB"]
+	if ack.Status != "failed" || broker.ErrorCodeOf(ack.Message) != broker.CodeInvalidTransition {
+		t.Fatalf("chainB acked %+v", ack)
+	}
+
+	// 未向本链发出过该发票的链不能通知冲红
+	register(t, chainC, chainA)
+	resp := chainC.Invoke("interchainRedReverse", "chainA", "chainC", "3100204130", "12345678")
+	if resp.Status == shim.OK || !strings.Contains(resp.Message, "did not send invoice") {
+		t.Fatalf("reversal from a chain that did not send the invoice returned %d %q", resp.Status, resp.Message)
+	}
+	assertInvoiceStatus(t, chainC, broker.InvoiceLocked)
+}
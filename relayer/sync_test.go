@@ -0,0 +1,340 @@
+package relayer
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/DXPlus/CrosschainContract/papp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// 模拟PAPP：将chainA的同步请求转交chainB执行，tamper不为nil时篡改chainB的应答
+func newPAPP(t *testing.T, chainA *MockChain, chainB *MockChain, tamper func([]byte) []byte) *papp.MockServer {
+	server := papp.NewMockServer(func(req papp.Request) ([]byte, error) {
+		signed := broker.RequestToPAPP{}
+		if err := json.Unmarshal(req.Message, &signed); err != nil {
+			return nil, err
+		}
+		msg, err := broker.ToInbound(signed.CCRequest)
+		if err != nil {
+			return nil, err
+		}
+		resp := chainB.Invoke(msg.Func, append([]string{msg.SrcChainID, msg.DstChainID}, msg.Args...)...)
+		if resp.Status != shim.OK {
+			return nil, errors.New(resp.Message)
+		}
+		if tamper != nil {
+			return tamper(resp.Payload), nil
+		}
+		return resp.Payload, nil
+	})
+	t.Cleanup(server.Close)
+	if resp := chainA.Invoke("modifyPAPPIP", server.URL); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	return server
+}
+
+func TestSyncQueryThroughPAPP(t *testing.T) {
+	chainA, chainB := newChains(t)
+	register(t, chainA, chainB)
+	server := newPAPP(t, chainA, chainB, nil)
+	chainB.Business.MockTransactionStart("seed")
+	chainB.Business.PutState("k1", []byte("v1"))
+	chainB.Business.MockTransactionEnd("seed")
+
+	resp := chainA.Invoke("InterchainSingleQuery", "chainB", "k1")
+	if resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	if string(resp.Payload) != "v1" {
+		t.Fatalf("query returned %q, expecting v1", resp.Payload)
+	}
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].RequestID != papp.RequestID("chainA", "chainB", 1) {
+		t.Fatalf("PAPP received %+v", requests)
+	}
+
+	// PAPP篡改应答时拒绝
+	server.SetHandler(func(req papp.Request) ([]byte, error) {
+		return []byte(`{"answer":{"requestID":"` + req.RequestID + `","chainID":"chainB","key":"k1","value":"Zm9yZ2Vk"}}`), nil
+	})
+	if resp := chainA.Invoke("InterchainSingleQuery", "chainB", "k1"); resp.Status == shim.OK {
+		t.Fatalf("forged answer accepted: %q", resp.Payload)
+	}
+}
+
+func TestAsyncInvokeCallback(t *testing.T) {
+	chainA, chainB := newChains(t)
+	register(t, chainA, chainB)
+	chainB.Business.MockTransactionStart("seed")
+	chainB.Business.PutState("k1", []byte("v1"))
+	chainB.Business.MockTransactionEnd("seed")
+
+	if resp := chainB.Invoke("registerService", broker.DefaultChaincodeID, "", `["interchainGet","missing"]`); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+
+	// 以interchainSet作为回调函数，回调结果写入chainA业务合约的chainB键
+	opts := `{"callback":"interchainSet"}`
+	if resp := chainA.Invoke("InterchainInvoke", "chainB", "", "interchainGet", `["k1"]`, opts); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	if resp := chainA.Invoke("InterchainInvoke", "chainB", "", "missing", `[]`, opts); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	r := newRelayer(t, filepath.Join(t.TempDir(), "cursors.json"), chainA, chainB)
+	if n, err := r.Poll(); err != nil || n != 2 {
+		t.Fatalf("poll delivered %d messages, err %v", n, err)
+	}
+
+	records := make([]broker.CallbackRecord, 0, 2)
+	for _, idx := range []string{"1", "2"} {
+		resp := chainA.Invoke("getCallback", "chainB", idx)
+		record := broker.CallbackRecord{}
+		if err := json.Unmarshal(resp.Payload, &record); err != nil {
+			t.Fatalf("callback %s: %v", idx, err)
+		}
+		records = append(records, record)
+	}
+	if records[0].Status != "ok" || records[0].Result != "v1" {
+		t.Fatalf("callback 1 is %+v", records[0])
+	}
+	if records[1].Status != "failed" || !strings.Contains(records[1].Result, "invalid function") {
+		t.Fatalf("callback 2 is %+v", records[1])
+	}
+
+	// 未经目的链签名的结果不能触发回调
+	if resp := chainA.Invoke("InterchainInvoke", "chainB", "", "interchainGet", `["k1"]`, opts); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	if resp := chainA.Invoke("interchainCallback", "chainB", "chainA", "3", "ok", "forged"); resp.Status == shim.OK {
+		t.Fatal("unsigned callback result accepted")
+	}
+}
+
+func TestInvokeRejectsUnlistedFunction(t *testing.T) {
+	chainA, chainB := newChains(t)
+	register(t, chainA, chainB)
+	if resp := chainB.Invoke("registerService", broker.DefaultChaincodeID, "", `["interchainGet"]`); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+
+	// 未列出的函数不能被跨链调用，即使是默认业务合约
+	opts := `{"callback":"interchainSet"}`
+	if resp := chainA.Invoke("InterchainInvoke", "chainB", "", "interchainSet", `["k1","forged"]`, opts); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	r := newRelayer(t, filepath.Join(t.TempDir(), "cursors.json"), chainA, chainB)
+	if _, err := r.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, chainB, "k1", "")
+
+	resp := chainA.Invoke("getCallback", "chainB", "1")
+	record := broker.CallbackRecord{}
+	if err := json.Unmarshal(resp.Payload, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != "failed" || broker.ErrorCodeOf(record.Result) != broker.CodeAccessDenied {
+		t.Fatalf("callback is %+v", record)
+	}
+}
+
+func TestExpireInvokeRequiresRequester(t *testing.T) {
+	chainA, _ := newChains(t)
+	opts := `{"callback":"interchainSet","timeout":600}`
+	if resp := chainA.Invoke("InterchainInvoke", "chainB", "", "interchainGet", `["k1"]`, opts); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+
+	other, err := MockIdentity("Org2MSP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainA.Broker.Creator = other
+	resp := chainA.Invoke("expireInvoke", "chainB", "1")
+	chainA.Broker.Creator = chainA.Admin
+	if broker.ErrorCodeOf(resp.Message) != broker.CodeAccessDenied {
+		t.Fatalf("expireInvoke by another MSP returned %d %q", resp.Status, resp.Message)
+	}
+
+	// 发起者也只能在超时后触发
+	if resp := chainA.Invoke("expireInvoke", "chainB", "1"); resp.Status == shim.OK || !strings.Contains(resp.Message, "has not timed out") {
+		t.Fatalf("expireInvoke before the deadline returned %d %q", resp.Status, resp.Message)
+	}
+}
+
+// 回调前若干次失败的来源链
+type flakySource struct {
+	*MockChain
+	failures int
+}
+
+func (src *flakySource) Callback(execChainID string, index uint64, status string, result string) error {
+	if src.failures > 0 {
+		src.failures--
+		return errors.New("source unavailable")
+	}
+	return src.MockChain.Callback(execChainID, index, status, result)
+}
+
+func TestCallbackRetriedAfterFailure(t *testing.T) {
+	chainA, chainB := newChains(t)
+	register(t, chainA, chainB)
+	chainB.Business.MockTransactionStart("seed")
+	chainB.Business.PutState("k1", []byte("v1"))
+	chainB.Business.MockTransactionEnd("seed")
+	if resp := chainB.Invoke("registerService", broker.DefaultChaincodeID, "", `["interchainGet"]`); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	if resp := chainA.Invoke("InterchainInvoke", "chainB", "", "interchainGet", `["k1"]`, `{"callback":"interchainSet"}`); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+
+	path := filepath.Join(t.TempDir(), "cursors.json")
+	newFlaky := func(failures int) *Relayer {
+		store, err := OpenCursorStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := New(store)
+		r.AddSource(&flakySource{MockChain: chainA, failures: failures}, chainA.PublicKey())
+		r.AddDestination(chainB)
+		return r
+	}
+
+	// 投递后回调失败，游标已前进，回调留在游标文件中
+	if n, err := newFlaky(1).Poll(); n != 1 || err == nil || !strings.Contains(err.Error(), "source unavailable") {
+		t.Fatalf("poll delivered %d messages, err %v", n, err)
+	}
+	if resp := chainA.Invoke("getCallback", "chainB", "1"); len(resp.Payload) != 0 {
+		t.Fatalf("callback recorded: %s", resp.Payload)
+	}
+
+	// 重启后的轮询向目的链查询结果并重试回调
+	r := newFlaky(0)
+	if got := r.cursors.Callbacks("chainA", "chainB"); len(got) != 1 || got[0].Index != 1 {
+		t.Fatalf("pending callbacks after restart are %+v", got)
+	}
+	if n, err := r.Poll(); err != nil || n != 0 {
+		t.Fatalf("poll delivered %d messages, err %v", n, err)
+	}
+	record := broker.CallbackRecord{}
+	if err := json.Unmarshal(chainA.Invoke("getCallback", "chainB", "1").Payload, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != "ok" || record.Result != "v1" {
+		t.Fatalf("callback is %+v", record)
+	}
+	if got := r.cursors.Callbacks("chainA", "chainB"); len(got) != 0 {
+		t.Fatalf("pending callbacks after retry are %+v", got)
+	}
+
+	// 已完成的回调再次提交视为成功
+	result, err := chainB.InMessage("chainA", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chainA.Callback("chainB", 1, "ok", string(result.Payload)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAnswerBindsQuery(t *testing.T) {
+	chainA, chainB := newChains(t)
+	register(t, chainA, chainB)
+	chainB.Business.MockTransactionStart("seed")
+	chainB.Business.PutState("310020413012345678", []byte(`{"fphm":"12345678","fpdm":"3100204130","jym":"12345678901234567890","je":"100.00"}`))
+	chainB.Business.MockTransactionEnd("seed")
+
+	// PAPP将核验请求中的校验码换成正确的校验码
+	newPAPP(t, chainA, chainB, nil).SetHandler(func(req papp.Request) ([]byte, error) {
+		signed := broker.RequestToPAPP{}
+		if err := json.Unmarshal(req.Message, &signed); err != nil {
+			return nil, err
+		}
+		msg, err := broker.ToInbound(signed.CCRequest)
+		if err != nil {
+			return nil, err
+		}
+		msg.Args[2] = "567890"
+		resp := chainB.Invoke(msg.Func, append([]string{msg.SrcChainID, msg.DstChainID}, msg.Args...)...)
+		if resp.Status != shim.OK {
+			return nil, errors.New(resp.Message)
+		}
+		return resp.Payload, nil
+	})
+
+	resp := chainA.Invoke("InterchainVerifyInvoice", "chainB", "3100204130", "12345678", "567890", "100.00")
+	if resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	signed := broker.SignedVerifyResult{}
+	if err := json.Unmarshal(resp.Payload, &signed); err != nil {
+		t.Fatal(err)
+	}
+	if !signed.Result.Match {
+		t.Fatalf("verify result is %+v", signed.Result)
+	}
+
+	resp = chainA.Invoke("InterchainVerifyInvoice", "chainB", "3100204130", "12345678", "000000", "100.00")
+	if resp.Status == shim.OK || !strings.Contains(resp.Message, "another jym or amount") {
+		t.Fatalf("answer for a substituted jym returned %d %q", resp.Status, resp.Message)
+	}
+}
+
+func aggregate(t *testing.T, chain *MockChain) broker.AggregateResult {
+	t.Helper()
+	resp := chain.Invoke("InterchainAggregateQuery", `{"pageSize":1}`)
+	if resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	result := broker.AggregateResult{}
+	if err := json.Unmarshal(resp.Payload, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestAggregateReportsInvalidAmounts(t *testing.T) {
+	chainA, chainB := newChains(t)
+	register(t, chainA, chainB, "InterchainAggregateQuery")
+	newPAPP(t, chainA, chainB, nil)
+	chainB.Business.MockTransactionStart("seed")
+	chainB.Business.PutState("1", []byte(`{"fphm":"00000001","fpdm":"3100204130","je":"100.00","se":"13.00"}`))
+	chainB.Business.PutState("2", []byte(`{"fphm":"00000002","fpdm":"3100204130","je":"50.50"}`))
+	chainB.Business.PutState("3", []byte(`{"fphm":"00000003","fpdm":"3100204130","je":"1e3"}`))
+	chainB.Business.MockTransactionEnd("seed")
+
+	// 金额无法解析的发票单独列出，不计入张数与合计
+	result := aggregate(t, chainA)
+	if result.Total != 2 || result.Summary.Amount != "150.50" || result.Summary.Tax != "13.00" || len(result.Invoices) != 1 {
+		t.Fatalf("aggregate result is %+v", result)
+	}
+	if result.InvalidCount != 1 || len(result.Invalid) != 1 || result.Invalid[0].Fphm != "00000003" {
+		t.Fatalf("invalid invoices are %+v", result.Invalid)
+	}
+
+	// 保存的归集记录只有统计值与摘要
+	record := broker.AggregateResult{}
+	if err := json.Unmarshal(chainA.Invoke("getMultiQueryResult", result.QueryID).Payload, &record); err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Invoices) != 0 || record.Invalid != nil || record.Digest != result.Digest || record.Summary != result.Summary || record.InvalidCount != 1 {
+		t.Fatalf("stored record is %+v", record)
+	}
+
+	// 合计超出int64的链视为未应答
+	chainB.Business.MockTransactionStart("seed")
+	chainB.Business.PutState("4", []byte(`{"fphm":"00000004","fpdm":"3100204130","je":"92233720368547758.07"}`))
+	chainB.Business.MockTransactionEnd("seed")
+	result = aggregate(t, chainA)
+	if len(result.Missing) != 1 || !strings.Contains(result.Errors["chainB"], "out of range") || result.Total != 0 {
+		t.Fatalf("overflowing aggregate result is %+v", result)
+	}
+}
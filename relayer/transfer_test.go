@@ -0,0 +1,192 @@
+package relayer
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DXPlus/CrosschainContract/broker"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const transferInvoice = `{"fpdm":"3100204130","fphm":"12345678"}`
+
+// 两条互相登记的模拟链及双向的relayer
+func newTransferChains(t *testing.T) (*MockChain, *MockChain, *Relayer, *Relayer) {
+	chainA, chainB := newChains(t)
+	register(t, chainA, chainB)
+	dir := t.TempDir()
+	return chainA, chainB, newRelayer(t, filepath.Join(dir, "ab.json"), chainA, chainB), newRelayer(t, filepath.Join(dir, "ba.json"), chainB, chainA)
+}
+
+func poll(t *testing.T, r *Relayer) {
+	t.Helper()
+	if _, err := r.Poll(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertTransfer(t *testing.T, chain *MockChain, key string, status string) broker.TransferRecord {
+	t.Helper()
+	resp := chain.Invoke("getTransfer", key)
+	if resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	record := broker.TransferRecord{}
+	if err := json.Unmarshal(resp.Payload, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Status != status {
+		t.Fatalf("transfer of %s on %s is %+v, expecting %s", key, chain.ChainID(), record, status)
+	}
+	return record
+}
+
+func assertInvoiceStatus(t *testing.T, chain *MockChain, status string) {
+	t.Helper()
+	resp := chain.Invoke("getInvoiceState", "3100204130", "12345678")
+	state := broker.InvoiceState{}
+	if err := json.Unmarshal(resp.Payload, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != status {
+		t.Fatalf("invoice on %s is %s, expecting %s", chain.ChainID(), state.Status, status)
+	}
+}
+
+func TestTransferInCannotResetReimbursedInvoice(t *testing.T) {
+	chainA, chainB, ab, _ := newTransferChains(t)
+	chainC, err := NewMockChain("chainC", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(t, chainB, chainC)
+	register(t, chainC, chainB)
+	cb := newRelayer(t, filepath.Join(t.TempDir(), "cb.json"), chainC, chainB)
+	bc := newRelayer(t, filepath.Join(t.TempDir(), "bc.json"), chainB, chainC)
+
+	// chainA在chainB上报销发票
+	for _, status := range []string{broker.InvoiceLocked, broker.InvoiceReimbursed} {
+		value := `{"fpdm":"3100204130","fphm":"12345678","zt":"` + status + `"}`
+		if resp := chainA.Invoke("InterchainSingleModifyInvoice", "chainB", "k1", value); resp.Status != shim.OK {
+			t.Fatal(resp.Message)
+		}
+		poll(t, ab)
+	}
+	assertInvoiceStatus(t, chainB, broker.InvoiceReimbursed)
+
+	// chainC将同一发票以已开具状态转入chainB
+	if resp := chainC.Invoke("InterchainTransferInvoice", "chainB", "k1", transferInvoice); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	poll(t, cb)
+	assertInvoiceStatus(t, chainB, broker.InvoiceReimbursed)
+	poll(t, bc)
+	record := assertTransfer(t, chainC, "k1", "failed")
+	if broker.ErrorCodeOf(record.Message) != broker.CodeInvalidTransition {
+		t.Fatalf("transfer failed with %q", record.Message)
+	}
+}
+
+func TestTransferChecksLocalInvoiceState(t *testing.T) {
+	chainA, _, _, _ := newTransferChains(t)
+
+	// chainA记录的发票状态为锁定
+	locked := `{"fpdm":"3100204130","fphm":"12345678","zt":"locked"}`
+	if resp := chainA.Invoke("InterchainSingleModifyInvoice", "chainB", "k1", locked); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	resp := chainA.Invoke("InterchainTransferInvoice", "chainB", "k1", transferInvoice)
+	if broker.ErrorCodeOf(resp.Message) != broker.CodeInvalidTransition {
+		t.Fatalf("transfer of a locked invoice returned %d %q", resp.Status, resp.Message)
+	}
+
+	// 报销后转移的发票状态须与本链记录一致，未携带状态时沿用本链记录
+	reimbursed := `{"fpdm":"3100204130","fphm":"12345678","zt":"reimbursed"}`
+	if resp := chainA.Invoke("InterchainSingleModifyInvoice", "chainB", "k1", reimbursed); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	issued := `{"fpdm":"3100204130","fphm":"12345678","zt":"issued"}`
+	resp = chainA.Invoke("InterchainTransferInvoice", "chainB", "k1", issued)
+	if broker.ErrorCodeOf(resp.Message) != broker.CodeInvalidTransition {
+		t.Fatalf("transfer with a stale status returned %d %q", resp.Status, resp.Message)
+	}
+	if resp := chainA.Invoke("InterchainTransferInvoice", "chainB", "k1", transferInvoice); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+}
+
+func TestTransferOutFailureIsRetryable(t *testing.T) {
+	chainA, chainB, ab, ba := newTransferChains(t)
+	chainA.Business.State["k1"] = []byte(transferInvoice)
+	if resp := chainA.Invoke("setTransferFunc", "missing"); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+
+	if resp := chainA.Invoke("InterchainTransferInvoice", "chainB", "k1", transferInvoice); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	poll(t, ab)
+	poll(t, ba)
+	// 目的链已创建，转出失败时发票保持锁定
+	assertTransfer(t, chainA, "k1", "out-pending")
+	if len(chainB.Business.State["k1"]) == 0 {
+		t.Fatal("invoice was not created on chainB")
+	}
+	if resp := chainA.Invoke("InterchainTransferInvoice", "chainB", "k1", transferInvoice); broker.ErrorCodeOf(resp.Message) != broker.CodeInFlight {
+		t.Fatalf("transfer during out-pending returned %d %q", resp.Status, resp.Message)
+	}
+
+	if resp := chainA.Invoke("setTransferFunc", "interchainTransferOut"); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	if resp := chainA.Invoke("retryTransferOut", "k1"); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	assertTransfer(t, chainA, "k1", "completed")
+	assertState(t, chainA, "k1", "")
+	if resp := chainA.Invoke("retryTransferOut", "k1"); resp.Status == shim.OK {
+		t.Fatal("retry of a completed transfer succeeded")
+	}
+}
+
+func TestCancelledTransferAwaitsReceipt(t *testing.T) {
+	chainA, chainB, ab, ba := newTransferChains(t)
+	chainA.Business.State["k1"] = []byte(transferInvoice)
+	k2 := `{"fpdm":"3100204130","fphm":"87654321"}`
+
+	// k1在截止时间前已转入chainB，k2尚未投递
+	if resp := chainA.Invoke("InterchainTransferInvoice", "chainB", "k1", transferInvoice, "1"); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	poll(t, ab)
+	if resp := chainA.Invoke("InterchainTransferInvoice", "chainB", "k2", k2, "1"); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+	time.Sleep(2 * time.Second)
+
+	for _, key := range []string{"k1", "k2"} {
+		if resp := chainA.Invoke("cancelTransfer", key); resp.Status != shim.OK {
+			t.Fatal(resp.Message)
+		}
+		// 收到回执前不能再次转移
+		resp := chainA.Invoke("InterchainTransferInvoice", "chainB", key, transferInvoice)
+		if broker.ErrorCodeOf(resp.Message) != broker.CodeInFlight {
+			t.Fatalf("transfer of cancelled %s returned %d %q", key, resp.Status, resp.Message)
+		}
+	}
+
+	poll(t, ab)
+	poll(t, ba)
+	// 迟到的成功回执完成转出，发票只留在chainB上
+	assertTransfer(t, chainA, "k1", "completed")
+	assertState(t, chainA, "k1", "")
+	if len(chainB.Business.State["k1"]) == 0 {
+		t.Fatal("invoice was not created on chainB")
+	}
+	assertTransfer(t, chainA, "k2", "failed")
+	if resp := chainA.Invoke("InterchainTransferInvoice", "chainB", "k2", k2); resp.Status != shim.OK {
+		t.Fatal(resp.Message)
+	}
+}